@@ -77,7 +77,7 @@ resource "aws_dynamodb_table" "workers" {
     hash_key           = "pool"
     range_key          = "cap"
     projection_type    = "INCLUDE"
-    non_key_attributes = ["ttl"]
+    non_key_attributes = ["ttl", "lbl", "zone", "disk", "cpus", "mem", "dver"]
     write_capacity     = 1
     read_capacity      = 1
   }
@@ -112,3 +112,213 @@ resource "aws_dynamodb_table" "allocs" {
     non_key_attributes = ["wrk", "eval"]
   }
 }
+
+resource "aws_dynamodb_table" "evals" {
+  name = "${data.template_file.p.rendered}-evals"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "eval"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "eval"
+    type = "S"
+  }
+
+  attribute {
+    name = "dfr" //only present while deferred
+    type = "N"
+  }
+
+  local_secondary_index {
+    name               = "dfr_idx"
+    range_key          = "dfr"
+    projection_type    = "INCLUDE"
+    non_key_attributes = ["st", "def"]
+  }
+}
+
+resource "aws_dynamodb_table" "schedules" {
+  name = "${data.template_file.p.rendered}-schedules"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "sched"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "sched"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "workflows" {
+  name = "${data.template_file.p.rendered}-workflows"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "wf"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "wf"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "runs" {
+  name = "${data.template_file.p.rendered}-runs"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "run"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "run"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "triggers" {
+  name = "${data.template_file.p.rendered}-triggers"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "trig"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "trig"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "firings" {
+  name = "${data.template_file.p.rendered}-firings"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "fire"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "fire"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "datasets" {
+  name = "${data.template_file.p.rendered}-datasets"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "set"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "set"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "versions" {
+  name = "${data.template_file.p.rendered}-versions"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "ver"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "ver"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "checkouts" {
+  name = "${data.template_file.p.rendered}-checkouts"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "co"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "co"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "lineage" {
+  name = "${data.template_file.p.rendered}-lineage"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "lin"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "lin"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "logs" {
+  name = "${data.template_file.p.rendered}-logs"
+  read_capacity = 1
+  write_capacity = 1
+  hash_key = "pool"
+  range_key = "chunk"
+
+  attribute {
+    name = "pool"
+    type = "S"
+  }
+
+  attribute {
+    name = "chunk"
+    type = "S"
+  }
+}
@@ -95,6 +95,17 @@ data "aws_iam_policy_document" "runtime" {
       "${aws_dynamodb_table.allocs.arn}*",
       "${aws_dynamodb_table.replicas.arn}*",
       "${aws_dynamodb_table.pools.arn}*",
+      "${aws_dynamodb_table.evals.arn}*",
+      "${aws_dynamodb_table.schedules.arn}*",
+      "${aws_dynamodb_table.workflows.arn}*",
+      "${aws_dynamodb_table.runs.arn}*",
+      "${aws_dynamodb_table.triggers.arn}*",
+      "${aws_dynamodb_table.firings.arn}*",
+      "${aws_dynamodb_table.datasets.arn}*",
+      "${aws_dynamodb_table.versions.arn}*",
+      "${aws_dynamodb_table.checkouts.arn}*",
+      "${aws_dynamodb_table.lineage.arn}*",
+      "${aws_dynamodb_table.logs.arn}*",
     ]
   }
 }
@@ -29,6 +29,7 @@ data "template_file" "env" {
     "LINE_WORKER_TTL" = "60"
     "LINE_REPLICA_TTL" = "30"
     "LINE_ALLOC_TTL" = "30"
+    "LINE_LOG_TTL" = "604800"
     "LINE_MAX_RETRY" = "3"
 
     "LINE_SCHEDULE_DLQUEUE_URL" = "${aws_sqs_queue.schedule_dlq.id}"
@@ -41,6 +42,18 @@ data "template_file" "env" {
     "LINE_TABLE_IDX_WORKERS_CAP" = "${lookup(aws_dynamodb_table.workers.global_secondary_index[0], "name")}"
     "LINE_TABLE_IDX_ALLOCS_TTL" = "${lookup(aws_dynamodb_table.allocs.local_secondary_index[0], "name")}"
     "LINE_TABLE_NAME_ALLOCS" = "${aws_dynamodb_table.allocs.name}"
+    "LINE_TABLE_NAME_EVALS" = "${aws_dynamodb_table.evals.name}"
+    "LINE_TABLE_IDX_EVALS_DEFER" = "${lookup(aws_dynamodb_table.evals.local_secondary_index[0], "name")}"
+    "LINE_TABLE_NAME_SCHEDULES" = "${aws_dynamodb_table.schedules.name}"
+    "LINE_TABLE_NAME_WORKFLOWS" = "${aws_dynamodb_table.workflows.name}"
+    "LINE_TABLE_NAME_RUNS" = "${aws_dynamodb_table.runs.name}"
+    "LINE_TABLE_NAME_TRIGGERS" = "${aws_dynamodb_table.triggers.name}"
+    "LINE_TABLE_NAME_FIRINGS" = "${aws_dynamodb_table.firings.name}"
+    "LINE_TABLE_NAME_DATASETS" = "${aws_dynamodb_table.datasets.name}"
+    "LINE_TABLE_NAME_VERSIONS" = "${aws_dynamodb_table.versions.name}"
+    "LINE_TABLE_NAME_CHECKOUTS" = "${aws_dynamodb_table.checkouts.name}"
+    "LINE_TABLE_NAME_LINEAGE" = "${aws_dynamodb_table.lineage.name}"
+    "LINE_TABLE_NAME_LOGS" = "${aws_dynamodb_table.logs.name}"
   }
 }
 
@@ -0,0 +1,216 @@
+package line
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+//LabelExpr is a condition on the labels a worker registered with
+type LabelExpr struct {
+	Key      string   `dynamodbav:"k"`
+	Operator string   `dynamodbav:"op"`
+	Values   []string `dynamodbav:"v,omitempty"`
+	Weight   int      `dynamodbav:"w,omitempty"` //only used when the expression is a preference
+}
+
+//AntiAffinity prevents placement near the allocs of another eval
+type AntiAffinity struct {
+	EvalID string `dynamodbav:"eval"`
+	Scope  string `dynamodbav:"scope,omitempty"` //empty means the worker itself, else the label key that should differ
+}
+
+//NewLabelExprs converts label expressions from client payloads while validating them
+func NewLabelExprs(exprs []*client.LabelExpr) (les []*LabelExpr, err error) {
+	for _, e := range exprs {
+		le := &LabelExpr{Key: e.Key, Operator: e.Operator, Values: e.Values, Weight: e.Weight}
+		if err = le.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid label expression %+v", e)
+		}
+
+		les = append(les, le)
+	}
+
+	return les, nil
+}
+
+//NewAntiAffinities converts anti-affinity rules from client payloads
+func NewAntiAffinities(aafs []*client.AntiAffinity) (rules []*AntiAffinity, err error) {
+	for _, a := range aafs {
+		if a.EvalID == "" {
+			return nil, errors.New("anti-affinity rule without an eval id")
+		}
+
+		rules = append(rules, &AntiAffinity{EvalID: a.EvalID, Scope: a.Scope})
+	}
+
+	return rules, nil
+}
+
+//Validate checks if the expression is well-formed
+func (e *LabelExpr) Validate() error {
+	if e.Key == "" {
+		return errors.New("label key is empty")
+	}
+
+	switch e.Operator {
+	case client.OpIn, client.OpNotIn:
+		if len(e.Values) < 1 {
+			return errors.Errorf("operator '%s' requires at least one value", e.Operator)
+		}
+	case client.OpExists, client.OpNotExists:
+		if len(e.Values) > 0 {
+			return errors.Errorf("operator '%s' doesn't take values", e.Operator)
+		}
+	default:
+		return errors.Errorf("unknown operator '%s'", e.Operator)
+	}
+
+	return nil
+}
+
+//Match returns whether the labels satisfy the expression
+func (e *LabelExpr) Match(labels map[string]string) bool {
+	v, ok := labels[e.Key]
+	switch e.Operator {
+	case client.OpExists:
+		return ok
+	case client.OpNotExists:
+		return !ok
+	case client.OpIn:
+		return ok && contains(e.Values, v)
+	case client.OpNotIn:
+		return !ok || !contains(e.Values, v)
+	default:
+		return false
+	}
+}
+
+//Eligible returns whether a worker isn't excluded, satisfies all required labels of the eval and isn't in conflict with the workers that hold allocs of each anti-affinity rule
+func (eval *Eval) Eligible(w *Worker, conflicts map[*AntiAffinity][]*Worker) bool {
+	if contains(eval.Exclude, w.WorkerID) {
+		return false
+	}
+
+	for _, e := range eval.Constraints {
+		if !e.Match(w.Labels) {
+			return false
+		}
+	}
+
+	for _, rule := range eval.AntiAffinity {
+		for _, c := range conflicts[rule] {
+			if rule.Scope == "" {
+				if c.WorkerID == w.WorkerID {
+					return false
+				}
+
+				continue
+			}
+
+			cv, ok := c.Labels[rule.Scope]
+			if ok && cv == w.Labels[rule.Scope] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+//Score sums the weights of preferred label expressions the worker matches, higher is better
+func (eval *Eval) Score(w *Worker) (score int) {
+	for _, e := range eval.Preferences {
+		if e.Match(w.Labels) {
+			weight := e.Weight
+			if weight < 1 {
+				weight = 1
+			}
+
+			score += weight
+		}
+	}
+
+	return score
+}
+
+//FindConflicts returns, for each anti-affinity rule of the eval, the workers that currently hold allocs of the eval the rule refers to. If that is an array eval the allocs of its children count as well
+func FindConflicts(conf *Conf, svc *Services, eval *Eval, pool *Pool) (conflicts map[*AntiAffinity][]*Worker, err error) {
+	conflicts = map[*AntiAffinity][]*Worker{}
+	workers := map[string]*Worker{}
+	for _, rule := range eval.AntiAffinity {
+		idattr, err := dynamodbattribute.Marshal(rule.EvalID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal eval id")
+		}
+
+		poolattr, err := dynamodbattribute.Marshal(pool.PoolID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal pool id")
+		}
+
+		seen := map[string]struct{}{}
+		if err = svc.DB.QueryPages(&dynamodb.QueryInput{
+			TableName:              aws.String(conf.AllocsTableName),
+			KeyConditionExpression: aws.String("#pool = :poolID"),
+			FilterExpression:       aws.String("#eval.#id = :evalID OR #eval.#par = :evalID"),
+			ExpressionAttributeNames: map[string]*string{
+				"#pool": aws.String("pool"),
+				"#eval": aws.String("eval"),
+				"#id":   aws.String("id"),
+				"#par":  aws.String("par"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":poolID": poolattr,
+				":evalID": idattr,
+			},
+		}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+			for _, item := range page.Items {
+				alloc := &Alloc{}
+				err := dynamodbattribute.UnmarshalMap(item, alloc)
+				if err != nil {
+					svc.Logs.Error("failed to unmarshal alloc item", zap.Error(err))
+					continue
+				}
+
+				if _, ok := seen[alloc.WorkerID]; ok {
+					continue
+				}
+
+				seen[alloc.WorkerID] = struct{}{}
+				worker, ok := workers[alloc.WorkerID]
+				if !ok {
+					worker, err = GetWorker(conf, svc.DB, WorkerPK{PoolID: alloc.PoolID, WorkerID: alloc.WorkerID})
+					if err != nil {
+						//the worker may be gone but we still want to stay away from it by id
+						svc.Logs.Info("failed to get conflicting worker", zap.String("wrk", alloc.WorkerID), zap.Error(err))
+						worker = &Worker{WorkerPK: WorkerPK{PoolID: alloc.PoolID, WorkerID: alloc.WorkerID}}
+					}
+
+					workers[alloc.WorkerID] = worker
+				}
+
+				conflicts[rule] = append(conflicts[rule], worker)
+			}
+
+			return true
+		}); err != nil {
+			return nil, errors.Wrap(err, "failed to query allocs")
+		}
+	}
+
+	return conflicts, nil
+}
+
+func contains(vals []string, v string) bool {
+	for _, val := range vals {
+		if val == v {
+			return true
+		}
+	}
+
+	return false
+}
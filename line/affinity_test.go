@@ -0,0 +1,57 @@
+package line
+
+import (
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestLabelExprMatch(t *testing.T) {
+	labels := map[string]string{"zone": "eu-west-1a", "ssd": "true"}
+	for i, c := range []struct {
+		expr *LabelExpr
+		exp  bool
+	}{
+		{&LabelExpr{Key: "zone", Operator: client.OpIn, Values: []string{"eu-west-1a", "eu-west-1b"}}, true},
+		{&LabelExpr{Key: "zone", Operator: client.OpIn, Values: []string{"eu-west-1b"}}, false},
+		{&LabelExpr{Key: "zone", Operator: client.OpNotIn, Values: []string{"eu-west-1b"}}, true},
+		{&LabelExpr{Key: "gpu", Operator: client.OpNotIn, Values: []string{"k80"}}, true},
+		{&LabelExpr{Key: "ssd", Operator: client.OpExists}, true},
+		{&LabelExpr{Key: "ssd", Operator: client.OpNotExists}, false},
+		{&LabelExpr{Key: "ssd", Operator: "~="}, false},
+	} {
+		if act := c.expr.Match(labels); act != c.exp {
+			t.Errorf("case %d: expected %v, got %v", i, c.exp, act)
+		}
+	}
+}
+
+func TestEvalEligible(t *testing.T) {
+	w1 := &Worker{WorkerPK: WorkerPK{WorkerID: "w1"}, Labels: map[string]string{"zone": "a"}}
+	w2 := &Worker{WorkerPK: WorkerPK{WorkerID: "w2"}, Labels: map[string]string{"zone": "a"}}
+	w3 := &Worker{WorkerPK: WorkerPK{WorkerID: "w3"}, Labels: map[string]string{"zone": "b"}}
+
+	rule := &AntiAffinity{EvalID: "e1"}
+	eval := &Eval{AntiAffinity: []*AntiAffinity{rule}}
+	if eval.Eligible(w1, map[*AntiAffinity][]*Worker{rule: {w1}}) || !eval.Eligible(w2, map[*AntiAffinity][]*Worker{rule: {w1}}) {
+		t.Errorf("expected worker anti-affinity to only exclude the conflicting worker")
+	}
+
+	rule = &AntiAffinity{EvalID: "e1", Scope: "zone"}
+	eval = &Eval{AntiAffinity: []*AntiAffinity{rule}}
+	if eval.Eligible(w2, map[*AntiAffinity][]*Worker{rule: {w1}}) || !eval.Eligible(w3, map[*AntiAffinity][]*Worker{rule: {w1}}) {
+		t.Errorf("expected zone anti-affinity to exclude all workers in the conflicting zone")
+	}
+
+	//a worker that conflicts with one rule doesn't count for the scope of another
+	byWorker, byZone := &AntiAffinity{EvalID: "e1"}, &AntiAffinity{EvalID: "e2", Scope: "zone"}
+	eval = &Eval{AntiAffinity: []*AntiAffinity{byWorker, byZone}}
+	if !eval.Eligible(w2, map[*AntiAffinity][]*Worker{byWorker: {w1}, byZone: {w3}}) {
+		t.Errorf("expected conflicts to only apply to the rule they were found for")
+	}
+
+	eval = &Eval{Preferences: []*LabelExpr{{Key: "zone", Operator: client.OpIn, Values: []string{"b"}, Weight: 5}}}
+	if eval.Score(w3) != 5 || eval.Score(w1) != 0 {
+		t.Errorf("expected preference weight to be scored")
+	}
+}
@@ -17,9 +17,11 @@ type AllocPK struct {
 //Alloc represents a planned execution
 type Alloc struct {
 	AllocPK
-	TTL      int64  `dynamodbav:"ttl"`
-	WorkerID string `dynamodbav:"wrk"`
-	Eval     *Eval  `dynamodbav:"eval"`
+	TTL      int64   `dynamodbav:"ttl"`
+	WorkerID string  `dynamodbav:"wrk"`
+	Eval     *Eval   `dynamodbav:"eval"`
+	CPUs     float64 `dynamodbav:"cpus,omitempty"` //claimed on the worker, given back when the alloc is released
+	MemoryMB int64   `dynamodbav:"mem,omitempty"`  //claimed on the worker, given back when the alloc is released
 }
 
 var (
@@ -115,3 +117,46 @@ func UpdateAllocTTL(conf *Conf, db DB, ttl int64, apk AllocPK) (err error) {
 
 	return nil
 }
+
+//ListWorkerAllocs returns the allocs that are placed on a worker
+func ListWorkerAllocs(conf *Conf, db DB, pk WorkerPK) (allocs []*Alloc, err error) {
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		PoolID   string `dynamodbav:":poolID"`
+		WorkerID string `dynamodbav:":workerID"`
+	}{pk.PoolID, pk.WorkerID})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal query values")
+	}
+
+	var ierr error
+	if err = db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.AllocsTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID"),
+		FilterExpression:       aws.String("#wrk = :workerID"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+			"#wrk":  aws.String("wrk"),
+		},
+		ExpressionAttributeValues: vals,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			alloc := &Alloc{}
+			ierr = dynamodbattribute.UnmarshalMap(item, alloc)
+			if ierr != nil {
+				return false
+			}
+
+			allocs = append(allocs, alloc)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query allocs")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal alloc")
+	}
+
+	return allocs, nil
+}
@@ -0,0 +1,381 @@
+package line
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//MaxArraySize is the largest number of children a single array eval may expand into
+const MaxArraySize = 10000
+
+//MaxSweepBytes limits the encoded size of an array eval's parameter maps, they are kept on the parent's record which must stay well below the item size limit of 400KB
+const MaxSweepBytes = 256 * 1024
+
+//FmtChildEvalID formats the id of an array eval's child such that all children can be queried by prefix
+func FmtChildEvalID(parentID string, index int) string {
+	return fmt.Sprintf("%s-%d", parentID, index)
+}
+
+//ArrayChunkSize is the number of children an array eval is expanded into each time its message is received
+const ArrayChunkSize = 100
+
+//submitArrayEval records the parent eval and sends it to the scheduling queue, the scheduler expands it into its children. The parent stays pending until its children are done
+func submitArrayEval(conf *Conf, svc *Services, pool *Pool, eval *Eval) (rec *EvalRecord, err error) {
+	rec = &EvalRecord{
+		EvalPK: EvalPK{PoolID: pool.PoolID, EvalID: eval.EvalID},
+		State:  client.EvalStatePending,
+		Eval:   eval,
+		Counts: map[string]int{client.EvalStatePending: eval.Count}, //children that weren't expanded yet count as pending
+	}
+
+	if eval.NotBefore-time.Now().Unix() > MaxQueueDelay {
+		rec.State = client.EvalStateDeferred
+		rec.Deferred = eval.NotBefore
+	}
+
+	err = PutNewEval(conf, svc.DB, rec)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to put parent eval")
+	}
+
+	if rec.State == client.EvalStateDeferred {
+		return rec, nil
+	}
+
+	err = EnqueueEval(conf, svc, pool, eval)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to enqueue parent eval")
+	}
+
+	return rec, nil
+}
+
+//expandArrayEval records and enqueues the next chunk of children of an array eval, it returns true once all children were expanded. Each chunk is claimed on the parent first such that schedulers that receive the same message expand different chunks
+func expandArrayEval(conf *Conf, svc *Services, pool *Pool, rec *EvalRecord) (done bool, err error) {
+	parent := rec.Eval
+	from, to := rec.Expanded, minInt(rec.Expanded+ArrayChunkSize, parent.Count)
+	if from >= parent.Count {
+		if len(parent.Sweep) > 0 {
+			if err = setExpanded(conf, svc.DB, rec.EvalPK, from, from, true); err != nil && err != ErrEvalStateChanged {
+				return false, errors.Wrap(err, "failed to clear array parameters")
+			}
+		}
+
+		return true, nil
+	}
+
+	if err = setExpanded(conf, svc.DB, rec.EvalPK, from, to, false); err == ErrEvalStateChanged {
+		return false, nil //claimed by another scheduler or cancelled, the message is received again
+	} else if err != nil {
+		return false, errors.Wrap(err, "failed to claim children")
+	}
+
+	var children []*EvalRecord
+	var evals []*Eval
+	for i := from; i < to; i++ {
+		child := *parent
+		child.EvalID = FmtChildEvalID(parent.EvalID, i)
+		child.Count, child.Sweep = 0, nil
+		child.ParentID, child.Index = parent.EvalID, i
+		if len(parent.Sweep) > 0 {
+			child.Params = parent.Sweep[i]
+		}
+
+		evals = append(evals, &child)
+		children = append(children, &EvalRecord{
+			EvalPK: EvalPK{PoolID: pool.PoolID, EvalID: child.EvalID},
+			State:  client.EvalStatePending,
+			Eval:   &child,
+		})
+	}
+
+	err = putEvalRecords(conf, svc.DB, children)
+	if err == nil {
+		err = enqueueEvals(conf, svc, pool, evals)
+	}
+
+	if err != nil {
+		if uerr := setExpanded(conf, svc.DB, rec.EvalPK, to, from, false); uerr != nil {
+			return false, errors.Wrapf(err, "failed to expand children and to give back the claim (%v)", uerr)
+		}
+
+		return false, errors.Wrap(err, "failed to expand children")
+	}
+
+	if to < parent.Count {
+		return false, nil
+	}
+
+	if err = setExpanded(conf, svc.DB, rec.EvalPK, to, to, true); err != nil && err != ErrEvalStateChanged {
+		return false, errors.Wrap(err, "failed to clear array parameters")
+	}
+
+	return true, nil
+}
+
+//setExpanded moves the number of expanded children of a pending array eval, under the condition that no other scheduler moved it in the meantime. The parameters can be removed once they are no longer needed
+func setExpanded(conf *Conf, db DB, pk EvalPK, from, to int, clearSweep bool) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		From  int    `dynamodbav:":from"`
+		To    int    `dynamodbav:":to"`
+		State string `dynamodbav:":st"`
+	}{from, to, client.EvalStatePending})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal expand values")
+	}
+
+	names := map[string]*string{
+		"#exp": aws.String("exp"),
+		"#st":  aws.String("st"),
+	}
+
+	update, cond := "SET #exp = :to", "#st = :st AND #exp = :from"
+	if from == 0 {
+		cond = "#st = :st AND (attribute_not_exists(#exp) OR #exp = :from)"
+	}
+
+	if clearSweep {
+		update = update + " REMOVE #def.#sweep"
+		names["#def"], names["#sweep"] = aws.String("def"), aws.String("sweep")
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(conf.EvalsTableName),
+		Key:                       ipk,
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: vals,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrEvalStateChanged
+	}
+
+	return nil
+}
+
+//putEvalRecords writes eval records in batches, the ids of children are derived from a new parent so they are not checked for existence
+func putEvalRecords(conf *Conf, db DB, recs []*EvalRecord) (err error) {
+	for i := 0; i < len(recs); i += 25 {
+		var reqs []*dynamodb.WriteRequest
+		for _, rec := range recs[i:minInt(i+25, len(recs))] {
+			item, err := dynamodbattribute.MarshalMap(rec)
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal item map")
+			}
+
+			reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+		}
+
+		unprocessed := map[string][]*dynamodb.WriteRequest{conf.EvalsTableName: reqs}
+		for attempt := 0; len(unprocessed) > 0; attempt++ {
+			if attempt >= 5 {
+				return errors.Errorf("gave up writing %d items", len(unprocessed[conf.EvalsTableName]))
+			}
+
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			var out *dynamodb.BatchWriteItemOutput
+			if out, err = db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+				RequestItems: unprocessed,
+			}); err != nil {
+				return errors.Wrap(err, "failed to batch write items")
+			}
+
+			unprocessed = out.UnprocessedItems
+		}
+	}
+
+	return nil
+}
+
+//enqueueEvals sends evals to the pool's scheduling queue in batches
+func enqueueEvals(conf *Conf, svc *Services, pool *Pool, evals []*Eval) (err error) {
+	for i := 0; i < len(evals); i += 10 {
+		var entries []*sqs.SendMessageBatchRequestEntry
+		for j, eval := range evals[i:minInt(i+10, len(evals))] {
+			msg, err := evalMessage(eval)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+				Id:           aws.String(strconv.Itoa(j)),
+				MessageBody:  aws.String(msg),
+				DelaySeconds: aws.Int64(queueDelay(eval)),
+			})
+		}
+
+		var out *sqs.SendMessageBatchOutput
+		if out, err = svc.SQS.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(pool.QueueURL),
+			Entries:  entries,
+		}); err != nil {
+			return errors.Wrap(err, "failed to send message batch")
+		}
+
+		if len(out.Failed) > 0 {
+			return errors.Errorf("failed to send %d messages, first: %s", len(out.Failed), aws.StringValue(out.Failed[0].Message))
+		}
+	}
+
+	return nil
+}
+
+//countChildState moves a child from one state count of its parent to another. When the last child is done the parent is completed, or failed if any of its children didn't complete
+func countChildState(conf *Conf, db DB, pk EvalPK, from, to string) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		One  int `dynamodbav:":one"`
+		Zero int `dynamodbav:":zero"`
+	}{1, 0})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal count values")
+	}
+
+	var out *dynamodb.UpdateItemOutput
+	if out, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.EvalsTableName),
+		Key:                 ipk,
+		ReturnValues:        aws.String(dynamodb.ReturnValueAllNew),
+		UpdateExpression:    aws.String("SET #agg.#from = #agg.#from - :one, #agg.#to = if_not_exists(#agg.#to, :zero) + :one"),
+		ConditionExpression: aws.String("attribute_exists(#eval)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#agg":  aws.String("agg"),
+			"#from": aws.String(from),
+			"#to":   aws.String(to),
+			"#eval": aws.String("eval"),
+		},
+		ExpressionAttributeValues: vals,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrEvalNotExists
+	}
+
+	parent := &EvalRecord{}
+	err = dynamodbattribute.UnmarshalMap(out.Attributes, parent)
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal parent eval")
+	}
+
+	if parent.Done() || parent.Eval == nil {
+		return nil
+	}
+
+	failed := parent.Counts[client.EvalStateFailed] + parent.Counts[client.EvalStateCancelled]
+	if parent.Counts[client.EvalStateCompleted]+failed < parent.Eval.Count {
+		return nil
+	}
+
+	//only the update that counted the last child gets here
+	state, reason := client.EvalStateCompleted, ""
+	if failed > 0 {
+		state, reason = client.EvalStateFailed, fmt.Sprintf("%d of %d children didn't complete", failed, parent.Eval.Count)
+	}
+
+	return UpdateEvalState(conf, db, pk, state, reason, "")
+}
+
+//ListChildEvals returns the records of all children of an array eval
+func ListChildEvals(conf *Conf, db DB, pk EvalPK) (recs []*EvalRecord, err error) {
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		PoolID string `dynamodbav:":poolID"`
+		Prefix string `dynamodbav:":prefix"`
+	}{pk.PoolID, pk.EvalID + "-"})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal query values")
+	}
+
+	var ierr error
+	if err = db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.EvalsTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID AND begins_with (#eval, :prefix)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+			"#eval": aws.String("eval"),
+		},
+		ExpressionAttributeValues: vals,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			rec := &EvalRecord{}
+			ierr = dynamodbattribute.UnmarshalMap(item, rec)
+			if ierr != nil {
+				return false
+			}
+
+			recs = append(recs, rec)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query child evals")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal child eval")
+	}
+
+	return recs, nil
+}
+
+//cancelArrayEval cancels the parent first such that it isn't completed by the children that are cancelled after it
+func cancelArrayEval(conf *Conf, svc *Services, rec *EvalRecord, reason string) (err error) {
+	err = CancelEvalState(conf, svc.DB, rec.EvalPK, reason, "")
+	if err == ErrEvalStateChanged {
+		return nil //the array is done already
+	} else if err != nil {
+		return errors.Wrap(err, "failed to update eval state")
+	}
+
+	children, err := ListChildEvals(conf, svc.DB, rec.EvalPK)
+	if err != nil {
+		return errors.Wrap(err, "failed to list child evals")
+	}
+
+	for _, child := range children {
+		if child.Done() {
+			continue
+		}
+
+		err = CancelEval(conf, svc, child, reason)
+		if err != nil {
+			return errors.Wrapf(err, "failed to cancel child eval '%s'", child.EvalID)
+		}
+	}
+
+	return nil
+}
+
+//minInt returns the smaller of two ints
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
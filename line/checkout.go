@@ -0,0 +1,224 @@
+package line
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//CheckoutPK describes the checkout's primary key in the base table
+type CheckoutPK struct {
+	PoolID     string `dynamodbav:"pool"`
+	CheckoutID string `dynamodbav:"co"`
+}
+
+//Checkout reserves disk space on a worker for the input and output checkouts of an alloc. The reservation outlives the alloc and is only removed when the worker removed the checkouts
+type Checkout struct {
+	CheckoutPK
+	WorkerID string `dynamodbav:"wrk"`
+	AllocID  string `dynamodbav:"alloc"`
+	Size     int64  `dynamodbav:"size"` //reserved bytes
+	TTL      int64  `dynamodbav:"ttl"`
+}
+
+var (
+	//ErrCheckoutNotExists means a checkout was not found while expecting it to exist
+	ErrCheckoutNotExists = errors.New("checkout doesn't exist")
+)
+
+//FmtCheckoutID formats the checkout id such that the checkouts of a worker can be queried by prefix
+func FmtCheckoutID(workerID, allocID string) string {
+	return fmt.Sprintf("%s:%s", workerID, allocID)
+}
+
+//CheckoutSize returns the disk space the checkouts of an eval are expected to take. Inputs without a declared size are looked up in the dataset registry, outputs without one are assumed to be as large as the input of the same dataset
+func CheckoutSize(conf *Conf, db DB, poolID string, eval *Eval) (size int64, err error) {
+	inputs := map[string]int64{}
+	for _, in := range eval.Inputs {
+		insize := in.Size
+		if insize == 0 {
+			ver, err := GetVersion(conf, db, VersionPK{PoolID: poolID, VersionID: FmtVersionID(in.DatasetID, in.Version)})
+			if err != nil && err != ErrVersionNotExists {
+				return 0, errors.Wrap(err, "failed to get input version")
+			}
+
+			if ver != nil {
+				insize = ver.Size
+			}
+		}
+
+		inputs[in.DatasetID] = insize
+		size += insize
+	}
+
+	if eval.Task == nil {
+		return size, nil
+	}
+
+	for _, out := range eval.Task.Outputs {
+		if out.Size > 0 {
+			size += out.Size
+			continue
+		}
+
+		size += inputs[out.DatasetID]
+	}
+
+	return size, nil
+}
+
+//PutCheckout will put a checkout reservation, it overwrites an existing one to refresh it
+func PutCheckout(conf *Conf, db DB, co *Checkout) (err error) {
+	item, err := dynamodbattribute.MarshalMap(co)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(conf.CheckoutsTableName),
+		Item:      item,
+	}); err != nil {
+		return errors.Wrap(err, "failed to put item")
+	}
+
+	return nil
+}
+
+//DeleteCheckout deletes a checkout by pk and returns the reservation it held
+func DeleteCheckout(conf *Conf, db DB, pk CheckoutPK) (co *Checkout, err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	var out *dynamodb.DeleteItemOutput
+	if out, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(conf.CheckoutsTableName),
+		Key:                 ipk,
+		ReturnValues:        aws.String(dynamodb.ReturnValueAllOld),
+		ConditionExpression: aws.String("attribute_exists(#co)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#co": aws.String("co"),
+		},
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, errors.Wrap(err, "failed to delete item")
+		}
+
+		return nil, ErrCheckoutNotExists
+	}
+
+	co = &Checkout{}
+	err = dynamodbattribute.UnmarshalMap(out.Attributes, co)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return co, nil
+}
+
+//ListCheckouts returns the checkout reservations on a worker
+func ListCheckouts(conf *Conf, db DB, pk WorkerPK) (cos []*Checkout, err error) {
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		PoolID string `dynamodbav:":poolID"`
+		Prefix string `dynamodbav:":workerID"`
+	}{pk.PoolID, FmtCheckoutID(pk.WorkerID, "")})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal query values")
+	}
+
+	var ierr error
+	if err = db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.CheckoutsTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID AND begins_with (#co, :workerID)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+			"#co":   aws.String("co"),
+		},
+		ExpressionAttributeValues: vals,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			co := &Checkout{}
+			ierr = dynamodbattribute.UnmarshalMap(item, co)
+			if ierr != nil {
+				return false
+			}
+
+			cos = append(cos, co)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query checkouts")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal checkout")
+	}
+
+	return cos, nil
+}
+
+//PendingCheckoutSize returns how much of the reservations is not yet taken by checkouts on disk. Space that checkouts already take is not free on the worker anymore so counting it again would reserve it twice
+func PendingCheckoutSize(cos []*Checkout, states []*client.CheckoutState, now int64) (pending int64) {
+	used := map[string]int64{}
+	for _, state := range states {
+		used[state.AllocID] += state.Size
+	}
+
+	for _, co := range cos {
+		if co.TTL < now {
+			continue //expired reservation
+		}
+
+		if co.Size > used[co.AllocID] {
+			pending += co.Size - used[co.AllocID]
+		}
+	}
+
+	return pending
+}
+
+//ReconcileCheckouts sets a worker's unreserved disk space from the free space it reports and the reservations that are not yet on disk. Reservations of checkouts that are reported are refreshed. If disk space was claimed or released in the meantime the reservations that were listed may be outdated, the disk space is then left alone until the next heartbeat reconciles it
+func ReconcileCheckouts(conf *Conf, db DB, pk WorkerPK, space int64, states []*client.CheckoutState) (err error) {
+	worker, err := GetWorker(conf, db, pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to get worker")
+	}
+
+	cos, err := ListCheckouts(conf, db, pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to list checkouts")
+	}
+
+	reported := map[string]bool{}
+	for _, state := range states {
+		reported[state.AllocID] = true
+	}
+
+	now := time.Now().Unix()
+	for _, co := range cos {
+		if !reported[co.AllocID] || co.TTL < now {
+			continue
+		}
+
+		co.TTL = now + conf.AllocTTL
+		if err = PutCheckout(conf, db, co); err != nil {
+			return errors.Wrap(err, "failed to refresh checkout")
+		}
+	}
+
+	err = SetWorkerDisk(conf, db, pk, space-PendingCheckoutSize(cos, states, now), worker.DiskVer)
+	if err == ErrWorkerDiskChanged {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,38 @@
+package line
+
+import (
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestPendingCheckoutSize(t *testing.T) {
+	cos := []*Checkout{
+		{AllocID: "a1", Size: 100, TTL: 10},
+		{AllocID: "a2", Size: 50, TTL: 10},
+		{AllocID: "a3", Size: 70, TTL: 10},
+		{AllocID: "a4", Size: 500, TTL: 1},
+	}
+
+	states := []*client.CheckoutState{
+		{AllocID: "a1", DatasetID: "in", Size: 30},
+		{AllocID: "a1", DatasetID: "out", Size: 20},
+		{AllocID: "a2", DatasetID: "out", Size: 80},
+	}
+
+	//a1 has 50 of 100 on disk, a2 outgrew its reservation and a3 is not checked out yet, a4 expired
+	if pending := PendingCheckoutSize(cos, states, 5); pending != 120 {
+		t.Fatalf("expected 120 bytes to be pending, got %d", pending)
+	}
+}
+
+func TestWorkerHasDisk(t *testing.T) {
+	if !(&Worker{}).HasDisk(1 << 40) {
+		t.Error("expected workers that don't account for disk to always have room")
+	}
+
+	disk := int64(100)
+	if w := (&Worker{Disk: &disk}); !w.HasDisk(100) || w.HasDisk(101) {
+		t.Error("expected worker to have room for at most its unreserved disk")
+	}
+}
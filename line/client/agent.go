@@ -0,0 +1,312 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//Agent takes care of the bookkeeping every worker needs: it registers, keeps sending heartbeats for the allocs and datasets it tracks, receives allocs from the worker's queue and registers again when the server forgot about the worker
+type Agent struct {
+	Client   *Client
+	Register *RegisterWorkerInput
+	Interval time.Duration //between heartbeats, defaults to ten seconds
+	WaitTime int64         //seconds to long poll for allocs, defaults to twenty
+
+	//HandleAlloc is called in its own go routine for every alloc that arrives. If it is not set allocs are delivered on the Allocs channel instead
+	HandleAlloc func(ctx context.Context, alloc *Alloc)
+
+	//PrepareHeartbeat may add to a heartbeat before it is send, e.g. the state of replicas or checkouts
+	PrepareHeartbeat func(in *SendHeartbeatInput)
+
+	//HandleHeartbeat receives the output of every heartbeat
+	HandleHeartbeat func(out *SendHeartbeatOutput)
+
+	//StopAlloc is called for allocs the server no longer knows about, the agent already stopped tracking them
+	StopAlloc func(allocID string)
+
+	//Registered is called every time the worker (re-)registered
+	Registered func(out *RegisterWorkerOutput)
+
+	//HandleError is called when a heartbeat or receiving allocs failed, the agent keeps running
+	HandleError func(err error)
+
+	//Completed is called after an alloc was completed, with the error of the completion if any
+	Completed func(in *CompleteAllocInput, err error)
+
+	allocCh  chan *Alloc
+	draining chan struct{}
+	drain    sync.Once
+	mu       sync.Mutex
+	worker   *RegisterWorkerOutput
+	allocs   map[string]struct{}
+	datasets map[string]struct{}
+}
+
+//ErrNotRegistered is returned when the agent needs a registration it doesn't have, e.g. after it deregistered
+var ErrNotRegistered = errors.New("worker is not registered")
+
+//NewAgent creates an agent that registers with the given input
+func NewAgent(c *Client, reg *RegisterWorkerInput) *Agent {
+	return &Agent{
+		Client:   c,
+		Register: reg,
+		Interval: 10 * time.Second,
+		WaitTime: 20,
+		allocCh:  make(chan *Alloc),
+		draining: make(chan struct{}),
+		allocs:   map[string]struct{}{},
+		datasets: map[string]struct{}{},
+	}
+}
+
+//Allocs delivers the allocs that arrive when no HandleAlloc is set
+func (a *Agent) Allocs() <-chan *Alloc {
+	return a.allocCh
+}
+
+//Worker returns the current registration, or nil if the agent didn't register yet
+func (a *Agent) Worker() *RegisterWorkerOutput {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.worker
+}
+
+//Resume continues as a worker that registered before, e.g. by a previous process. The worker registers again when the server forgot about it
+func (a *Agent) Resume(worker *RegisterWorkerOutput) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.worker = worker
+}
+
+//Track reports an alloc in heartbeats that didn't arrive through the agent, e.g. one that was resumed
+func (a *Agent) Track(allocID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allocs[allocID] = struct{}{}
+}
+
+//AddDataset starts reporting a replica of a dataset in heartbeats
+func (a *Agent) AddDataset(datasetID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.datasets[datasetID] = struct{}{}
+}
+
+//RemoveDataset stops reporting a replica of a dataset
+func (a *Agent) RemoveDataset(datasetID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.datasets, datasetID)
+}
+
+//Complete completes an alloc and stops tracking it
+func (a *Agent) Complete(in *CompleteAllocInput) (err error) {
+	a.mu.Lock()
+	delete(a.allocs, in.AllocID)
+	a.mu.Unlock()
+
+	if _, err = a.Client.CompleteAlloc(in); err != nil {
+		err = errors.Wrap(err, "failed to complete alloc")
+	}
+
+	if a.Completed != nil {
+		a.Completed(in, err)
+	}
+
+	return err
+}
+
+//Drain stops receiving allocs, heartbeats continue until Run returns such that the allocs that are still running are kept
+func (a *Agent) Drain() {
+	a.drain.Do(func() { close(a.draining) })
+}
+
+//Deregister removes the worker from its pool and forgets the registration, allocs the agent still tracks are scheduled again by the server
+func (a *Agent) Deregister() (err error) {
+	worker := a.Worker()
+	if worker == nil {
+		return nil
+	}
+
+	if _, err = a.Client.DeregisterWorker(&DeregisterWorkerInput{
+		PoolID:   worker.PoolID,
+		WorkerID: worker.WorkerID,
+	}); err != nil && !IsWorkerNotExists(err) {
+		return errors.Wrap(err, "failed to deregister worker")
+	}
+
+	a.mu.Lock()
+	a.worker = nil
+	a.allocs = map[string]struct{}{}
+	a.mu.Unlock()
+	return nil
+}
+
+//Run registers the worker, unless it was resumed, and then sends heartbeats and receives allocs until the context is done
+func (a *Agent) Run(ctx context.Context) (err error) {
+	if a.Worker() == nil {
+		if err = a.register(); err != nil {
+			return err
+		}
+	}
+
+	go a.receive(ctx)
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err = a.Heartbeat(); err != nil && a.HandleError != nil {
+				a.HandleError(err) //the next heartbeat may succeed
+			}
+		}
+	}
+}
+
+//Heartbeat sends a single heartbeat, if the server forgot about the worker it registers again and the allocs it tracked are stopped
+func (a *Agent) Heartbeat() (err error) {
+	worker := a.Worker()
+	if worker == nil {
+		return ErrNotRegistered
+	}
+
+	in := &SendHeartbeatInput{
+		PoolID:   worker.PoolID,
+		WorkerID: worker.WorkerID,
+		Allocs:   []string{},
+		Datasets: []string{},
+	}
+
+	a.mu.Lock()
+	for allocID := range a.allocs {
+		in.Allocs = append(in.Allocs, allocID)
+	}
+
+	for datasetID := range a.datasets {
+		in.Datasets = append(in.Datasets, datasetID)
+	}
+	a.mu.Unlock()
+
+	sort.Strings(in.Allocs)
+	sort.Strings(in.Datasets)
+	if a.PrepareHeartbeat != nil {
+		a.PrepareHeartbeat(in)
+	}
+
+	out, err := a.Client.SendHeartbeat(in)
+	if IsWorkerNotExists(err) {
+		a.stop(in.Allocs) //the allocs of a forgotten worker were released by the server
+		return a.register()
+	} else if err != nil {
+		return errors.Wrap(err, "failed to send heartbeat")
+	}
+
+	a.stop(out.StopAllocs)
+	if a.HandleHeartbeat != nil {
+		a.HandleHeartbeat(out)
+	}
+
+	return nil
+}
+
+//register (re-)registers the worker
+func (a *Agent) register() (err error) {
+	out, err := a.Client.RegisterWorker(a.Register)
+	if err != nil {
+		return errors.Wrap(err, "failed to register worker")
+	}
+
+	a.mu.Lock()
+	a.worker = out
+	a.mu.Unlock()
+
+	if a.Registered != nil {
+		a.Registered(out)
+	}
+
+	return nil
+}
+
+//stop stops tracking allocs and tells the worker to stop them
+func (a *Agent) stop(allocIDs []string) {
+	for _, allocID := range allocIDs {
+		a.mu.Lock()
+		delete(a.allocs, allocID)
+		a.mu.Unlock()
+
+		if a.StopAlloc != nil {
+			a.StopAlloc(allocID)
+		}
+	}
+}
+
+//receive long polls the queue of the current registration and hands out allocs that aren't tracked yet
+func (a *Agent) receive(ctx context.Context) {
+	for ctx.Err() == nil && !a.isDraining() {
+		var out *ReceiveAllocsOutput
+		err := ErrNotRegistered
+		if worker := a.Worker(); worker != nil {
+			out, err = a.Client.ReceiveAllocs(&ReceiveAllocsInput{
+				WorkerQueueURL:      worker.QueueURL,
+				MaxNumberOfMessages: 10,
+				WaitTimeSeconds:     a.WaitTime,
+			})
+		}
+
+		if err != nil {
+			if a.HandleError != nil && ctx.Err() == nil {
+				a.HandleError(errors.Wrap(err, "failed to receive allocs"))
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-a.draining:
+			case <-time.After(time.Second): //the queue may be gone after the worker was forgotten
+			}
+
+			continue
+		}
+
+		for _, alloc := range out.Allocs {
+			if a.isDraining() {
+				return //the server schedules allocs of a worker that left again
+			}
+
+			a.mu.Lock()
+			_, ok := a.allocs[alloc.AllocID]
+			a.allocs[alloc.AllocID] = struct{}{}
+			a.mu.Unlock()
+			if ok {
+				continue //already tracked
+			}
+
+			if a.HandleAlloc != nil {
+				go a.HandleAlloc(ctx, alloc)
+				continue
+			}
+
+			select {
+			case a.allocCh <- alloc:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+//isDraining returns whether the agent stopped receiving allocs
+func (a *Agent) isDraining() bool {
+	select {
+	case <-a.draining:
+		return true
+	default:
+		return false
+	}
+}
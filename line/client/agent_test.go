@@ -0,0 +1,242 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+//fakeServer answers the line api and the sqs queue of the worker
+type fakeServer struct {
+	mu           sync.Mutex
+	registered   int
+	heartbeats   []*SendHeartbeatInput
+	deregistered []*DeregisterWorkerInput
+	forget       bool     //heartbeats fail as if the server forgot the worker
+	queue        []*Alloc //delivered by the next receive
+	receives     int
+	*httptest.Server
+}
+
+func newFakeServer(t *testing.T) (srv *fakeServer, c *Client) {
+	srv = &fakeServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.handle))
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:                aws.String(srv.URL),
+		Region:                  aws.String("eu-west-1"),
+		Credentials:             credentials.NewStaticCredentials("id", "secret", ""),
+		DisableComputeChecksums: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err = NewClient(srv.URL, sess); err != nil {
+		t.Fatal(err)
+	}
+
+	return srv, c
+}
+
+func (srv *fakeServer) handle(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	switch r.URL.Path {
+	case "/RegisterWorker":
+		srv.registered++
+		in := &RegisterWorkerInput{}
+		json.NewDecoder(r.Body).Decode(in)
+		json.NewEncoder(w).Encode(&RegisterWorkerOutput{
+			PoolID:   in.PoolID,
+			WorkerID: fmt.Sprintf("w%d", srv.registered),
+			QueueURL: srv.URL + "/queue",
+		})
+	case "/SendHeartbeat":
+		in := &SendHeartbeatInput{}
+		json.NewDecoder(r.Body).Decode(in)
+		srv.heartbeats = append(srv.heartbeats, in)
+		if srv.forget {
+			srv.forget = false
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, `{"message": "failed to get worker: worker doesn't exist"}`)
+			return
+		}
+
+		fmt.Fprintln(w, "{}")
+	case "/DeregisterWorker":
+		in := &DeregisterWorkerInput{}
+		json.NewDecoder(r.Body).Decode(in)
+		srv.deregistered = append(srv.deregistered, in)
+		fmt.Fprintln(w, "{}")
+	case "/":
+		r.ParseForm()
+		switch r.Form.Get("Action") {
+		case "ReceiveMessage":
+			srv.receives++
+			fmt.Fprint(w, "<ReceiveMessageResponse><ReceiveMessageResult>")
+			for i, alloc := range srv.queue {
+				body, _ := json.Marshal(alloc)
+				fmt.Fprintf(w, "<Message><MessageId>m%d</MessageId><ReceiptHandle>r%d</ReceiptHandle><Body>", i, i)
+				xml.EscapeText(w, body)
+				fmt.Fprint(w, "</Body></Message>")
+			}
+
+			srv.queue = nil
+			fmt.Fprint(w, "</ReceiveMessageResult></ReceiveMessageResponse>")
+		case "DeleteMessage":
+			fmt.Fprint(w, "<DeleteMessageResponse></DeleteMessageResponse>")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestAgentRegistersAgainWhenForgotten(t *testing.T) {
+	srv, c := newFakeServer(t)
+	defer srv.Close()
+
+	a := NewAgent(c, &RegisterWorkerInput{PoolID: "p1"})
+	a.Resume(&RegisterWorkerOutput{PoolID: "p1", WorkerID: "w0"})
+	a.Track("a1")
+
+	var stopped []string
+	var registered *RegisterWorkerOutput
+	a.StopAlloc = func(allocID string) { stopped = append(stopped, allocID) }
+	a.Registered = func(out *RegisterWorkerOutput) { registered = out }
+
+	srv.forget = true
+	if err := a.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	if registered == nil || a.Worker().WorkerID != "w1" {
+		t.Fatalf("expected the agent to register again, got %+v", a.Worker())
+	}
+
+	if len(stopped) != 1 || stopped[0] != "a1" {
+		t.Fatalf("expected the allocs of the forgotten worker to be stopped, got %v", stopped)
+	}
+
+	if err := a.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	if last := srv.heartbeats[len(srv.heartbeats)-1]; last.WorkerID != "w1" || len(last.Allocs) != 0 {
+		t.Fatalf("expected heartbeats of the new registration without the stopped allocs, got %+v", last)
+	}
+}
+
+func TestAgentHandsOutAllocsOnce(t *testing.T) {
+	srv, c := newFakeServer(t)
+	defer srv.Close()
+
+	a := NewAgent(c, &RegisterWorkerInput{PoolID: "p1"})
+	a.Interval, a.WaitTime = time.Hour, 0
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+	a.HandleAlloc = func(ctx context.Context, alloc *Alloc) {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[alloc.AllocID]++
+	}
+
+	//the same alloc is delivered twice, e.g. because deleting its message failed
+	srv.queue = []*Alloc{{PoolID: "p1", AllocID: "a1"}, {PoolID: "p1", AllocID: "a1"}, {PoolID: "p1", AllocID: "a2"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(handled)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if handled["a1"] != 1 || handled["a2"] != 1 {
+		t.Fatalf("expected every alloc to be handled once, got %v", handled)
+	}
+
+	if err := a.Heartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	if last := srv.heartbeats[len(srv.heartbeats)-1]; strings.Join(last.Allocs, ",") != "a1,a2" {
+		t.Fatalf("expected the handed out allocs to be tracked, got %v", last.Allocs)
+	}
+}
+
+func TestAgentDrainAndDeregister(t *testing.T) {
+	srv, c := newFakeServer(t)
+	defer srv.Close()
+
+	a := NewAgent(c, &RegisterWorkerInput{PoolID: "p1"})
+	a.Interval, a.WaitTime = 10*time.Millisecond, 0
+	a.HandleAlloc = func(ctx context.Context, alloc *Alloc) {}
+	a.Drain()
+
+	srv.queue = []*Alloc{{PoolID: "p1", AllocID: "a1"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Run(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	srv.mu.Lock()
+	receives, heartbeats := srv.receives, len(srv.heartbeats)
+	srv.mu.Unlock()
+	if receives != 0 || heartbeats < 1 {
+		t.Fatalf("expected a drained agent to keep sending heartbeats without receiving allocs, got %d receives and %d heartbeats", receives, heartbeats)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	a.Track("a2")
+	if err := a.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.deregistered) != 1 || srv.deregistered[0].WorkerID != "w1" {
+		t.Fatalf("expected the worker to deregister, got %+v", srv.deregistered)
+	}
+
+	if a.Worker() != nil {
+		t.Fatal("expected the registration to be forgotten")
+	}
+
+	if err := a.Heartbeat(); err != ErrNotRegistered {
+		t.Fatalf("expected a heartbeat without a registration to fail, got %v", err)
+	}
+
+	if err := a.Deregister(); err != nil {
+		t.Fatalf("expected deregistering twice to be a no-op, got %v", err)
+	}
+}
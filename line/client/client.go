@@ -2,11 +2,14 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -35,6 +38,24 @@ func NewClient(endpoint string, aws *session.Session) (c *Client, err error) {
 	return c, nil
 }
 
+//ServerError is returned when the server responded with an error status
+type ServerError struct {
+	StatusCode int    `json:"-"`
+	URL        string `json:"-"`
+	Body       string `json:"-"`
+	Message    string `json:"message"`
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("unexpected response code '%d' from server, url: '%s' response: '%s'", e.StatusCode, e.URL, e.Body)
+}
+
+//IsWorkerNotExists returns whether the server failed a request because it doesn't know the worker, for example because its heartbeats stopped for too long
+func IsWorkerNotExists(err error) bool {
+	serr, ok := errors.Cause(err).(*ServerError)
+	return ok && strings.Contains(serr.Message, "worker doesn't exist")
+}
+
 func (c *Client) doRequest(in interface{}, out interface{}) (err error) {
 	loc := *c.ep
 	switch in.(type) {
@@ -44,12 +65,60 @@ func (c *Client) doRequest(in interface{}, out interface{}) (err error) {
 		loc.Path = path.Join(loc.Path, "DisbandPool")
 	case *RegisterWorkerInput:
 		loc.Path = path.Join(loc.Path, "RegisterWorker")
+	case *DeregisterWorkerInput:
+		loc.Path = path.Join(loc.Path, "DeregisterWorker")
 	case *SendHeartbeatInput:
 		loc.Path = path.Join(loc.Path, "SendHeartbeat")
+	case *ListReplicasInput:
+		loc.Path = path.Join(loc.Path, "ListReplicas")
 	case *ScheduleEvalInput:
 		loc.Path = path.Join(loc.Path, "ScheduleEval")
+	case *GetEvalInput:
+		loc.Path = path.Join(loc.Path, "GetEval")
 	case *CompleteAllocInput:
 		loc.Path = path.Join(loc.Path, "CompleteAlloc")
+	case *CreateScheduleInput:
+		loc.Path = path.Join(loc.Path, "CreateSchedule")
+	case *ListSchedulesInput:
+		loc.Path = path.Join(loc.Path, "ListSchedules")
+	case *PauseScheduleInput:
+		loc.Path = path.Join(loc.Path, "PauseSchedule")
+	case *ResumeScheduleInput:
+		loc.Path = path.Join(loc.Path, "ResumeSchedule")
+	case *DeleteScheduleInput:
+		loc.Path = path.Join(loc.Path, "DeleteSchedule")
+	case *CreateWorkflowInput:
+		loc.Path = path.Join(loc.Path, "CreateWorkflow")
+	case *StartWorkflowInput:
+		loc.Path = path.Join(loc.Path, "StartWorkflow")
+	case *GetWorkflowRunInput:
+		loc.Path = path.Join(loc.Path, "GetWorkflowRun")
+	case *CreateTriggerInput:
+		loc.Path = path.Join(loc.Path, "CreateTrigger")
+	case *ListTriggersInput:
+		loc.Path = path.Join(loc.Path, "ListTriggers")
+	case *DeleteTriggerInput:
+		loc.Path = path.Join(loc.Path, "DeleteTrigger")
+	case *CreateDatasetInput:
+		loc.Path = path.Join(loc.Path, "CreateDataset")
+	case *GetDatasetInput:
+		loc.Path = path.Join(loc.Path, "GetDataset")
+	case *UpdateDatasetInput:
+		loc.Path = path.Join(loc.Path, "UpdateDataset")
+	case *ListDatasetVersionsInput:
+		loc.Path = path.Join(loc.Path, "ListDatasetVersions")
+	case *GetReplicaPeersInput:
+		loc.Path = path.Join(loc.Path, "GetReplicaPeers")
+	case *RemoveCheckoutInput:
+		loc.Path = path.Join(loc.Path, "RemoveCheckout")
+	case *GetLineageInput:
+		loc.Path = path.Join(loc.Path, "GetLineage")
+	case *RemoveReplicaInput:
+		loc.Path = path.Join(loc.Path, "RemoveReplica")
+	case *PutAllocLogsInput:
+		loc.Path = path.Join(loc.Path, "PutAllocLogs")
+	case *GetAllocLogsInput:
+		loc.Path = path.Join(loc.Path, "GetAllocLogs")
 	default:
 		return errors.Errorf("no known endpoint for %T", in)
 	}
@@ -81,7 +150,9 @@ func (c *Client) doRequest(in interface{}, out interface{}) (err error) {
 	}
 
 	if resp.StatusCode > 399 {
-		return errors.Errorf("unexpected response code '%d' from server, url: '%s' response: '%s'", resp.StatusCode, loc.String(), respBody.String())
+		serr := &ServerError{StatusCode: resp.StatusCode, URL: loc.String(), Body: respBody.String()}
+		json.Unmarshal(respBody.Bytes(), serr) //the message is optional, the body is reported either way
+		return serr
 	}
 
 	return nil
@@ -109,6 +180,17 @@ func (c *Client) RegisterWorker(in *RegisterWorkerInput) (out *RegisterWorkerOut
 	return out, nil
 }
 
+//DeregisterWorker removes a worker from its pool, allocs it still held are scheduled again
+func (c *Client) DeregisterWorker(in *DeregisterWorkerInput) (out *DeregisterWorkerOutput, err error) {
+	out = &DeregisterWorkerOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+
+	return out, nil
+}
+
 //DisbandPool will remove a pool
 func (c *Client) DisbandPool(in *DisbandPoolInput) (out *DisbandPoolOutput, err error) {
 	out = &DisbandPoolOutput{}
@@ -131,6 +213,16 @@ func (c *Client) SendHeartbeat(in *SendHeartbeatInput) (out *SendHeartbeatOutput
 	return out, nil
 }
 
+//ListReplicas returns where replicas of datasets are located in the pool
+func (c *Client) ListReplicas(in *ListReplicasInput) (out *ListReplicasOutput, err error) {
+	out = &ListReplicasOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
 //ScheduleEval will queue up an evaluation to be processed by the scheduling logic
 func (c *Client) ScheduleEval(in *ScheduleEvalInput) (out *ScheduleEvalOutput, err error) {
 	out = &ScheduleEvalOutput{}
@@ -141,6 +233,16 @@ func (c *Client) ScheduleEval(in *ScheduleEvalInput) (out *ScheduleEvalOutput, e
 	return out, nil
 }
 
+//GetEval returns the state of an evaluation
+func (c *Client) GetEval(in *GetEvalInput) (out *GetEvalOutput, err error) {
+	out = &GetEvalOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
 //CompleteAlloc indicates to the server that an allocation has ended
 func (c *Client) CompleteAlloc(in *CompleteAllocInput) (out *CompleteAllocOutput, err error) {
 	out = &CompleteAllocOutput{}
@@ -151,9 +253,251 @@ func (c *Client) CompleteAlloc(in *CompleteAllocInput) (out *CompleteAllocOutput
 	return out, nil
 }
 
-//ReceiveAllocs will open a long poll for new allocations
+//CreateSchedule sets up an eval that is submitted periodically
+func (c *Client) CreateSchedule(in *CreateScheduleInput) (out *CreateScheduleOutput, err error) {
+	out = &CreateScheduleOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//ListSchedules returns the schedules of a pool
+func (c *Client) ListSchedules(in *ListSchedulesInput) (out *ListSchedulesOutput, err error) {
+	out = &ListSchedulesOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//PauseSchedule stops a schedule from submitting evals
+func (c *Client) PauseSchedule(in *PauseScheduleInput) (out *PauseScheduleOutput, err error) {
+	out = &PauseScheduleOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//ResumeSchedule continues a paused schedule
+func (c *Client) ResumeSchedule(in *ResumeScheduleInput) (out *ResumeScheduleOutput, err error) {
+	out = &ResumeScheduleOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//DeleteSchedule removes a schedule
+func (c *Client) DeleteSchedule(in *DeleteScheduleInput) (out *DeleteScheduleOutput, err error) {
+	out = &DeleteScheduleOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//CreateWorkflow stores a graph of evals that can be started as a whole
+func (c *Client) CreateWorkflow(in *CreateWorkflowInput) (out *CreateWorkflowOutput, err error) {
+	out = &CreateWorkflowOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//StartWorkflow starts a new run of a workflow
+func (c *Client) StartWorkflow(in *StartWorkflowInput) (out *StartWorkflowOutput, err error) {
+	out = &StartWorkflowOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//GetWorkflowRun returns the progress of a workflow run
+func (c *Client) GetWorkflowRun(in *GetWorkflowRunInput) (out *GetWorkflowRunOutput, err error) {
+	out = &GetWorkflowRunOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//CreateTrigger sets up an eval that is submitted for every new version of a dataset
+func (c *Client) CreateTrigger(in *CreateTriggerInput) (out *CreateTriggerOutput, err error) {
+	out = &CreateTriggerOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//ListTriggers returns the triggers of a pool
+func (c *Client) ListTriggers(in *ListTriggersInput) (out *ListTriggersOutput, err error) {
+	out = &ListTriggersOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//DeleteTrigger removes a trigger
+func (c *Client) DeleteTrigger(in *DeleteTriggerInput) (out *DeleteTriggerOutput, err error) {
+	out = &DeleteTriggerOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//CreateDataset registers a dataset in a pool
+func (c *Client) CreateDataset(in *CreateDatasetInput) (out *CreateDatasetOutput, err error) {
+	out = &CreateDatasetOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//GetDataset describes a dataset
+func (c *Client) GetDataset(in *GetDatasetInput) (out *GetDatasetOutput, err error) {
+	out = &GetDatasetOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//UpdateDataset changes the desired number of replicas of a dataset
+func (c *Client) UpdateDataset(in *UpdateDatasetInput) (out *UpdateDatasetOutput, err error) {
+	out = &UpdateDatasetOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//ListDatasetVersions returns the known versions of a dataset
+func (c *Client) ListDatasetVersions(in *ListDatasetVersionsInput) (out *ListDatasetVersionsOutput, err error) {
+	out = &ListDatasetVersionsOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//GetReplicaPeers returns workers a dataset can be fetched from
+func (c *Client) GetReplicaPeers(in *GetReplicaPeersInput) (out *GetReplicaPeersOutput, err error) {
+	out = &GetReplicaPeersOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//RemoveCheckout releases the disk space reserved for the checkouts of an alloc
+func (c *Client) RemoveCheckout(in *RemoveCheckoutInput) (out *RemoveCheckoutOutput, err error) {
+	out = &RemoveCheckoutOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//GetLineage returns the upstream or downstream lineage of a dataset version
+func (c *Client) GetLineage(in *GetLineageInput) (out *GetLineageOutput, err error) {
+	out = &GetLineageOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//RemoveReplica tells the server a worker removed its replica of a dataset
+func (c *Client) RemoveReplica(in *RemoveReplicaInput) (out *RemoveReplicaOutput, err error) {
+	out = &RemoveReplicaOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//PutAllocLogs uploads a chunk of the output of an alloc
+func (c *Client) PutAllocLogs(in *PutAllocLogsInput) (out *PutAllocLogsOutput, err error) {
+	out = &PutAllocLogsOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//GetAllocLogs returns the output of an alloc
+func (c *Client) GetAllocLogs(in *GetAllocLogsInput) (out *GetAllocLogsOutput, err error) {
+	out = &GetAllocLogsOutput{}
+	err = c.doRequest(in, out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do HTTP request")
+	}
+	return out, nil
+}
+
+//FollowAllocLogs calls fn for every line of output of an alloc until the alloc finished or the context is done, the input's after, since and tail select where to start
+func (c *Client) FollowAllocLogs(ctx context.Context, in *GetAllocLogsInput, fn func(line *LogLine)) (err error) {
+	req := *in
+	if req.Wait < 1 {
+		req.Wait = 5
+	}
+
+	for ctx.Err() == nil {
+		out, err := c.GetAllocLogs(&req)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range out.Lines {
+			fn(line)
+		}
+
+		if out.Done {
+			return nil
+		}
+
+		if out.Next != "" {
+			req.After = out.Next
+		}
+
+		req.Tail = 0
+	}
+
+	return ctx.Err()
+}
+
+//ReceiveAllocs will open a long poll for new allocations, received allocs are removed from the queue
 func (c *Client) ReceiveAllocs(in *ReceiveAllocsInput) (out *ReceiveAllocsOutput, err error) {
-	recv, err := sqs.New(c.aws).ReceiveMessage(&sqs.ReceiveMessageInput{
+	queue := sqs.New(c.aws)
+	recv, err := queue.ReceiveMessage(&sqs.ReceiveMessageInput{
 		QueueUrl:            aws.String(in.WorkerQueueURL),
 		MaxNumberOfMessages: aws.Int64(in.MaxNumberOfMessages),
 		WaitTimeSeconds:     aws.Int64(in.WaitTimeSeconds),
@@ -172,6 +516,12 @@ func (c *Client) ReceiveAllocs(in *ReceiveAllocsInput) (out *ReceiveAllocsOutput
 		}
 
 		out.Allocs = append(out.Allocs, alloc)
+		if _, err = queue.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(in.WorkerQueueURL),
+			ReceiptHandle: msg.ReceiptHandle,
+		}); err != nil {
+			return nil, errors.Wrap(err, "failed to delete alloc message")
+		}
 	}
 
 	return out, nil
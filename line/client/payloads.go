@@ -10,16 +10,27 @@ type CreatePoolOutput struct {
 
 //RegisterWorkerInput will off the pool capacity to work with
 type RegisterWorkerInput struct {
-	PoolID   string `json:"pool_id"`
-	Capacity int    `json:"capacity"`
+	PoolID   string            `json:"pool_id"`
+	Capacity int               `json:"capacity"`
+	Labels   map[string]string `json:"labels,omitempty"`         //e.g zone, instance type, docker version
+	Zone     string            `json:"zone,omitempty"`           //failure domain, also available as the "zone" label
+	Endpoint string            `json:"endpoint,omitempty"`       //base url at which the worker serves its replicas to peers
+	Space    int64             `json:"checkout_space,omitempty"` //free bytes for checkouts, zero means the worker doesn't account for disk
+	CPUs     float64           `json:"cpus,omitempty"`           //cpus available to tasks, tasks that ask for more are not placed on the worker
+	MemoryMB int64             `json:"memory_mb,omitempty"`      //memory available to tasks, tasks that ask for more are not placed on the worker
 }
 
 //RegisterWorkerOutput is returned when a worker is added to a pool
 type RegisterWorkerOutput struct {
-	PoolID   string `json:"pool_id"`
-	WorkerID string `json:"worker_id"`
-	QueueURL string `json:"queue_url"`
-	Capacity int    `json:"capacity"`
+	PoolID   string            `json:"pool_id"`
+	WorkerID string            `json:"worker_id"`
+	QueueURL string            `json:"queue_url"`
+	Capacity int               `json:"capacity"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Zone     string            `json:"zone,omitempty"`
+	Endpoint string            `json:"endpoint,omitempty"`
+	CPUs     float64           `json:"cpus,omitempty"`
+	MemoryMB int64             `json:"memory_mb,omitempty"`
 }
 
 //DisbandPoolInput will remove a worker
@@ -30,28 +41,188 @@ type DisbandPoolInput struct {
 //DisbandPoolOutput is returned when a worker is removed
 type DisbandPoolOutput struct{}
 
+//DeregisterWorkerInput is send by a worker that shuts down
+type DeregisterWorkerInput struct {
+	PoolID   string `json:"pool_id"`
+	WorkerID string `json:"worker_id"`
+}
+
+//DeregisterWorkerOutput is returned when a worker left the pool
+type DeregisterWorkerOutput struct {
+	Rescheduled []string `json:"rescheduled,omitempty"` //allocs the worker still held, their evals are scheduled again
+}
+
 //SendHeartbeatInput is send when updating heartbeats
 type SendHeartbeatInput struct {
-	PoolID   string   `json:"pool_id"`
-	WorkerID string   `json:"worker_id"`
-	Allocs   []string `json:"allocs"`
-	Datasets []string `json:"datasets"`
+	PoolID    string            `json:"pool_id"`
+	WorkerID  string            `json:"worker_id"`
+	Allocs    []string          `json:"allocs"`
+	Datasets  []string          `json:"datasets"`
+	Versions  []*DatasetVersion `json:"versions,omitempty"`       //head version of each branch in the local replicas
+	Replicas  []*ReplicaState   `json:"replicas,omitempty"`       //commits the local replicas are at, used for version aware scheduling
+	Space     int64             `json:"checkout_space,omitempty"` //free bytes for checkouts
+	Checkouts []*CheckoutState  `json:"checkouts,omitempty"`      //checkouts that are on disk
+}
+
+//CheckoutState describes how much space the checkout of a dataset for an alloc takes
+type CheckoutState struct {
+	AllocID   string `json:"alloc_id"`
+	DatasetID string `json:"dataset_id"`
+	Size      int64  `json:"size"`
+}
+
+//ReplicaState describes which commits a local replica of a dataset holds
+type ReplicaState struct {
+	DatasetID string            `json:"dataset_id"`
+	Head      string            `json:"head"`           //commit that is checked out
+	Refs      map[string]string `json:"refs,omitempty"` //branch and tag names to the commits they point at
 }
 
 //SendHeartbeatOutput is returned when updating heartbeats
 type SendHeartbeatOutput struct {
-	//@TODO expired allocs(?), or itself(?)
+	StopAllocs    []string              `json:"stop_allocs,omitempty"`    //allocs the server no longer knows about, the worker should stop them
+	EvictReplicas []string              `json:"evict_replicas,omitempty"` //datasets the worker should remove its replica of
+	Retention     map[string]*Retention `json:"retention,omitempty"`      //retention hints for the replicas the worker reported
+}
+
+//Retention hints how workers should keep their replica of a dataset
+type Retention struct {
+	Pinned       bool `json:"pinned,omitempty"`        //the replica is never evicted to make room
+	KeepVersions int  `json:"keep_versions,omitempty"` //number of most recent versions to keep of each branch, zero keeps all history
+}
+
+//DatasetVersion identifies a specific version (commit) of a dataset
+type DatasetVersion struct {
+	DatasetID string `json:"dataset_id"`
+	Version   string `json:"version"`
+	Branch    string `json:"branch,omitempty"` //branch the version was committed on, used to match triggers
+	Parent    string `json:"parent,omitempty"` //parent commit, recorded in the dataset registry
+	Size      int64  `json:"size,omitempty"`   //size in bytes, recorded in the dataset registry and used to reserve disk space for checkouts
+}
+
+//Operators that can be used in label expressions
+const (
+	OpIn        = "in"         //label value is one of the values
+	OpNotIn     = "not_in"     //label is absent or its value is none of the values
+	OpExists    = "exists"     //label is present, regardless of its value
+	OpNotExists = "not_exists" //label is absent
+)
+
+//LabelExpr describes a condition on the labels of a worker
+type LabelExpr struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+	Weight   int      `json:"weight,omitempty"` //only used for preferences, defaults to 1
+}
+
+//AntiAffinity keeps an eval away from the allocs of another eval
+type AntiAffinity struct {
+	EvalID string `json:"eval_id"`
+	Scope  string `json:"scope,omitempty"` //empty for "not on the same worker", or a label key e.g "zone"
+}
+
+//TaskOutput is a dataset that is checked out writable for a task, changes are committed when the task is finished
+type TaskOutput struct {
+	DatasetID string `json:"dataset_id"`
+	Branch    string `json:"branch,omitempty"` //branch the new version is committed on
+	Size      int64  `json:"size,omitempty"`   //expected size in bytes of the output checkout, used to reserve disk space
+}
+
+//ResourceLimits constrain the container of a task
+type ResourceLimits struct {
+	MemoryMB int64   `json:"memory_mb,omitempty"`
+	CPUs     float64 `json:"cpus,omitempty"`
+}
+
+//Task describes the container that is run for an eval
+type Task struct {
+	Image   string            `json:"image"`
+	Command []string          `json:"command,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Inputs  []*DatasetVersion `json:"inputs,omitempty"` //checked out read-only
+	Outputs []*TaskOutput     `json:"outputs,omitempty"`
+	Limits  *ResourceLimits   `json:"limits,omitempty"`
+	Timeout int64             `json:"timeout,omitempty"` //seconds after which the task is stopped
 }
 
 //ScheduleEvalInput will block until allocations are available for the worker
 type ScheduleEvalInput struct {
-	PoolID    string `json:"pool_id"`
-	DatasetID string `json:"dataset_id"`
-	Size      int    `json:"size"`
+	PoolID       string              `json:"pool_id"`
+	DatasetID    string              `json:"dataset_id"`
+	Size         int                 `json:"size"`
+	Constraints  []*LabelExpr        `json:"constraints,omitempty"`
+	Preferences  []*LabelExpr        `json:"preferences,omitempty"`
+	AntiAffinity []*AntiAffinity     `json:"anti_affinity,omitempty"`
+	NotBefore    int64               `json:"not_before,omitempty"` //unix time before which the eval won't be placed
+	Deadline     int64               `json:"deadline,omitempty"`   //unix time after which the eval fails if it wasn't placed
+	Inputs       []*DatasetVersion   `json:"inputs,omitempty"`     //deprecated, use the inputs of the task
+	Task         *Task               `json:"task,omitempty"`
+	Count        int                 `json:"count,omitempty"`  //expand into this many indexed child evals
+	Params       []map[string]string `json:"params,omitempty"` //expand into one child eval per parameter map
 }
 
 //ScheduleEvalOutput is returned when new allocs are available
-type ScheduleEvalOutput struct{}
+type ScheduleEvalOutput struct {
+	EvalID string `json:"eval_id"`
+	State  string `json:"state"`
+}
+
+//States an eval can be in
+const (
+	EvalStatePending   = "pending"   //waiting in the scheduling queue
+	EvalStateDeferred  = "deferred"  //waiting for its not-before time
+	EvalStateAllocated = "allocated" //placed on a worker
+	EvalStateCompleted = "completed" //the alloc was completed
+	EvalStateFailed    = "failed"    //gave up, see the reason
+	EvalStateCancelled = "cancelled" //stopped on purpose, see the reason
+)
+
+//GetEvalInput describes an eval
+type GetEvalInput struct {
+	PoolID string `json:"pool_id"`
+	EvalID string `json:"eval_id"`
+}
+
+//GetEvalOutput is returned when describing an eval
+type GetEvalOutput struct {
+	EvalID       string         `json:"eval_id"`
+	State        string         `json:"state"`
+	Reason       string         `json:"reason,omitempty"`
+	AllocID      string         `json:"alloc_id,omitempty"`
+	NotBefore    int64          `json:"not_before,omitempty"`
+	Deadline     int64          `json:"deadline,omitempty"`
+	ParentEvalID string         `json:"parent_eval_id,omitempty"` //set on the children of an array eval
+	Count        int            `json:"count,omitempty"`          //number of children of an array eval
+	Counts       map[string]int `json:"counts,omitempty"`         //number of children per eval state
+}
+
+//ListReplicasInput lists the replicas of datasets in a pool
+type ListReplicasInput struct {
+	PoolID    string `json:"pool_id"`
+	DatasetID string `json:"dataset_id,omitempty"` //optionally only list replicas of one dataset
+}
+
+//ReplicaInfo describes a single replica of a dataset
+type ReplicaInfo struct {
+	WorkerID string            `json:"worker_id"`
+	Zone     string            `json:"zone,omitempty"`
+	Head     string            `json:"head,omitempty"`
+	Refs     map[string]string `json:"refs,omitempty"`
+}
+
+//DatasetReplicas describes where the replicas of a dataset are located
+type DatasetReplicas struct {
+	DatasetID  string         `json:"dataset_id"`
+	Replicas   []*ReplicaInfo `json:"replicas"`
+	Zones      []string       `json:"zones"`
+	SingleZone bool           `json:"single_zone"` //all replicas sit in one zone and should be spread
+}
+
+//ListReplicasOutput is returned when listing replicas
+type ListReplicasOutput struct {
+	Datasets []*DatasetReplicas `json:"datasets"`
+}
 
 //ReceiveAllocsInput will block until allocations are available for the worker
 type ReceiveAllocsInput struct {
@@ -62,10 +233,22 @@ type ReceiveAllocsInput struct {
 
 //Alloc payload is returned to indicate an allocation
 type Alloc struct {
-	PoolID   string `json:"pool_id"`
-	AllocID  string `json:"alloc_id"`
-	WorkerID string `json:"worker_id"`
-	//@TODO add some fields the worker has use for
+	PoolID       string            `json:"pool_id"`
+	AllocID      string            `json:"alloc_id"`
+	WorkerID     string            `json:"worker_id"`
+	EvalID       string            `json:"eval_id"`
+	Inputs       []*DatasetVersion `json:"inputs,omitempty"` //deprecated, use the inputs of the task
+	Task         *Task             `json:"task,omitempty"`
+	ParentEvalID string            `json:"parent_eval_id,omitempty"` //set when the eval is part of an array eval
+	Index        int               `json:"index"`
+	Params       map[string]string `json:"params,omitempty"`
+	Replication  *Replication      `json:"replication,omitempty"` //set when the alloc should clone a dataset instead of running a task
+}
+
+//Replication asks a worker to create a replica of a dataset
+type Replication struct {
+	DatasetID string `json:"dataset_id"`
+	Remote    string `json:"remote,omitempty"`
 }
 
 //ReceiveAllocsOutput is returned when new allocs are available
@@ -73,11 +256,374 @@ type ReceiveAllocsOutput struct {
 	Allocs []*Alloc `json:"allocs"`
 }
 
+//Outcomes of an allocation
+const (
+	AllocOutcomeSucceeded = "succeeded"
+	AllocOutcomeFailed    = "failed"
+	AllocOutcomeLost      = "lost" //the worker stopped the alloc before it finished, its eval is scheduled again
+)
+
 //CompleteAllocInput is provided to complete an allocation
 type CompleteAllocInput struct {
-	PoolID  string `json:"pool_id"`
-	AllocID string `json:"alloc_id"`
+	PoolID   string            `json:"pool_id"`
+	AllocID  string            `json:"alloc_id"`
+	Outcome  string            `json:"outcome,omitempty"` //succeeded (default), failed or lost
+	ExitCode int               `json:"exit_code"`
+	Outputs  []*DatasetVersion `json:"outputs,omitempty"` //dataset versions produced by the task
 }
 
 //CompleteAllocOutput is returned when a worker is removed
 type CompleteAllocOutput struct{}
+
+//Overlap policies decide what happens when a schedule fires while the eval of its previous run is still in progress
+const (
+	OverlapSkip    = "skip"    //don't submit a new eval (default)
+	OverlapAllow   = "allow"   //submit a new eval regardless
+	OverlapReplace = "replace" //cancel the previous eval and submit a new one
+)
+
+//CreateScheduleInput sets up a recurring eval in a pool
+type CreateScheduleInput struct {
+	PoolID   string             `json:"pool_id"`
+	Cron     string             `json:"cron"`    //e.g "0 2 * * *" or "@daily", in UTC
+	Overlap  string             `json:"overlap"` //skip, allow or replace
+	Template *ScheduleEvalInput `json:"template"`
+}
+
+//CreateScheduleOutput is returned when a schedule was created
+type CreateScheduleOutput struct {
+	ScheduleID string `json:"schedule_id"`
+	NextRun    int64  `json:"next_run"`
+}
+
+//ListSchedulesInput lists the schedules of a pool
+type ListSchedulesInput struct {
+	PoolID string `json:"pool_id"`
+}
+
+//ScheduleInfo describes a schedule
+type ScheduleInfo struct {
+	ScheduleID string `json:"schedule_id"`
+	Cron       string `json:"cron"`
+	Overlap    string `json:"overlap"`
+	Paused     bool   `json:"paused"`
+	NextRun    int64  `json:"next_run"`
+	LastEvalID string `json:"last_eval_id,omitempty"`
+}
+
+//ListSchedulesOutput is returned when listing schedules
+type ListSchedulesOutput struct {
+	Schedules []*ScheduleInfo `json:"schedules"`
+}
+
+//PauseScheduleInput stops a schedule from submitting evals until it is resumed
+type PauseScheduleInput struct {
+	PoolID     string `json:"pool_id"`
+	ScheduleID string `json:"schedule_id"`
+}
+
+//PauseScheduleOutput is returned when a schedule was paused
+type PauseScheduleOutput struct{}
+
+//ResumeScheduleInput continues a paused schedule
+type ResumeScheduleInput struct {
+	PoolID     string `json:"pool_id"`
+	ScheduleID string `json:"schedule_id"`
+}
+
+//ResumeScheduleOutput is returned when a schedule was resumed
+type ResumeScheduleOutput struct{}
+
+//DeleteScheduleInput removes a schedule
+type DeleteScheduleInput struct {
+	PoolID     string `json:"pool_id"`
+	ScheduleID string `json:"schedule_id"`
+}
+
+//DeleteScheduleOutput is returned when a schedule was removed
+type DeleteScheduleOutput struct{}
+
+//States of a workflow run
+const (
+	RunStateRunning   = "running"
+	RunStateSucceeded = "succeeded"
+	RunStateFailed    = "failed"
+)
+
+//States of a single node in a workflow run
+const (
+	NodeStateWaiting   = "waiting"   //dependencies haven't succeeded yet
+	NodeStateRunning   = "running"   //an eval was submitted
+	NodeStateSucceeded = "succeeded" //outputs were passed to the children
+	NodeStateFailed    = "failed"    //failed after all retries, the branch stopped
+	NodeStateSkipped   = "skipped"   //a dependency failed
+)
+
+//WorkflowNode is an eval template in a workflow, it is scheduled when all nodes it depends on succeeded with their outputs as its inputs
+type WorkflowNode struct {
+	Name      string             `json:"name"`
+	DependsOn []string           `json:"depends_on,omitempty"`
+	Retries   int                `json:"retries,omitempty"` //times a failed node is retried before its branch stops
+	Template  *ScheduleEvalInput `json:"template"`
+}
+
+//CreateWorkflowInput describes a directed acyclic graph of evals
+type CreateWorkflowInput struct {
+	PoolID string          `json:"pool_id"`
+	Nodes  []*WorkflowNode `json:"nodes"`
+}
+
+//CreateWorkflowOutput is returned when a workflow was created
+type CreateWorkflowOutput struct {
+	WorkflowID string `json:"workflow_id"`
+}
+
+//StartWorkflowInput starts a new run of a workflow
+type StartWorkflowInput struct {
+	PoolID     string            `json:"pool_id"`
+	WorkflowID string            `json:"workflow_id"`
+	Inputs     []*DatasetVersion `json:"inputs,omitempty"` //passed to nodes without dependencies
+}
+
+//StartWorkflowOutput is returned when a workflow run was started
+type StartWorkflowOutput struct {
+	RunID string `json:"run_id"`
+}
+
+//GetWorkflowRunInput describes a workflow run
+type GetWorkflowRunInput struct {
+	PoolID string `json:"pool_id"`
+	RunID  string `json:"run_id"`
+}
+
+//WorkflowNodeStatus describes the progress of a node in a workflow run
+type WorkflowNodeStatus struct {
+	Name     string            `json:"name"`
+	State    string            `json:"state"`
+	EvalID   string            `json:"eval_id,omitempty"`
+	Attempts int               `json:"attempts"`
+	Outputs  []*DatasetVersion `json:"outputs,omitempty"`
+}
+
+//GetWorkflowRunOutput is returned when describing a workflow run
+type GetWorkflowRunOutput struct {
+	RunID      string                `json:"run_id"`
+	WorkflowID string                `json:"workflow_id"`
+	State      string                `json:"state"`
+	Nodes      []*WorkflowNodeStatus `json:"nodes"`
+}
+
+//CreateTriggerInput sets up an eval that is submitted for every new version of a dataset
+type CreateTriggerInput struct {
+	PoolID    string             `json:"pool_id"`
+	DatasetID string             `json:"dataset_id"`
+	Branch    string             `json:"branch,omitempty"` //only versions on this branch, empty matches all branches
+	Template  *ScheduleEvalInput `json:"template"`         //the new version is added to its inputs
+}
+
+//CreateTriggerOutput is returned when a trigger was created
+type CreateTriggerOutput struct {
+	TriggerID string `json:"trigger_id"`
+}
+
+//ListTriggersInput lists the triggers of a pool
+type ListTriggersInput struct {
+	PoolID    string `json:"pool_id"`
+	DatasetID string `json:"dataset_id,omitempty"` //only list triggers for this dataset
+}
+
+//TriggerInfo describes a trigger
+type TriggerInfo struct {
+	TriggerID string `json:"trigger_id"`
+	DatasetID string `json:"dataset_id"`
+	Branch    string `json:"branch,omitempty"`
+}
+
+//ListTriggersOutput is returned when listing triggers
+type ListTriggersOutput struct {
+	Triggers []*TriggerInfo `json:"triggers"`
+}
+
+//DeleteTriggerInput removes a trigger
+type DeleteTriggerInput struct {
+	PoolID    string `json:"pool_id"`
+	TriggerID string `json:"trigger_id"`
+}
+
+//DeleteTriggerOutput is returned when a trigger was removed
+type DeleteTriggerOutput struct{}
+
+//CreateDatasetInput registers a dataset in a pool
+type CreateDatasetInput struct {
+	PoolID    string     `json:"pool_id"`
+	Name      string     `json:"name"`               //unique in the pool and used as the dataset id
+	Remote    string     `json:"remote,omitempty"`   //git remote the dataset is cloned from
+	Replicas  int        `json:"replicas,omitempty"` //desired number of replicas, zero leaves replication to the workers
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+//CreateDatasetOutput is returned when a dataset was registered
+type CreateDatasetOutput struct {
+	DatasetID string `json:"dataset_id"`
+}
+
+//GetDatasetInput describes a dataset
+type GetDatasetInput struct {
+	PoolID    string `json:"pool_id"`
+	DatasetID string `json:"dataset_id"`
+}
+
+//GetDatasetOutput is returned when describing a dataset
+type GetDatasetOutput struct {
+	DatasetID string     `json:"dataset_id"`
+	Remote    string     `json:"remote,omitempty"`
+	CreatedAt int64      `json:"created_at"`
+	Replicas  int        `json:"replicas,omitempty"`
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+//UpdateDatasetInput changes the desired number of replicas of a dataset and, if provided, its retention hints
+type UpdateDatasetInput struct {
+	PoolID    string     `json:"pool_id"`
+	DatasetID string     `json:"dataset_id"`
+	Replicas  int        `json:"replicas"`
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+//UpdateDatasetOutput is returned when a dataset was updated
+type UpdateDatasetOutput struct{}
+
+//ListDatasetVersionsInput lists the known versions of a dataset
+type ListDatasetVersionsInput struct {
+	PoolID    string `json:"pool_id"`
+	DatasetID string `json:"dataset_id"`
+}
+
+//VersionInfo describes a version of a dataset
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Parent    string `json:"parent,omitempty"`
+	Branch    string `json:"branch,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	AllocID   string `json:"alloc_id,omitempty"` //alloc that produced the version
+	CreatedAt int64  `json:"created_at"`
+}
+
+//ListDatasetVersionsOutput is returned when listing versions
+type ListDatasetVersionsOutput struct {
+	Versions []*VersionInfo `json:"versions"`
+}
+
+//GetReplicaPeersInput asks for workers a dataset can be fetched from
+type GetReplicaPeersInput struct {
+	PoolID    string `json:"pool_id"`
+	WorkerID  string `json:"worker_id"` //the asking worker, it is left out of the peers and its zone is preferred
+	DatasetID string `json:"dataset_id"`
+	Version   string `json:"version,omitempty"` //peers that hold this version are listed first
+}
+
+//Peer is a worker that serves its replica of a dataset read-only over git's http protocol
+type Peer struct {
+	WorkerID   string `json:"worker_id"`
+	Zone       string `json:"zone,omitempty"`
+	URL        string `json:"url"`
+	HasVersion bool   `json:"has_version"`
+}
+
+//GetReplicaPeersOutput lists peers from nearest to furthest, the remote is the upstream fallback
+type GetReplicaPeersOutput struct {
+	Peers  []*Peer `json:"peers"`
+	Remote string  `json:"remote,omitempty"`
+}
+
+//RemoveCheckoutInput is send when a worker removed the checkouts of an alloc, this releases the disk space that was reserved for them
+type RemoveCheckoutInput struct {
+	PoolID   string `json:"pool_id"`
+	WorkerID string `json:"worker_id"`
+	AllocID  string `json:"alloc_id"`
+}
+
+//RemoveCheckoutOutput is returned when the reservation was released
+type RemoveCheckoutOutput struct{}
+
+//Lineage directions
+const (
+	LineageUpstream   = "upstream"   //the steps and versions that led to a version
+	LineageDownstream = "downstream" //the steps and versions that followed from a version
+)
+
+//Lineage formats
+const (
+	LineageFormatJSON = "json"
+	LineageFormatDOT  = "dot"
+)
+
+//GetLineageInput asks for the lineage of a dataset version
+type GetLineageInput struct {
+	PoolID    string `json:"pool_id"`
+	DatasetID string `json:"dataset_id"`
+	Version   string `json:"version"`
+	Direction string `json:"direction,omitempty"` //upstream (default) or downstream
+	Depth     int    `json:"depth,omitempty"`     //number of steps to follow, zero follows as many as allowed
+	Format    string `json:"format,omitempty"`    //json (default) or dot
+}
+
+//LineageStep is a completed alloc that turned input versions into output versions
+type LineageStep struct {
+	AllocID   string            `json:"alloc_id"`
+	EvalID    string            `json:"eval_id"`
+	Image     string            `json:"image,omitempty"`
+	Inputs    []*DatasetVersion `json:"inputs,omitempty"`
+	Outputs   []*DatasetVersion `json:"outputs"`
+	CreatedAt int64             `json:"created_at"`
+}
+
+//GetLineageOutput holds the steps of the lineage, or its Graphviz rendering when asked for the dot format
+type GetLineageOutput struct {
+	Steps []*LineageStep `json:"steps,omitempty"`
+	DOT   string         `json:"dot,omitempty"`
+}
+
+//RemoveReplicaInput is send when a worker removed its replica of a dataset, such that the server doesn't wait for the replica to expire
+type RemoveReplicaInput struct {
+	PoolID    string `json:"pool_id"`
+	WorkerID  string `json:"worker_id"`
+	DatasetID string `json:"dataset_id"`
+}
+
+//RemoveReplicaOutput is returned when the replica was removed
+type RemoveReplicaOutput struct{}
+
+//LogLine is a line of output of an alloc
+type LogLine struct {
+	T    int64  `json:"t"` //unix time in nanoseconds
+	Line string `json:"line"`
+}
+
+//PutAllocLogsInput is send by workers to upload a chunk of the output of an alloc they run
+type PutAllocLogsInput struct {
+	PoolID   string     `json:"pool_id"`
+	WorkerID string     `json:"worker_id"`
+	AllocID  string     `json:"alloc_id"`
+	Lines    []*LogLine `json:"lines"`
+}
+
+//PutAllocLogsOutput is returned when the chunk was stored
+type PutAllocLogsOutput struct{}
+
+//GetAllocLogsInput asks for the output of an alloc
+type GetAllocLogsInput struct {
+	PoolID  string `json:"pool_id"`
+	AllocID string `json:"alloc_id"`
+	After   string `json:"after,omitempty"` //only return lines after this position, the next value of a previous call
+	Since   int64  `json:"since,omitempty"` //only return lines after this time in nanoseconds, ignored when after is given
+	Tail    int    `json:"tail,omitempty"`  //only return this many of the last lines, ignored when after or since is given
+	Wait    int64  `json:"wait,omitempty"`  //seconds to wait for new lines when there are none yet, to follow logs
+}
+
+//GetAllocLogsOutput holds lines of output in the order they were written
+type GetAllocLogsOutput struct {
+	Lines []*LogLine `json:"lines,omitempty"`
+	Next  string     `json:"next,omitempty"` //after value for the next call, empty if no lines were returned yet
+	Done  bool       `json:"done"`           //the alloc finished and all its output was returned
+}
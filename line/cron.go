@@ -0,0 +1,163 @@
+package line
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//CronExpr is a parsed cron expression with the classic five fields: minute, hour, day of month, month and day of week. Times are evaluated in UTC
+type CronExpr struct {
+	minute, hour, dom, month, dow uint64 //bitsets of allowed values
+	domAny, dowAny                bool   //wildcards change how days are matched
+}
+
+//cronMacros are shorthands for common expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//ParseCron parses a cron expression such as "30 2 * * 1-5" or "@daily"
+func ParseCron(s string) (expr *CronExpr, err error) {
+	s = strings.TrimSpace(s)
+	if macro, ok := cronMacros[s]; ok {
+		s = macro
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("expected 5 fields in cron expression '%s', got %d", s, len(fields))
+	}
+
+	expr = &CronExpr{
+		domAny: fields[2] == "*" || fields[2] == "?",
+		dowAny: fields[4] == "*" || fields[4] == "?",
+	}
+
+	for i, f := range []struct {
+		dst      *uint64
+		min, max int
+		name     string
+	}{
+		{&expr.minute, 0, 59, "minute"},
+		{&expr.hour, 0, 23, "hour"},
+		{&expr.dom, 1, 31, "day of month"},
+		{&expr.month, 1, 12, "month"},
+		{&expr.dow, 0, 7, "day of week"},
+	} {
+		if *f.dst, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s field", f.name)
+		}
+	}
+
+	//both 0 and 7 are sunday
+	if expr.dow&(1<<7) != 0 {
+		expr.dow = (expr.dow | 1) &^ (1 << 7)
+	}
+
+	return expr, nil
+}
+
+//parseCronField parses comma separated values, ranges and steps into a bitset
+func parseCronField(field string, min, max int) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step < 1 {
+				return 0, errors.Errorf("invalid step in '%s'", part)
+			}
+
+			part = part[:idx]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Errorf("invalid range start in '%s'", part)
+			}
+
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return 0, errors.Errorf("invalid range end in '%s'", part)
+			}
+		default:
+			if lo, err = strconv.Atoi(part); err != nil {
+				return 0, errors.Errorf("invalid value '%s'", part)
+			}
+
+			//a single value with a step means "starting at"
+			if step > 1 {
+				hi = max
+			} else {
+				hi = lo
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.Errorf("'%s' is out of range [%d-%d]", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+//Next returns the first moment after t that matches the expression, or the zero time if there is none within five years
+func (expr *CronExpr) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if expr.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !expr.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if expr.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+
+		if expr.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+//matchDay follows the cron convention: if both day fields are restricted a day matches if either matches
+func (expr *CronExpr) matchDay(t time.Time) bool {
+	dom := expr.dom&(1<<uint(t.Day())) != 0
+	dow := expr.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case expr.domAny && expr.dowAny:
+		return true
+	case expr.domAny:
+		return dow
+	case expr.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
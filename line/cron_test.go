@@ -0,0 +1,51 @@
+package line
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2017, 3, 15, 10, 30, 20, 0, time.UTC) //a wednesday
+	for _, c := range []struct {
+		expr string
+		exp  time.Time
+	}{
+		{"* * * * *", time.Date(2017, 3, 15, 10, 31, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2017, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 3, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 2 * * 1-5", time.Date(2017, 3, 16, 2, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 3, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * 6", time.Date(2017, 3, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+	} {
+		expr, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %v", c.expr, err)
+		}
+
+		if act := expr.Next(from); !act.Equal(c.exp) {
+			t.Errorf("'%s': expected %s, got %s", c.expr, c.exp, act)
+		}
+	}
+}
+
+func TestCronNeverMatches(t *testing.T) {
+	expr, err := ParseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next := expr.Next(time.Now()); !next.IsZero() {
+		t.Fatalf("expected an expression for a day that doesn't exist to never match, got %s", next)
+	}
+}
+
+func TestCronParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("expected '%s' to fail parsing", expr)
+		}
+	}
+}
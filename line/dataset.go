@@ -0,0 +1,537 @@
+package line
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//DatasetNameExp restricts dataset names such that they can be used as key prefixes
+var DatasetNameExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+//RemoteSchemes are the url schemes a dataset's remote may use, workers hand the remote to git so other transports are refused
+var RemoteSchemes = map[string]bool{"https": true, "ssh": true, "git": true}
+
+//CheckRemote validates the remote of a dataset, an empty remote means the dataset only lives on workers
+func CheckRemote(remote string) (err error) {
+	if remote == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(remote, "-") {
+		return errors.Errorf("invalid remote '%s'", remote)
+	}
+
+	loc, err := url.Parse(remote)
+	if err != nil {
+		return errors.Wrapf(err, "invalid remote '%s'", remote)
+	}
+
+	if !RemoteSchemes[loc.Scheme] || loc.Host == "" {
+		return errors.Errorf("invalid remote '%s', expected a https, ssh or git url", remote)
+	}
+
+	return nil
+}
+
+//DatasetPK describes the dataset's primary key in the base table
+type DatasetPK struct {
+	PoolID    string `dynamodbav:"pool"`
+	DatasetID string `dynamodbav:"set"`
+}
+
+//Dataset is a git repository registered in a pool, its name is used as its id
+type Dataset struct {
+	DatasetPK
+	Remote      string   `dynamodbav:"remote,omitempty"`
+	Created     int64    `dynamodbav:"ts"`
+	Replicas    int      `dynamodbav:"rf,omitempty"`   //desired number of replicas, zero leaves replication to the workers
+	Replicating []string `dynamodbav:"repl,omitempty"` //replication evals that are in progress
+	Pinned      bool     `dynamodbav:"pin,omitempty"`  //workers never evict their replica of a pinned dataset
+	Keep        int      `dynamodbav:"keep,omitempty"` //number of most recent versions workers keep of each branch, zero keeps all history
+}
+
+//VersionPK describes the version's primary key in the base table
+type VersionPK struct {
+	PoolID    string `dynamodbav:"pool"`
+	VersionID string `dynamodbav:"ver"`
+}
+
+//Version is a commit of a dataset
+type Version struct {
+	VersionPK
+	DatasetID string `dynamodbav:"set"`
+	Commit    string `dynamodbav:"commit"`
+	Parent    string `dynamodbav:"parent,omitempty"`
+	Branch    string `dynamodbav:"br,omitempty"`
+	Size      int64  `dynamodbav:"size,omitempty"`
+	AllocID   string `dynamodbav:"alloc,omitempty"` //alloc that produced the version, if any
+	Created   int64  `dynamodbav:"ts"`
+}
+
+var (
+	//ErrDatasetExists means a dataset exists while it was expected not to
+	ErrDatasetExists = errors.New("dataset already exists")
+
+	//ErrDatasetNotExists means a dataset was not found while expecting it to exist
+	ErrDatasetNotExists = errors.New("dataset doesn't exist")
+
+	//ErrVersionExists means a version exists while it was expected not to
+	ErrVersionExists = errors.New("version already exists")
+
+	//ErrVersionNotExists means a version was not found while expecting it to exist
+	ErrVersionNotExists = errors.New("version doesn't exist")
+)
+
+//FmtVersionID formats the version id such that the versions of a dataset can be queried by prefix
+func FmtVersionID(datasetID, commit string) string {
+	return fmt.Sprintf("%s:%s", datasetID, commit)
+}
+
+//PutNewDataset will put a dataset with the condition the pk doesn't exist yet
+func PutNewDataset(conf *Conf, db DB, set *Dataset) (err error) {
+	item, err := dynamodbattribute.MarshalMap(set)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.DatasetsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#set)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#set": aws.String("set"),
+		},
+		Item: item,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrDatasetExists
+	}
+
+	return nil
+}
+
+//GetDataset returns a dataset by its primary key
+func GetDataset(conf *Conf, db DB, pk DatasetPK) (set *Dataset, err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	var out *dynamodb.GetItemOutput
+	if out, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(conf.DatasetsTableName),
+		Key:       ipk,
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to get item")
+	}
+
+	if out.Item == nil {
+		return nil, ErrDatasetNotExists
+	}
+
+	set = &Dataset{}
+	err = dynamodbattribute.UnmarshalMap(out.Item, set)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return set, nil
+}
+
+//ListDatasets returns all datasets registered in a pool
+func ListDatasets(conf *Conf, db DB, poolID string) (sets []*Dataset, err error) {
+	poolattr, err := dynamodbattribute.Marshal(poolID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal pool id")
+	}
+
+	var ierr error
+	if err = db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.DatasetsTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":poolID": poolattr,
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			set := &Dataset{}
+			ierr = dynamodbattribute.UnmarshalMap(item, set)
+			if ierr != nil {
+				return false
+			}
+
+			sets = append(sets, set)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query datasets")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal dataset")
+	}
+
+	return sets, nil
+}
+
+//UpdateDatasetReplicas sets the desired number of replicas under the condition that the dataset exists
+func UpdateDatasetReplicas(conf *Conf, db DB, pk DatasetPK, replicas int) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	rfattr, err := dynamodbattribute.Marshal(replicas)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal replicas")
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.DatasetsTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String("SET #rf = :rf"),
+		ConditionExpression: aws.String("attribute_exists(#set)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#rf":  aws.String("rf"),
+			"#set": aws.String("set"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":rf": rfattr,
+		},
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrDatasetNotExists
+	}
+
+	return nil
+}
+
+//UpdateDatasetRetention sets the retention hints under the condition that the dataset exists
+func UpdateDatasetRetention(conf *Conf, db DB, pk DatasetPK, pinned bool, keep int) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		Pinned bool `dynamodbav:":pin"`
+		Keep   int  `dynamodbav:":keep"`
+	}{pinned, keep})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal retention")
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.DatasetsTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String("SET #pin = :pin, #keep = :keep"),
+		ConditionExpression: aws.String("attribute_exists(#set)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pin":  aws.String("pin"),
+			"#keep": aws.String("keep"),
+			"#set":  aws.String("set"),
+		},
+		ExpressionAttributeValues: vals,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrDatasetNotExists
+	}
+
+	return nil
+}
+
+//Retention returns the retention hints of the dataset for workers, or nil if workers may evict and prune it as they see fit
+func (set *Dataset) Retention() *client.Retention {
+	if !set.Pinned && set.Keep < 1 {
+		return nil
+	}
+
+	return &client.Retention{Pinned: set.Pinned, KeepVersions: set.Keep}
+}
+
+//UpdateDatasetReplicating stores the replication evals that are in progress
+func UpdateDatasetReplicating(conf *Conf, db DB, pk DatasetPK, evalIDs []string) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.DatasetsTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String("REMOVE #repl"),
+		ConditionExpression: aws.String("attribute_exists(#set)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#repl": aws.String("repl"),
+			"#set":  aws.String("set"),
+		},
+	}
+
+	if len(evalIDs) > 0 {
+		replattr, err := dynamodbattribute.Marshal(evalIDs)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal eval ids")
+		}
+
+		input.UpdateExpression = aws.String("SET #repl = :repl")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":repl": replattr}
+	}
+
+	if _, err = db.UpdateItem(input); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrDatasetNotExists
+	}
+
+	return nil
+}
+
+//PutNewVersion will put a version with the condition the pk doesn't exist yet, commits are immutable so the first report wins
+func PutNewVersion(conf *Conf, db DB, ver *Version) (err error) {
+	item, err := dynamodbattribute.MarshalMap(ver)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.VersionsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#ver)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#ver": aws.String("ver"),
+		},
+		Item: item,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrVersionExists
+	}
+
+	return nil
+}
+
+//UpdateVersionAlloc records the alloc that produced a version, workers may have reported the version in a heartbeat before the alloc completed
+func UpdateVersionAlloc(conf *Conf, db DB, pk VersionPK, allocID string) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	allocattr, err := dynamodbattribute.Marshal(allocID)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal alloc id")
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.VersionsTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String("SET #alloc = if_not_exists(#alloc, :alloc)"),
+		ConditionExpression: aws.String("attribute_exists(#ver)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#alloc": aws.String("alloc"),
+			"#ver":   aws.String("ver"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":alloc": allocattr,
+		},
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrVersionNotExists
+	}
+
+	return nil
+}
+
+//GetVersion returns a version by its primary key
+func GetVersion(conf *Conf, db DB, pk VersionPK) (ver *Version, err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	var out *dynamodb.GetItemOutput
+	if out, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(conf.VersionsTableName),
+		Key:       ipk,
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to get item")
+	}
+
+	if out.Item == nil {
+		return nil, ErrVersionNotExists
+	}
+
+	ver = &Version{}
+	err = dynamodbattribute.UnmarshalMap(out.Item, ver)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return ver, nil
+}
+
+//ListVersions returns all known versions of a dataset
+func ListVersions(conf *Conf, db DB, pk DatasetPK) (vers []*Version, err error) {
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		PoolID string `dynamodbav:":poolID"`
+		Prefix string `dynamodbav:":prefix"`
+	}{pk.PoolID, FmtVersionID(pk.DatasetID, "")})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal query values")
+	}
+
+	var ierr error
+	if err = db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.VersionsTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID AND begins_with (#ver, :prefix)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+			"#ver":  aws.String("ver"),
+		},
+		ExpressionAttributeValues: vals,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			ver := &Version{}
+			ierr = dynamodbattribute.UnmarshalMap(item, ver)
+			if ierr != nil {
+				return false
+			}
+
+			vers = append(vers, ver)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query versions")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal version")
+	}
+
+	return vers, nil
+}
+
+//RecordVersions registers reported versions of datasets that exist in the pool, versions of unknown datasets are ignored. If the versions were produced by an alloc it is recorded as well
+func RecordVersions(conf *Conf, db DB, poolID string, dvs []*client.DatasetVersion, allocID string) (err error) {
+	known := map[string]bool{}
+	for _, dv := range dvs {
+		exists, ok := known[dv.DatasetID]
+		if !ok {
+			_, err = GetDataset(conf, db, DatasetPK{PoolID: poolID, DatasetID: dv.DatasetID})
+			if err != nil && err != ErrDatasetNotExists {
+				return errors.Wrap(err, "failed to get dataset")
+			}
+
+			exists = err == nil
+			known[dv.DatasetID] = exists
+		}
+
+		if !exists {
+			continue
+		}
+
+		ver := &Version{
+			VersionPK: VersionPK{PoolID: poolID, VersionID: FmtVersionID(dv.DatasetID, dv.Version)},
+			DatasetID: dv.DatasetID,
+			Commit:    dv.Version,
+			Parent:    dv.Parent,
+			Branch:    dv.Branch,
+			Size:      dv.Size,
+			AllocID:   allocID,
+			Created:   time.Now().Unix(),
+		}
+
+		err = PutNewVersion(conf, db, ver)
+		if err == ErrVersionExists {
+			if allocID == "" {
+				continue
+			}
+
+			err = UpdateVersionAlloc(conf, db, ver.VersionPK, allocID)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "failed to record version '%s'", ver.VersionID)
+		}
+	}
+
+	return nil
+}
+
+//CheckDatasets verifies that the versions an eval's inputs are pinned at are registered in the pool. Datasets that are referred to otherwise may only be known to the workers that report them, they are not required to be registered
+func CheckDatasets(conf *Conf, db DB, poolID string, eval *Eval) (err error) {
+	for _, in := range eval.Inputs {
+		if in.Version == "" {
+			continue
+		}
+
+		if _, err = GetVersion(conf, db, VersionPK{
+			PoolID:    poolID,
+			VersionID: FmtVersionID(in.DatasetID, in.Version),
+		}); err != nil {
+			return errors.Wrapf(err, "input '%s' at version '%s'", in.DatasetID, in.Version)
+		}
+	}
+
+	return nil
+}
+
+//MaxAncestorDepth limits how many parents are followed when looking for ancestors of a version
+const MaxAncestorDepth = 32
+
+//FindAncestors follows the parents of a version in the registry and returns the commits it found, the walk stops at versions that weren't recorded
+func FindAncestors(conf *Conf, db DB, poolID, datasetID, commit string) (ancestors map[string]struct{}, err error) {
+	ancestors = map[string]struct{}{}
+	for i := 0; i < MaxAncestorDepth; i++ {
+		ver, err := GetVersion(conf, db, VersionPK{PoolID: poolID, VersionID: FmtVersionID(datasetID, commit)})
+		if err == ErrVersionNotExists {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to get version")
+		}
+
+		if ver.Parent == "" {
+			break
+		}
+
+		commit = ver.Parent
+		ancestors[commit] = struct{}{}
+	}
+
+	return ancestors, nil
+}
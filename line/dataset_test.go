@@ -0,0 +1,17 @@
+package line
+
+import "testing"
+
+func TestCheckRemote(t *testing.T) {
+	for _, remote := range []string{"", "https://github.com/org/repo.git", "ssh://git@github.com/org/repo.git", "git://example.com/repo"} {
+		if err := CheckRemote(remote); err != nil {
+			t.Errorf("expected '%s' to be a valid remote, got %v", remote, err)
+		}
+	}
+
+	for _, remote := range []string{"--upload-pack=touch /tmp/x", "ext::sh -c touch% /tmp/x", "file:///etc", "/var/lib/repo", "https://"} {
+		if err := CheckRemote(remote); err == nil {
+			t.Errorf("expected '%s' to be refused", remote)
+		}
+	}
+}
@@ -1,8 +1,475 @@
 package line
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//MaxQueueDelay is the longest (in seconds) SQS is able to delay a message, evals that need to wait longer are deferred in the evals table
+const MaxQueueDelay = 900
+
 //Eval is a scheduling evaluation
 type Eval struct {
-	Dataset string `dynamodbav:"set"`  //certain dataset must be available
-	Size    int    `dynamodbav:"size"` //certain capacity must be available
-	Retry   int    `dynamodbav:"try"`
+	EvalID       string              `dynamodbav:"id"`
+	Dataset      string              `dynamodbav:"set"`  //certain dataset must be available
+	Size         int                 `dynamodbav:"size"` //certain capacity must be available
+	Retry        int                 `dynamodbav:"try"`
+	Constraints  []*LabelExpr        `dynamodbav:"req,omitempty"` //worker labels that are required
+	Preferences  []*LabelExpr        `dynamodbav:"prf,omitempty"` //worker labels that are preferred
+	AntiAffinity []*AntiAffinity     `dynamodbav:"aaf,omitempty"` //stay away from the allocs of other evals
+	NotBefore    int64               `dynamodbav:"nbf,omitempty"` //unix time before which the eval may not be placed
+	Deadline     int64               `dynamodbav:"ddl,omitempty"` //unix time after which the eval fails if it wasn't placed
+	Task         *Task               `dynamodbav:"task,omitempty"`
+	Inputs       []*DatasetRef       `dynamodbav:"in,omitempty"`  //dataset versions the task takes as input
+	RunID        string              `dynamodbav:"run,omitempty"` //workflow run the eval is part of
+	Node         string              `dynamodbav:"node,omitempty"`
+	Count        int                 `dynamodbav:"cnt,omitempty"`   //array evals expand into this many children
+	Sweep        []map[string]string `dynamodbav:"sweep,omitempty"` //parameters for each child, only kept until the array is expanded
+	ParentID     string              `dynamodbav:"par,omitempty"`   //array eval the child belongs to
+	Index        int                 `dynamodbav:"idx,omitempty"`
+	Params       map[string]string   `dynamodbav:"prm,omitempty"`
+	Replicate    string              `dynamodbav:"rep,omitempty"`  //replication evals clone this dataset instead of running a task
+	Exclude      []string            `dynamodbav:"excl,omitempty"` //workers the eval may not be placed on
+	Disk         int64               `dynamodbav:"disk,omitempty"` //checkout space in bytes, determined when the eval is placed
+}
+
+//RequiredVersion returns the version of the eval's dataset that the task takes as input, or an empty string if any version will do
+func (eval *Eval) RequiredVersion() string {
+	for _, in := range eval.Inputs {
+		if in.DatasetID == eval.Dataset {
+			return in.Version
+		}
+	}
+
+	return ""
+}
+
+//DatasetRef refers to a specific version of a dataset
+type DatasetRef struct {
+	DatasetID string `dynamodbav:"set"`
+	Version   string `dynamodbav:"ver"`
+	Branch    string `dynamodbav:"br,omitempty"`
+	Size      int64  `dynamodbav:"size,omitempty"`
+}
+
+//NewDatasetRefs converts dataset versions from client payloads
+func NewDatasetRefs(dvs []*client.DatasetVersion) (refs []*DatasetRef, err error) {
+	for _, dv := range dvs {
+		if dv.DatasetID == "" || dv.Version == "" {
+			return nil, errors.Errorf("dataset version %+v requires both a dataset id and a version", dv)
+		}
+
+		if !DatasetNameExp.MatchString(dv.DatasetID) {
+			return nil, errors.Errorf("invalid dataset id '%s', expected it to match %s", dv.DatasetID, DatasetNameExp)
+		}
+
+		if dv.Size < 0 {
+			return nil, errors.Errorf("dataset version %+v can't have a negative size", dv)
+		}
+
+		refs = append(refs, &DatasetRef{DatasetID: dv.DatasetID, Version: dv.Version, Branch: dv.Branch, Size: dv.Size})
+	}
+
+	return refs, nil
+}
+
+//DatasetVersions converts dataset refs to client payloads
+func DatasetVersions(refs []*DatasetRef) (dvs []*client.DatasetVersion) {
+	for _, ref := range refs {
+		dvs = append(dvs, &client.DatasetVersion{DatasetID: ref.DatasetID, Version: ref.Version, Branch: ref.Branch, Size: ref.Size})
+	}
+
+	return dvs
+}
+
+//EvalPK describes the eval's primary key in the base table
+type EvalPK struct {
+	PoolID string `dynamodbav:"pool"`
+	EvalID string `dynamodbav:"eval"`
+}
+
+//EvalRecord keeps track of an eval's state over its lifetime
+type EvalRecord struct {
+	EvalPK
+	State    string         `dynamodbav:"st"`
+	Reason   string         `dynamodbav:"rsn,omitempty"`
+	AllocID  string         `dynamodbav:"alloc,omitempty"`
+	Deferred int64          `dynamodbav:"dfr,omitempty"` //only set while waiting for the not-before time, this keeps the index sparse
+	Eval     *Eval          `dynamodbav:"def"`
+	Counts   map[string]int `dynamodbav:"agg,omitempty"` //number of children per state, only for array evals
+	Expanded int            `dynamodbav:"exp,omitempty"` //number of children an array eval was expanded into so far
+}
+
+var (
+	//ErrEvalExists means a eval exists while it was expected not to
+	ErrEvalExists = errors.New("eval already exists")
+
+	//ErrEvalNotExists means a eval was not found while expecting it to exist
+	ErrEvalNotExists = errors.New("eval doesn't exist")
+
+	//ErrEvalStateChanged means a eval was not in the state it was expected to be in
+	ErrEvalStateChanged = errors.New("eval state changed")
+)
+
+//NewEval validates scheduling input and turns it into an eval with a new random id
+func NewEval(input *client.ScheduleEvalInput) (eval *Eval, err error) {
+	idb := make([]byte, 10)
+	_, err = rand.Read(idb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate random id bytes")
+	}
+
+	eval = &Eval{
+		EvalID:    hex.EncodeToString(idb),
+		Size:      input.Size,
+		Dataset:   input.DatasetID,
+		NotBefore: input.NotBefore,
+		Deadline:  input.Deadline,
+	}
+
+	if eval.Deadline > 0 && eval.Deadline <= eval.NotBefore {
+		return nil, errors.New("deadline must be after the not-before time")
+	}
+
+	if eval.Constraints, err = NewLabelExprs(input.Constraints); err != nil {
+		return nil, errors.Wrap(err, "invalid constraints")
+	}
+
+	if eval.Preferences, err = NewLabelExprs(input.Preferences); err != nil {
+		return nil, errors.Wrap(err, "invalid preferences")
+	}
+
+	if eval.AntiAffinity, err = NewAntiAffinities(input.AntiAffinity); err != nil {
+		return nil, errors.Wrap(err, "invalid anti-affinity")
+	}
+
+	if input.Task != nil {
+		if eval.Task, eval.Inputs, err = NewTask(input.Task); err != nil {
+			return nil, errors.Wrap(err, "invalid task")
+		}
+
+		//move compute to the data if the dataset wasn't explicitly specified
+		if eval.Dataset == "" && len(eval.Inputs) > 0 {
+			eval.Dataset = eval.Inputs[0].DatasetID
+		}
+	}
+
+	//inputs outside of the task are still accepted from clients that predate tasks
+	inputs, err := NewDatasetRefs(input.Inputs)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid inputs")
+	}
+
+	eval.Inputs = append(eval.Inputs, inputs...)
+
+	eval.Count, eval.Sweep = input.Count, input.Params
+	if len(eval.Sweep) > 0 {
+		if eval.Count > 0 && eval.Count != len(eval.Sweep) {
+			return nil, errors.Errorf("count %d doesn't match the %d parameter maps", eval.Count, len(eval.Sweep))
+		}
+
+		eval.Count = len(eval.Sweep)
+	}
+
+	if eval.Count < 0 || eval.Count > MaxArraySize {
+		return nil, errors.Errorf("array count must be between 0 and %d, got %d", MaxArraySize, eval.Count)
+	}
+
+	if len(eval.Sweep) > 0 {
+		data, err := json.Marshal(eval.Sweep)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode parameters")
+		}
+
+		if len(data) > MaxSweepBytes {
+			return nil, errors.Errorf("parameters take %d bytes encoded, at most %d are allowed", len(data), MaxSweepBytes)
+		}
+	}
+
+	return eval, nil
+}
+
+//PutNewEval will put an eval record with the condition the pk doesn't exist yet
+func PutNewEval(conf *Conf, db DB, rec *EvalRecord) (err error) {
+	item, err := dynamodbattribute.MarshalMap(rec)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.EvalsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#eval)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#eval": aws.String("eval"),
+		},
+		Item: item,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrEvalExists
+	}
+
+	return nil
+}
+
+//GetEval returns an eval record by its primary key
+func GetEval(conf *Conf, db DB, pk EvalPK) (rec *EvalRecord, err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	var out *dynamodb.GetItemOutput
+	if out, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(conf.EvalsTableName),
+		Key:       ipk,
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to get item")
+	}
+
+	if out.Item == nil {
+		return nil, ErrEvalNotExists
+	}
+
+	rec = &EvalRecord{}
+	err = dynamodbattribute.UnmarshalMap(out.Item, rec)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return rec, nil
+}
+
+//UpdateEvalState under the condition that it exists, this also clears the deferred timestamp
+func UpdateEvalState(conf *Conf, db DB, pk EvalPK, state, reason, allocID string) (err error) {
+	return updateEvalState(conf, db, pk, nil, state, reason, allocID, 0)
+}
+
+//AllocateEval marks a pending eval as allocated, it returns ErrEvalStateChanged if the eval is no longer pending, e.g. because it was cancelled or already allocated through a duplicate message
+func AllocateEval(conf *Conf, db DB, pk EvalPK, allocID string) (err error) {
+	return updateEvalState(conf, db, pk, []string{client.EvalStatePending}, client.EvalStateAllocated, "", allocID, 0)
+}
+
+//UndeferEval marks a deferred eval as pending, it returns ErrEvalStateChanged if the eval is no longer deferred such that only one release round enqueues it
+func UndeferEval(conf *Conf, db DB, pk EvalPK) (err error) {
+	return updateEvalState(conf, db, pk, []string{client.EvalStateDeferred}, client.EvalStatePending, "", "", 0)
+}
+
+//DeferEval marks a pending eval as deferred until the given unix time, such that a later release round enqueues it
+func DeferEval(conf *Conf, db DB, pk EvalPK, until int64) (err error) {
+	return updateEvalState(conf, db, pk, []string{client.EvalStatePending}, client.EvalStateDeferred, "", "", until)
+}
+
+//CancelEvalState marks an eval as cancelled under the condition that it isn't done yet, it returns ErrEvalStateChanged if it completed, failed or was cancelled in the meantime
+func CancelEvalState(conf *Conf, db DB, pk EvalPK, reason, allocID string) (err error) {
+	return updateEvalState(conf, db, pk, []string{client.EvalStatePending, client.EvalStateDeferred, client.EvalStateAllocated}, client.EvalStateCancelled, reason, allocID, 0)
+}
+
+//updateEvalState sets the state of an existing eval, if from is not empty the eval must be in one of those states. The deferred timestamp is cleared unless a new one is given
+func updateEvalState(conf *Conf, db DB, pk EvalPK, from []string, state, reason, allocID string, deferred int64) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		State    string `dynamodbav:":st"`
+		Reason   string `dynamodbav:":rsn"`
+		AllocID  string `dynamodbav:":alloc"`
+		Deferred int64  `dynamodbav:":dfr,omitempty"`
+	}{state, reason, allocID, deferred})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal state values")
+	}
+
+	update, cond := "SET #st = :st, #rsn = :rsn, #alloc = :alloc REMOVE #dfr", "attribute_exists(#eval)"
+	if deferred > 0 {
+		update = "SET #st = :st, #rsn = :rsn, #alloc = :alloc, #dfr = :dfr"
+	}
+
+	if len(from) > 0 {
+		var names []string
+		for i, st := range from {
+			name := fmt.Sprintf(":from%d", i)
+			vals[name] = &dynamodb.AttributeValue{S: aws.String(st)}
+			names = append(names, name)
+		}
+
+		cond = cond + " AND #st IN (" + strings.Join(names, ", ") + ")"
+	}
+
+	var out *dynamodb.UpdateItemOutput
+	if out, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.EvalsTableName),
+		Key:                 ipk,
+		ReturnValues:        aws.String(dynamodb.ReturnValueAllOld),
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String(cond),
+		ExpressionAttributeNames: map[string]*string{
+			"#st":    aws.String("st"),
+			"#rsn":   aws.String("rsn"),
+			"#alloc": aws.String("alloc"),
+			"#dfr":   aws.String("dfr"),
+			"#eval":  aws.String("eval"),
+		},
+		ExpressionAttributeValues: vals,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		if len(from) > 0 {
+			return ErrEvalStateChanged
+		}
+
+		return ErrEvalNotExists
+	}
+
+	//children of an array eval keep the counts on their parent up-to-date
+	prev := &EvalRecord{}
+	err = dynamodbattribute.UnmarshalMap(out.Attributes, prev)
+	if err != nil {
+		return errors.Wrap(err, "failed to unmarshal previous eval")
+	}
+
+	if prev.Eval != nil && prev.Eval.ParentID != "" && prev.State != state {
+		err = countChildState(conf, db, EvalPK{PoolID: pk.PoolID, EvalID: prev.Eval.ParentID}, prev.State, state)
+		if err != nil {
+			return errors.Wrap(err, "failed to update parent counts")
+		}
+	}
+
+	return nil
+}
+
+//Done returns whether the eval reached a state it will not leave anymore
+func (rec *EvalRecord) Done() bool {
+	switch rec.State {
+	case client.EvalStateCompleted, client.EvalStateFailed, client.EvalStateCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+//CancelEval stops an eval that is in progress, pending evals are dropped when they are received from the queue and allocated evals have their capacity released. The worker is told to stop the alloc on its next heartbeat
+func CancelEval(conf *Conf, svc *Services, rec *EvalRecord, reason string) (err error) {
+	if rec.Eval != nil && rec.Eval.Count > 0 {
+		return cancelArrayEval(conf, svc, rec, reason)
+	}
+
+	if rec.State == client.EvalStateAllocated && rec.AllocID != "" {
+		alloc, err := GetAlloc(conf, svc.DB, AllocPK{PoolID: rec.PoolID, AllocID: rec.AllocID})
+		if err != nil && err != ErrAllocNotExists {
+			return errors.Wrap(err, "failed to get alloc")
+		}
+
+		if alloc != nil {
+			err = releaseAlloc(conf, svc, alloc)
+			if err != nil {
+				return errors.Wrap(err, "failed to release alloc")
+			}
+		}
+	}
+
+	//an eval that completed or failed in the meantime keeps its outcome
+	err = CancelEvalState(conf, svc.DB, rec.EvalPK, reason, rec.AllocID)
+	if err != nil && err != ErrEvalStateChanged {
+		return errors.Wrap(err, "failed to update eval state")
+	}
+
+	return nil
+}
+
+//SubmitEval records a new eval and sends it to the pool's scheduling queue. If the eval has to wait longer then the queue is able to delay it is deferred and picked up by a later release round instead. Array evals are expanded into their children by the scheduler
+func SubmitEval(conf *Conf, svc *Services, pool *Pool, eval *Eval) (rec *EvalRecord, err error) {
+	if eval.Count > 0 {
+		return submitArrayEval(conf, svc, pool, eval)
+	}
+
+	rec = &EvalRecord{
+		EvalPK: EvalPK{PoolID: pool.PoolID, EvalID: eval.EvalID},
+		State:  client.EvalStatePending,
+		Eval:   eval,
+	}
+
+	delay := eval.NotBefore - time.Now().Unix()
+	if delay > MaxQueueDelay {
+		rec.State = client.EvalStateDeferred
+		rec.Deferred = eval.NotBefore
+	}
+
+	err = PutNewEval(conf, svc.DB, rec)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to put eval")
+	}
+
+	if rec.State == client.EvalStateDeferred {
+		return rec, nil
+	}
+
+	err = EnqueueEval(conf, svc, pool, eval)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to enqueue eval")
+	}
+
+	return rec, nil
+}
+
+//EnqueueEval sends an eval to the pool's scheduling queue, delaying it until its not-before time if necessary
+func EnqueueEval(conf *Conf, svc *Services, pool *Pool, eval *Eval) (err error) {
+	msg, err := evalMessage(eval)
+	if err != nil {
+		return err
+	}
+
+	if _, err := svc.SQS.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:     aws.String(pool.QueueURL),
+		MessageBody:  aws.String(msg),
+		DelaySeconds: aws.Int64(queueDelay(eval)),
+	}); err != nil {
+		return errors.Wrap(err, "failed to send message")
+	}
+
+	return nil
+}
+
+//evalMessage encodes an eval as the body of a scheduling message
+func evalMessage(eval *Eval) (msg string, err error) {
+	e := *eval
+	e.Sweep = nil //the parameters of an array eval are read from its record, they may not fit in a message
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode scheduling message")
+	}
+
+	return string(data), nil
+}
+
+//queueDelay returns the seconds a scheduling message needs to be delayed until the eval's not-before time, capped at what the queue supports
+func queueDelay(eval *Eval) int64 {
+	delay := eval.NotBefore - time.Now().Unix()
+	if delay < 0 {
+		return 0
+	} else if delay > MaxQueueDelay {
+		return MaxQueueDelay
+	}
+
+	return delay
 }
@@ -1,8 +1,11 @@
 package line
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -10,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/microfactory/line/line/client"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
@@ -85,6 +89,15 @@ func releaseWorkers(conf *Conf, svc *Services, pool *Pool) (err error) {
 	}
 
 	svc.Logs.Info("workers expired", zap.Int("n", len(out.Items)))
+
+	//replicas on expired workers are gone, even if their own ttl didn't expire yet
+	var replicas []*Replica
+	if len(out.Items) > 0 {
+		if replicas, err = ListReplicas(conf, svc.DB, pool.PoolID, ""); err != nil {
+			return errors.Wrap(err, "failed to list replicas")
+		}
+	}
+
 	for _, item := range out.Items {
 		worker := &Worker{}
 		err = dynamodbattribute.UnmarshalMap(item, worker)
@@ -93,16 +106,34 @@ func releaseWorkers(conf *Conf, svc *Services, pool *Pool) (err error) {
 			continue
 		}
 
-		if _, err = svc.SQS.DeleteQueue(&sqs.DeleteQueueInput{
-			QueueUrl: aws.String(FmtWorkerQueueURL(conf, worker.PoolID, worker.WorkerID)),
-		}); err != nil {
-			svc.Logs.Error("failed to remove worker queue", zap.Error(err))
+		if err = removeWorker(conf, svc, worker, replicas); err != nil {
+			svc.Logs.Error("failed to remove expired worker", zap.String("worker", fmt.Sprintf("%+v", worker.WorkerPK)), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+//removeWorker deletes a worker's queue and the worker itself, the replicas it held are gone with it
+func removeWorker(conf *Conf, svc *Services, worker *Worker, replicas []*Replica) (err error) {
+	if _, err = svc.SQS.DeleteQueue(&sqs.DeleteQueueInput{
+		QueueUrl: aws.String(FmtWorkerQueueURL(conf, worker.PoolID, worker.WorkerID)),
+	}); err != nil {
+		return errors.Wrap(err, "failed to remove worker queue")
+	}
+
+	err = DeleteWorker(conf, svc.DB, worker.WorkerPK)
+	if err != nil {
+		svc.Logs.Error("failed to delete worker", zap.String("worker", fmt.Sprintf("%+v", worker.WorkerPK)), zap.Error(err))
+	}
+
+	for _, replica := range replicas {
+		if replica.WorkerID != worker.WorkerID {
 			continue
 		}
 
-		err = DeleteWorker(conf, svc.DB, worker.WorkerPK)
-		if err != nil {
-			svc.Logs.Error("failed to delete worker", zap.String("worker", fmt.Sprintf("%+v", worker.WorkerPK)), zap.Error(err))
+		if err = DeleteReplica(conf, svc.DB, replica.ReplicaPK); err != nil {
+			svc.Logs.Error("failed to delete replica of removed worker", zap.String("replica", fmt.Sprintf("%+v", replica.ReplicaPK)), zap.Error(err))
 		}
 	}
 
@@ -134,14 +165,39 @@ func releaseAlloc(conf *Conf, svc *Services, alloc *Alloc) (err error) {
 		return errors.Wrap(err, "failed to delete allocation, may never release")
 	}
 
-	if _, err := svc.DB.UpdateItem(&dynamodb.UpdateItemInput{
+	//cpus and memory the alloc claimed are given back with its capacity
+	releasein := &dynamodb.UpdateItemInput{
 		TableName:        aws.String(conf.WorkersTableName),
 		Key:              wpk,
 		UpdateExpression: aws.String(`SET cap = cap + :allocSize`),
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":allocSize": allocSize,
 		},
-	}); err != nil {
+	}
+
+	if alloc.CPUs > 0 || alloc.MemoryMB > 0 {
+		sets := []string{"cap = cap + :allocSize"}
+		releasein.ExpressionAttributeNames = map[string]*string{}
+		if alloc.CPUs > 0 {
+			sets = append(sets, "#cpus = #cpus + :cpus")
+			releasein.ExpressionAttributeNames["#cpus"] = aws.String("cpus")
+			if releasein.ExpressionAttributeValues[":cpus"], err = dynamodbattribute.Marshal(alloc.CPUs); err != nil {
+				return errors.Wrap(err, "failed to marshal alloc cpus")
+			}
+		}
+
+		if alloc.MemoryMB > 0 {
+			sets = append(sets, "#mem = #mem + :mem")
+			releasein.ExpressionAttributeNames["#mem"] = aws.String("mem")
+			if releasein.ExpressionAttributeValues[":mem"], err = dynamodbattribute.Marshal(alloc.MemoryMB); err != nil {
+				return errors.Wrap(err, "failed to marshal alloc memory")
+			}
+		}
+
+		releasein.UpdateExpression = aws.String("SET " + strings.Join(sets, ", "))
+	}
+
+	if _, err := svc.DB.UpdateItem(releasein); err != nil {
 		//@TODO worker may have been removed, due do worker ttl or otherwise
 		return errors.Wrap(err, "failed to release capacity back to worker")
 	}
@@ -149,6 +205,61 @@ func releaseAlloc(conf *Conf, svc *Services, alloc *Alloc) (err error) {
 	return nil
 }
 
+//rescheduleAlloc sends the eval of an alloc that didn't finish back to the pool queue, or fails it when it was retried too often. The alloc itself is not released
+func rescheduleAlloc(conf *Conf, svc *Services, pool *Pool, alloc *Alloc, reason string) (err error) {
+	evalMsg, err := json.Marshal(alloc.Eval)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal eval msg")
+	}
+
+	//reschedule the allocation
+	if alloc.Eval.Retry >= conf.MaxRetry {
+		if _, err = svc.SQS.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(conf.ScheduleDLQueueURL),
+			MessageBody: aws.String(string(evalMsg)),
+		}); err != nil {
+			return errors.Wrap(err, "failed to send eval to dead letter queue")
+		}
+
+		if err = UpdateEvalState(conf, svc.DB, EvalPK{
+			PoolID: alloc.PoolID,
+			EvalID: alloc.Eval.EvalID,
+		}, client.EvalStateFailed, "max retries exceeded", alloc.AllocID); err != nil && err != ErrEvalNotExists {
+			return errors.Wrap(err, "failed to update eval state")
+		}
+
+		if err = AdvanceWorkflowRun(conf, svc, pool, alloc.Eval, false, nil); err != nil {
+			return errors.Wrap(err, "failed to advance workflow run")
+		}
+	} else {
+		//the eval is pending before its message can be received, the scheduler only allocates pending evals
+		evalPK := EvalPK{PoolID: alloc.PoolID, EvalID: alloc.Eval.EvalID}
+		if err = UpdateEvalState(conf, svc.DB, evalPK, client.EvalStatePending, reason, ""); err != nil && err != ErrEvalNotExists {
+			return errors.Wrap(err, "failed to update eval state")
+		}
+
+		if _, err = svc.SQS.SendMessage(&sqs.SendMessageInput{
+			QueueUrl:    aws.String(pool.QueueURL),
+			MessageBody: aws.String(string(evalMsg)),
+		}); err != nil {
+
+			aerr, ok := err.(awserr.Error)
+			if !ok || aerr.Code() != sqs.ErrCodeQueueDoesNotExist {
+				//the eval stays with the alloc, such that a retry reschedules it again
+				if uerr := UpdateEvalState(conf, svc.DB, evalPK, client.EvalStateAllocated, "", alloc.AllocID); uerr != nil && uerr != ErrEvalNotExists {
+					svc.Logs.Error("failed to update eval state", zap.Error(uerr))
+				}
+
+				return errors.Wrap(err, "failed to re-send eval on pool queue")
+			}
+
+			//else we assume the scheduling queue was deleted because the pool itself is disbanded, we dont try to reschedule
+		}
+	}
+
+	return nil
+}
+
 func releaseAllocs(conf *Conf, svc *Services, pool *Pool) (err error) {
 	condAttr, err := dynamodbattribute.MarshalMap(Alloc{
 		AllocPK: AllocPK{PoolID: pool.PoolID},
@@ -194,38 +305,175 @@ func releaseAllocs(conf *Conf, svc *Services, pool *Pool) (err error) {
 			continue
 		}
 
-		evalMsg, err := json.Marshal(alloc.Eval)
+		if err = rescheduleAlloc(conf, svc, pool, alloc, "alloc expired"); err != nil {
+			return err
+		}
+
+		//release the actual capacity
+		err = releaseAlloc(conf, svc, alloc)
 		if err != nil {
-			return errors.Wrap(err, "failed to marshal eval msg")
+			svc.Logs.Error("failed to release alloc", zap.Error(err))
+			continue
 		}
+	}
+
+	return nil
+}
+
+func releaseEvals(conf *Conf, svc *Services, pool *Pool) (err error) {
+	if pool.TTL > 0 {
+		return nil //pool is marked for deletion, no evaluations allowed
+	}
+
+	condAttr, err := dynamodbattribute.MarshalMap(EvalRecord{
+		EvalPK:   EvalPK{PoolID: pool.PoolID},
+		Deferred: time.Now().Unix(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal eval condition")
+	}
 
-		//reschedule expired allocation
-		if alloc.Eval.Retry >= conf.MaxRetry {
-			if _, err = svc.SQS.SendMessage(&sqs.SendMessageInput{
-				QueueUrl:    aws.String(conf.ScheduleDLQueueURL),
-				MessageBody: aws.String(string(evalMsg)),
-			}); err != nil {
-				return errors.Wrap(err, "failed to send eval to dead letter queue")
+	recs := []*EvalRecord{}
+	if err = svc.DB.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.EvalsTableName),
+		IndexName:              aws.String(conf.EvalsDeferIdxName),
+		KeyConditionExpression: aws.String("#pool = :poolID AND #dfr < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+			"#dfr":  aws.String("dfr"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":poolID": condAttr["pool"],
+			":now":    condAttr["dfr"],
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			rec := &EvalRecord{}
+			if err := dynamodbattribute.UnmarshalMap(item, rec); err != nil {
+				svc.Logs.Error("failed to unmarshal deferred eval", zap.Error(err))
+				continue
 			}
-		} else {
-			if _, err = svc.SQS.SendMessage(&sqs.SendMessageInput{
-				QueueUrl:    aws.String(pool.QueueURL),
-				MessageBody: aws.String(string(evalMsg)),
-			}); err != nil {
-
-				aerr, ok := err.(awserr.Error)
-				if !ok || aerr.Code() != sqs.ErrCodeQueueDoesNotExist {
-					return errors.Wrap(err, "failed to re-send eval on pool queue")
-				}
 
-				//else we assume the scheduling queue was deleted because the pool itself is disbanded, we dont try to reschedule
+			recs = append(recs, rec)
+		}
+
+		return true
+	}); err != nil {
+		return errors.Wrap(err, "failed to query deferred evals")
+	}
+
+	svc.Logs.Info("deferred evals due", zap.Int("n", len(recs)))
+	for _, rec := range recs {
+		if rec.Eval == nil {
+			svc.Logs.Error("deferred eval record has no eval")
+			continue
+		}
+
+		//the eval is pending before it is enqueued, such that a concurrent release round doesn't enqueue it as well and the scheduler finds it pending
+		err = UndeferEval(conf, svc.DB, rec.EvalPK)
+		if err == ErrEvalStateChanged {
+			continue
+		} else if err != nil {
+			svc.Logs.Error("failed to update eval state", zap.Error(err))
+			continue
+		}
+
+		//the eval is due but may wait a few more seconds in the queue until its not-before time
+		err = EnqueueEval(conf, svc, pool, rec.Eval)
+		if err != nil {
+			svc.Logs.Error("failed to enqueue deferred eval", zap.Error(err))
+			if err = DeferEval(conf, svc.DB, rec.EvalPK, rec.Deferred); err != nil {
+				svc.Logs.Error("failed to defer eval again", zap.Error(err))
 			}
+
+			continue
 		}
+	}
 
-		//release the actual capacity
-		err = releaseAlloc(conf, svc, alloc)
+	return nil
+}
+
+func runSchedules(conf *Conf, svc *Services, pool *Pool) (err error) {
+	if pool.TTL > 0 {
+		return nil //pool is marked for deletion, no evaluations allowed
+	}
+
+	scheds, err := ListSchedules(conf, svc.DB, pool.PoolID)
+	if err != nil {
+		return errors.Wrap(err, "failed to list schedules")
+	}
+
+	now := time.Now()
+	for _, sched := range scheds {
+		if sched.Paused || sched.NextRun > now.Unix() || sched.Template == nil {
+			continue
+		}
+
+		expr, err := ParseCron(sched.Cron)
 		if err != nil {
-			svc.Logs.Error("failed to release alloc", zap.Error(err))
+			svc.Logs.Error("failed to parse schedule cron", zap.String("sched", sched.ScheduleID), zap.Error(err))
+			continue
+		}
+
+		//an expression that never matches again would make the schedule overdue in every round, it is paused instead of fired
+		next := expr.Next(now)
+		if next.IsZero() {
+			svc.Logs.Info("pausing schedule that never runs again", zap.String("sched", sched.ScheduleID))
+			if err = UpdateSchedulePaused(conf, svc.DB, true, sched.EvalSchedulePK); err != nil {
+				svc.Logs.Error("failed to pause schedule", zap.String("sched", sched.ScheduleID), zap.Error(err))
+			}
+
+			continue
+		}
+
+		//find out whether the eval of the previous run is still in progress
+		var prev *EvalRecord
+		if sched.LastEvalID != "" {
+			prev, err = GetEval(conf, svc.DB, EvalPK{PoolID: pool.PoolID, EvalID: sched.LastEvalID})
+			if err != nil && err != ErrEvalNotExists {
+				svc.Logs.Error("failed to get previous eval", zap.String("sched", sched.ScheduleID), zap.Error(err))
+				continue
+			}
+
+			if prev != nil && prev.Done() {
+				prev = nil
+			}
+		}
+
+		eval, err := sched.Template.Instantiate()
+		if err != nil {
+			svc.Logs.Error("failed to instantiate eval template", zap.String("sched", sched.ScheduleID), zap.Error(err))
+			continue
+		}
+
+		skip := prev != nil && (sched.Overlap == "" || sched.Overlap == client.OverlapSkip)
+		lastEvalID := eval.EvalID
+		if skip {
+			lastEvalID = sched.LastEvalID
+		}
+
+		//claim this run first, such that concurrent rounds cannot submit it twice
+		err = AdvanceSchedule(conf, svc.DB, sched, next.Unix(), lastEvalID)
+		if err != nil {
+			svc.Logs.Info("failed to advance schedule", zap.String("sched", sched.ScheduleID), zap.Error(err))
+			continue
+		}
+
+		if skip {
+			svc.Logs.Info("skipping schedule run, previous eval in progress", zap.String("sched", sched.ScheduleID), zap.String("eval", prev.EvalID))
+			continue
+		}
+
+		if prev != nil && sched.Overlap == client.OverlapReplace {
+			err = CancelEval(conf, svc, prev, fmt.Sprintf("replaced by a new run of schedule %s", sched.ScheduleID))
+			if err != nil {
+				svc.Logs.Error("failed to cancel previous eval", zap.String("sched", sched.ScheduleID), zap.Error(err))
+			}
+		}
+
+		_, err = SubmitEval(conf, svc, pool, eval)
+		if err != nil {
+			svc.Logs.Error("failed to submit scheduled eval", zap.String("sched", sched.ScheduleID), zap.Error(err))
 			continue
 		}
 	}
@@ -233,6 +481,104 @@ func releaseAllocs(conf *Conf, svc *Services, pool *Pool) (err error) {
 	return nil
 }
 
+func reconcileReplicas(conf *Conf, svc *Services, pool *Pool) (err error) {
+	if pool.TTL > 0 {
+		return nil //pool is marked for deletion, no evaluations allowed
+	}
+
+	sets, err := ListDatasets(conf, svc.DB, pool.PoolID)
+	if err != nil {
+		return errors.Wrap(err, "failed to list datasets")
+	}
+
+	for _, set := range sets {
+		if set.Replicas < 1 {
+			continue //replication is not managed for this dataset
+		}
+
+		replicas, err := ListReplicas(conf, svc.DB, pool.PoolID, set.DatasetID)
+		if err != nil {
+			svc.Logs.Error("failed to list replicas", zap.String("set", set.DatasetID), zap.Error(err))
+			continue
+		}
+
+		//replication evals that finished either produced a replica or failed, both no longer count as in progress
+		var inflight []string
+		for _, evalID := range set.Replicating {
+			rec, err := GetEval(conf, svc.DB, EvalPK{PoolID: pool.PoolID, EvalID: evalID})
+			if err == ErrEvalNotExists {
+				continue
+			} else if err != nil {
+				svc.Logs.Error("failed to get replication eval", zap.String("eval", evalID), zap.Error(err))
+				inflight = append(inflight, evalID)
+				continue
+			}
+
+			if !rec.Done() {
+				inflight = append(inflight, evalID)
+			}
+		}
+
+		switch have := len(replicas) + len(inflight); {
+		case have < set.Replicas:
+			var holders []string
+			for _, replica := range replicas {
+				holders = append(holders, replica.WorkerID)
+			}
+
+			//new replicas stay away from existing ones and from each other
+			for i := have; i < set.Replicas; i++ {
+				idb := make([]byte, 10)
+				_, err = rand.Read(idb)
+				if err != nil {
+					return errors.Wrap(err, "failed to generate random id bytes")
+				}
+
+				eval := &Eval{
+					EvalID:    hex.EncodeToString(idb),
+					Size:      1,
+					Replicate: set.DatasetID,
+					Exclude:   holders,
+				}
+
+				for _, evalID := range inflight {
+					eval.AntiAffinity = append(eval.AntiAffinity, &AntiAffinity{EvalID: evalID})
+				}
+
+				if _, err = SubmitEval(conf, svc, pool, eval); err != nil {
+					svc.Logs.Error("failed to submit replication eval", zap.String("set", set.DatasetID), zap.Error(err))
+					break
+				}
+
+				inflight = append(inflight, eval.EvalID)
+			}
+
+			svc.Logs.Info("dataset under-replicated", zap.String("set", set.DatasetID), zap.Int("have", have), zap.Int("want", set.Replicas))
+		case len(replicas) > set.Replicas && len(inflight) < 1:
+			for _, replica := range PickEvictions(replicas, len(replicas)-set.Replicas) {
+				if err = UpdateWorkerEvictions(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: replica.WorkerID}, true, []string{set.DatasetID}); err != nil && err != ErrWorkerNotExists {
+					svc.Logs.Error("failed to mark replica for eviction", zap.String("rpl", replica.ReplicaID), zap.Error(err))
+					continue
+				}
+
+				if err = DeleteReplica(conf, svc.DB, replica.ReplicaPK); err != nil {
+					svc.Logs.Error("failed to delete evicted replica", zap.String("rpl", replica.ReplicaID), zap.Error(err))
+				}
+			}
+
+			svc.Logs.Info("dataset over-replicated", zap.String("set", set.DatasetID), zap.Int("have", len(replicas)), zap.Int("want", set.Replicas))
+		}
+
+		if strings.Join(inflight, ",") != strings.Join(set.Replicating, ",") {
+			if err = UpdateDatasetReplicating(conf, svc.DB, set.DatasetPK, inflight); err != nil {
+				svc.Logs.Error("failed to update replicating evals", zap.String("set", set.DatasetID), zap.Error(err))
+			}
+		}
+	}
+
+	return nil
+}
+
 //HandleRelease is a Lambda handler that periodically queries a pool's expired allocations, replicas and workers
 func HandleRelease(conf *Conf, svc *Services, ev json.RawMessage) (res interface{}, err error) {
 
@@ -255,6 +601,20 @@ func HandleRelease(conf *Conf, svc *Services, ev json.RawMessage) (res interface
 					continue
 				}
 
+				//@TODO do this concurrently(?)
+				err = releaseEvals(conf, svc, pool)
+				if err != nil {
+					svc.Logs.Error("failed to release deferred evals", zap.String("pool", pool.PoolID), zap.Error(err))
+					continue
+				}
+
+				//@TODO do this concurrently(?)
+				err = runSchedules(conf, svc, pool)
+				if err != nil {
+					svc.Logs.Error("failed to run schedules", zap.String("pool", pool.PoolID), zap.Error(err))
+					continue
+				}
+
 				//@TODO do this concurrently(?)
 				err = releaseReplicas(conf, svc, pool)
 				if err != nil {
@@ -268,6 +628,13 @@ func HandleRelease(conf *Conf, svc *Services, ev json.RawMessage) (res interface
 					svc.Logs.Error("failed to release workers", zap.String("pool", pool.PoolID), zap.Error(err))
 					continue
 				}
+
+				//@TODO do this concurrently(?)
+				err = reconcileReplicas(conf, svc, pool)
+				if err != nil {
+					svc.Logs.Error("failed to reconcile replicas", zap.String("pool", pool.PoolID), zap.Error(err))
+					continue
+				}
 			}
 
 			return true
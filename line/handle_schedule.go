@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -20,17 +21,18 @@ import (
 
 //FindReplicas returns locality information for an evaluation
 func FindReplicas(conf *Conf, svc *Services, eval *Eval, pool *Pool) ([]*Replica, error) {
-	evalattr, err := dynamodbattribute.MarshalMap(eval)
+	poolattr, err := dynamodbattribute.MarshalMap(pool)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to marshal eval")
 	}
 
-	poolattr, err := dynamodbattribute.MarshalMap(pool)
+	//the prefix includes the separator, such that dataset "a" doesn't match the replicas of dataset "ab"
+	setattr, err := dynamodbattribute.Marshal(FmtReplicaID(eval.Dataset, ""))
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to marshal eval")
+		return nil, errors.Wrap(err, "failed to marshal dataset prefix")
 	}
 
-	// Step 1: LOCALITY - Find all workers that have replica and store the zones these replicas are in. If no replicas are found, scheduling will fail
+	// Step 1: LOCALITY - Find all workers that have replica and the zones these replicas are in. If no replicas are found, any worker with capacity may be chosen
 	replicas := []*Replica{}
 	if eval.Dataset != "" {
 		locqin := &dynamodb.QueryInput{
@@ -43,7 +45,7 @@ func FindReplicas(conf *Conf, svc *Services, eval *Eval, pool *Pool) ([]*Replica
 			},
 			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 				":poolID":    poolattr["pool"],
-				":datasetID": evalattr["set"],
+				":datasetID": setattr,
 			},
 		}
 
@@ -87,9 +89,15 @@ func Schedule(conf *Conf, svc *Services, eval *Eval, pool *Pool, replicas []*Rep
 
 	// Step 2: CAPACITY - find workers with enough capacity in a given pool.
 
-	//query workers with enough capacity at this point-in-time
-	var capq *dynamodb.QueryOutput
-	if capq, err = svc.DB.Query(&dynamodb.QueryInput{
+	//workers that hold allocs of evals we have an anti-affinity with are excluded
+	conflicts, err := FindConflicts(conf, svc, eval, pool)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find conflicting workers")
+	}
+
+	//query workers with enough capacity at this point-in-time, we keep paging until we found enough workers that match the eval's labels and anti-affinity
+	var candidates []*Worker
+	if err = svc.DB.QueryPages(&dynamodb.QueryInput{
 		TableName: aws.String(conf.WorkersTableName),
 		IndexName: aws.String(conf.WorkersCapIdxName),
 		Limit:     aws.Int64(10),
@@ -102,39 +110,126 @@ func Schedule(conf *Conf, svc *Services, eval *Eval, pool *Pool, replicas []*Rep
 			":poolID":   poolattr["pool"],
 			":evalSize": evalattr["size"],
 		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+
+		//decode dynamo items into candidate workers
+		for _, item := range page.Items {
+			cand := &Worker{}
+			err := dynamodbattribute.UnmarshalMap(item, cand)
+			if err != nil {
+				svc.Logs.Error("failed to unmarshal item", zap.Error(err))
+				continue
+			}
+
+			if cand.TTL < time.Now().Unix() {
+				continue //skip expired workers
+			}
+
+			if !eval.Eligible(cand, conflicts) {
+				continue //skip workers that don't match labels or anti-affinity
+			}
+
+			if !cand.HasDisk(eval.Disk) {
+				continue //skip workers without room for the checkouts
+			}
+
+			if !cand.HasResources(eval.Task) {
+				continue //skip workers that are too small for the task
+			}
+
+			candidates = append(candidates, cand)
+		}
+
+		return len(candidates) < 10
 	}); err != nil {
 		return nil, errors.Wrap(err, "failed to query workers")
 	}
 
-	//decode dynamo items into candidate workers
-	var candidates []*Worker
-	for _, item := range capq.Items {
-		cand := &Worker{}
-		err := dynamodbattribute.UnmarshalMap(item, cand)
+	//if there is some locality information available, we would like to choose a worker that is near the data. Workers that hold a replica are not necessarily part of the capacity page so we check them explicitly
+	holders := map[string]struct{}{}
+	zones := map[string]struct{}{}
+	for _, replica := range replicas {
+		holders[replica.WorkerID] = struct{}{}
+		if replica.Zone != "" {
+			zones[replica.Zone] = struct{}{}
+		}
+	}
+
+	for _, cand := range candidates {
+		delete(holders, cand.WorkerID)
+	}
+
+	for workerID := range holders {
+		cand, err := GetWorker(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: workerID})
 		if err != nil {
-			svc.Logs.Error("failed to unmarshal item", zap.Error(err))
+			svc.Logs.Info("failed to get replica holding worker", zap.String("wrk", workerID), zap.Error(err))
 			continue
 		}
 
-		if cand.TTL < time.Now().Unix() {
-			continue //skip expired workers
+		if cand.TTL < time.Now().Unix() || cand.Capacity < eval.Size || !eval.Eligible(cand, conflicts) || !cand.HasDisk(eval.Disk) || !cand.HasResources(eval.Task) {
+			continue
 		}
 
 		candidates = append(candidates, cand)
 	}
 
-	//sort by workers with the highest capacity (spread) @TODO add a way of placing on lowest capacity, this will create more contention but allows more room for large placements in the future
-	svc.Logs.Info("received candidate workers", zap.Int("candidates", len(candidates)))
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].Capacity >= candidates[j].Capacity
-	})
+	//if the task needs a specific version, replicas that are not at it may still hold an ancestor from which the version can be fetched cheaply
+	version := eval.RequiredVersion()
+	ancestors := map[string]struct{}{}
+	if version != "" {
+		for _, replica := range replicas {
+			if replica.Has(version) {
+				continue
+			}
 
-	//if there is some locality information available, we would like to choose a worker that is near the data.
-	if len(replicas) > 0 {
-		//@TODO if workers with a replica have capacity, put these on top
-		//else put workers in the same zone on top
+			if ancestors, err = FindAncestors(conf, svc.DB, pool.PoolID, eval.Dataset, version); err != nil {
+				svc.Logs.Info("failed to find ancestors", zap.String("ver", version), zap.Error(err))
+			}
+
+			break
+		}
 	}
 
+	//locality ranks workers with a replica at the required version first, then replicas with an ancestor, then other replicas, then workers in the same zone as a replica and then everything else
+	locality := func(w *Worker) int {
+		for _, replica := range replicas {
+			if replica.WorkerID != w.WorkerID {
+				continue
+			}
+
+			switch {
+			case version == "" || replica.Has(version):
+				return 0
+			case replica.HasAny(ancestors):
+				return 1
+			default:
+				return 2
+			}
+		}
+
+		if _, ok := zones[w.Zone]; ok && w.Zone != "" {
+			return 3
+		}
+
+		return 4
+	}
+
+	//sort by locality, then by workers that match most preferences, then by the highest capacity (spread) @TODO add a way of placing on lowest capacity, this will create more contention but allows more room for large placements in the future
+	svc.Logs.Info("received candidate workers", zap.Int("candidates", len(candidates)))
+	sort.SliceStable(candidates, func(i, j int) bool {
+		li, lj := locality(candidates[i]), locality(candidates[j])
+		if li != lj {
+			return li < lj
+		}
+
+		si, sj := eval.Score(candidates[i]), eval.Score(candidates[j])
+		if si != sj {
+			return si > sj
+		}
+
+		return candidates[i].Capacity > candidates[j].Capacity
+	})
+
 	//if we have no candidates to begin we return an error en hope it will be better in the future
 	if len(candidates) < 1 {
 		return nil, errors.Errorf("not enough capacity")
@@ -147,17 +242,53 @@ func Schedule(conf *Conf, svc *Services, eval *Eval, pool *Pool, replicas []*Rep
 		return nil, errors.Wrap(err, "failed to marshal worker pk")
 	}
 
-	svc.Logs.Info("claim capacity of worker", zap.String("pool", worker.PoolID), zap.String("wrk", worker.WorkerID))
-	if _, err = svc.DB.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName:           aws.String(conf.WorkersTableName),
-		Key:                 pk,
-		UpdateExpression:    aws.String(`SET cap = cap - :claim`),
-		ConditionExpression: aws.String("cap >= :claim"),
+	//disk, cpus and memory are claimed together with compute on workers that account for them
+	sets, conds := []string{"cap = cap - :claim"}, []string{"cap >= :claim"}
+	claimin := &dynamodb.UpdateItemInput{
+		TableName:                aws.String(conf.WorkersTableName),
+		Key:                      pk,
+		ExpressionAttributeNames: map[string]*string{},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":claim": evalattr["size"],
 		},
-	}); err != nil {
-		return nil, errors.Wrap(err, "failed to update worker capacity")
+	}
+
+	claimDisk := eval.Disk > 0 && worker.Disk != nil
+	if claimDisk {
+		sets, conds = append(sets, "disk = disk - :disk"), append(conds, "disk >= :disk")
+		claimin.ExpressionAttributeNames["#dver"] = aws.String("dver")
+		claimin.ExpressionAttributeValues[":disk"] = evalattr["disk"]
+		claimin.ExpressionAttributeValues[":one"] = &dynamodb.AttributeValue{N: aws.String("1")}
+	}
+
+	var cpus float64
+	var mem int64
+	if eval.Task != nil && eval.Task.CPUs > 0 && worker.CPUs != nil {
+		cpus = eval.Task.CPUs
+		sets, conds = append(sets, "#cpus = #cpus - :cpus"), append(conds, "#cpus >= :cpus")
+		claimin.ExpressionAttributeNames["#cpus"] = aws.String("cpus")
+		if claimin.ExpressionAttributeValues[":cpus"], err = dynamodbattribute.Marshal(cpus); err != nil {
+			return nil, errors.Wrap(err, "failed to marshal cpus")
+		}
+	}
+
+	if eval.Task != nil && eval.Task.MemoryMB > 0 && worker.MemoryMB != nil {
+		mem = eval.Task.MemoryMB
+		sets, conds = append(sets, "#mem = #mem - :mem"), append(conds, "#mem >= :mem")
+		claimin.ExpressionAttributeNames["#mem"] = aws.String("mem")
+		if claimin.ExpressionAttributeValues[":mem"], err = dynamodbattribute.Marshal(mem); err != nil {
+			return nil, errors.Wrap(err, "failed to marshal memory")
+		}
+	}
+
+	if len(claimin.ExpressionAttributeNames) < 1 {
+		claimin.ExpressionAttributeNames = nil //an empty map is rejected
+	}
+
+	claimin.UpdateExpression = aws.String("SET " + strings.Join(sets, ", "))
+	claimin.ConditionExpression = aws.String(strings.Join(conds, " AND "))
+	if claimDisk {
+		claimin.UpdateExpression = aws.String(aws.StringValue(claimin.UpdateExpression) + " ADD #dver :one")
 	}
 
 	idb := make([]byte, 10)
@@ -166,12 +297,42 @@ func Schedule(conf *Conf, svc *Services, eval *Eval, pool *Pool, replicas []*Rep
 		return nil, errors.Wrap(err, "failed to generate random alloc id")
 	}
 
+	allocID := hex.EncodeToString(idb)
+
+	//the disk stays reserved until the worker removed the checkouts, which may well be after the alloc is released. The reservation is put before the disk is claimed so a failure leaves no claim behind and reconciling the disk space never misses it
+	co := &Checkout{
+		CheckoutPK: CheckoutPK{PoolID: worker.PoolID, CheckoutID: FmtCheckoutID(worker.WorkerID, allocID)},
+		WorkerID:   worker.WorkerID,
+		AllocID:    allocID,
+		Size:       eval.Disk,
+		TTL:        time.Now().Unix() + conf.AllocTTL,
+	}
+
+	if claimDisk {
+		if err = PutCheckout(conf, svc.DB, co); err != nil {
+			return nil, errors.Wrap(err, "failed to reserve checkout space")
+		}
+	}
+
+	svc.Logs.Info("claim capacity of worker", zap.String("pool", worker.PoolID), zap.String("wrk", worker.WorkerID))
+	if _, err = svc.DB.UpdateItem(claimin); err != nil {
+		if claimDisk {
+			if _, derr := DeleteCheckout(conf, svc.DB, co.CheckoutPK); derr != nil && derr != ErrCheckoutNotExists {
+				svc.Logs.Error("failed to remove unclaimed checkout reservation", zap.String("co", co.CheckoutID), zap.Error(derr))
+			}
+		}
+
+		return nil, errors.Wrap(err, "failed to update worker capacity")
+	}
+
 	eval.Retry = eval.Retry + 1
 	alloc = &Alloc{
-		AllocPK:  AllocPK{PoolID: worker.PoolID, AllocID: hex.EncodeToString(idb)},
+		AllocPK:  AllocPK{PoolID: worker.PoolID, AllocID: allocID},
 		TTL:      time.Now().Unix() + conf.AllocTTL,
 		WorkerID: worker.WorkerID,
 		Eval:     eval,
+		CPUs:     cpus,
+		MemoryMB: mem,
 	}
 
 	return alloc, nil
@@ -204,6 +365,77 @@ func ReceiveEvals(conf *Conf, svc *Services, pool *Pool) (err error) {
 				eval.Size = 1
 			}
 
+			//evals that were cancelled (or otherwise finished) while waiting in the queue are dropped
+			rec, err := GetEval(conf, svc.DB, EvalPK{PoolID: pool.PoolID, EvalID: eval.EvalID})
+			if err != nil && err != ErrEvalNotExists {
+				svc.Logs.Error("failed to get eval record", zap.Error(err))
+				continue
+			}
+
+			if rec != nil && rec.Done() {
+				svc.Logs.Info("dropping finished eval", zap.String("eval", eval.EvalID), zap.String("state", rec.State))
+				if _, err = svc.SQS.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(pool.QueueURL),
+					ReceiptHandle: msg.ReceiptHandle,
+				}); err != nil {
+					svc.Logs.Error("failed to delete eval msg", zap.Error(err))
+				}
+
+				continue
+			}
+
+			//array evals are expanded into their children a chunk at a time, the message is kept until all children were created
+			if eval.Count > 0 {
+				done := true
+				if rec != nil && rec.Eval != nil {
+					if done, err = expandArrayEval(conf, svc, pool, rec); err != nil {
+						svc.Logs.Error("failed to expand array eval", zap.String("eval", eval.EvalID), zap.Error(err))
+						continue
+					}
+				} else {
+					svc.Logs.Info("dropping array eval without a record", zap.String("eval", eval.EvalID))
+				}
+
+				if !done {
+					continue
+				}
+
+				if _, err = svc.SQS.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(pool.QueueURL),
+					ReceiptHandle: msg.ReceiptHandle,
+				}); err != nil {
+					svc.Logs.Error("failed to delete eval msg", zap.Error(err))
+				}
+
+				continue
+			}
+
+			//evals that couldn't be placed before their deadline are failed and removed from the queue
+			if eval.Deadline > 0 && eval.Deadline < time.Now().Unix() {
+				svc.Logs.Info("eval deadline exceeded", zap.String("eval", eval.EvalID))
+				if err = UpdateEvalState(conf, svc.DB, EvalPK{
+					PoolID: pool.PoolID,
+					EvalID: eval.EvalID,
+				}, client.EvalStateFailed, "deadline exceeded", ""); err != nil && err != ErrEvalNotExists {
+					svc.Logs.Error("failed to update eval state", zap.Error(err))
+					continue
+				}
+
+				if err = AdvanceWorkflowRun(conf, svc, pool, eval, false, nil); err != nil {
+					svc.Logs.Error("failed to advance workflow run", zap.Error(err))
+					continue
+				}
+
+				if _, err = svc.SQS.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(pool.QueueURL),
+					ReceiptHandle: msg.ReceiptHandle,
+				}); err != nil {
+					svc.Logs.Error("failed to delete eval msg", zap.Error(err))
+				}
+
+				continue
+			}
+
 			//if the eval requires specific dataset we can provide locality based scheduling by finding replicas in the pool
 			replicas := []*Replica{}
 			if eval.Dataset != "" {
@@ -214,6 +446,12 @@ func ReceiveEvals(conf *Conf, svc *Services, pool *Pool) (err error) {
 				}
 			}
 
+			//the checkout space is determined when placing, such that inputs that were added by triggers and workflows are accounted for
+			if eval.Disk, err = CheckoutSize(conf, svc.DB, pool.PoolID, eval); err != nil {
+				svc.Logs.Error("failed to determine checkout size", zap.Error(err))
+				continue
+			}
+
 			//find capacity in the pool
 			alloc, err := Schedule(conf, svc, eval, pool, replicas)
 			if err != nil {
@@ -227,15 +465,49 @@ func ReceiveEvals(conf *Conf, svc *Services, pool *Pool) (err error) {
 				continue
 			}
 
+			//the eval is allocated before the worker can see the alloc, such that a completion can't be overwritten. Only a pending eval is allocated: a duplicate message or an eval that was cancelled in the meantime gives its capacity back
+			evalPK := EvalPK{PoolID: pool.PoolID, EvalID: eval.EvalID}
+			if err = AllocateEval(conf, svc.DB, evalPK, alloc.AllocID); err != nil {
+				if rerr := releaseAlloc(conf, svc, alloc); rerr != nil {
+					svc.Logs.Error("failed to release alloc", zap.Error(rerr))
+				}
+
+				if err != ErrEvalStateChanged {
+					svc.Logs.Error("failed to allocate eval", zap.Error(err))
+					continue
+				}
+
+				svc.Logs.Info("dropping eval that is no longer pending", zap.String("eval", eval.EvalID))
+				if _, err = svc.SQS.DeleteMessage(&sqs.DeleteMessageInput{
+					QueueUrl:      aws.String(pool.QueueURL),
+					ReceiptHandle: msg.ReceiptHandle,
+				}); err != nil {
+					svc.Logs.Error("failed to delete eval msg", zap.Error(err))
+				}
+
+				continue
+			}
+
 			allocPl := &client.Alloc{
-				AllocID:  alloc.AllocID,
-				PoolID:   pool.PoolID,
-				WorkerID: alloc.WorkerID,
-				//@TODO fill with information the worker needs:
-				// - RAM/CPU limits
-				// - Docker image
-				// - DatasetID/version
-				// - AllocID
+				AllocID:      alloc.AllocID,
+				PoolID:       pool.PoolID,
+				WorkerID:     alloc.WorkerID,
+				EvalID:       eval.EvalID,
+				Task:         TaskPayload(eval),
+				Inputs:       DatasetVersions(eval.Inputs),
+				ParentEvalID: eval.ParentID,
+				Index:        eval.Index,
+				Params:       eval.Params,
+			}
+
+			if eval.Replicate != "" {
+				allocPl.Replication = &client.Replication{DatasetID: eval.Replicate}
+				set, err := GetDataset(conf, svc.DB, DatasetPK{PoolID: pool.PoolID, DatasetID: eval.Replicate})
+				if err == nil {
+					allocPl.Replication.Remote = set.Remote
+				} else if err != ErrDatasetNotExists {
+					svc.Logs.Error("failed to get dataset to replicate", zap.Error(err))
+				}
 			}
 
 			allocPlMsg, err := json.Marshal(allocPl)
@@ -249,6 +521,17 @@ func ReceiveEvals(conf *Conf, svc *Services, pool *Pool) (err error) {
 				MessageBody: aws.String(string(allocPlMsg)),
 			}); err != nil {
 				svc.Logs.Error("failed to send alloc msg", zap.Error(err))
+
+				//the worker never sees the alloc, the eval is scheduled again when its message becomes visible
+				if err = UpdateEvalState(conf, svc.DB, evalPK, client.EvalStatePending, "", ""); err != nil && err != ErrEvalNotExists {
+					svc.Logs.Error("failed to update eval state", zap.Error(err))
+					continue
+				}
+
+				if err = releaseAlloc(conf, svc, alloc); err != nil {
+					svc.Logs.Error("failed to release alloc", zap.Error(err))
+				}
+
 				continue
 			}
 
@@ -17,6 +17,8 @@ type Services struct {
 	SQS  sqsiface.SQSAPI           //message queues
 	DB   dynamodbiface.DynamoDBAPI //dynamodb nosql database
 	Logs *zap.Logger               //logging service
+
+	AllocLogs LogStore //output of allocs, defaults to the logs table
 }
 
 //Conf holds our configuration taken from the environment
@@ -32,6 +34,7 @@ type Conf struct {
 	WorkerTTL          int64  `envconfig:"WORKER_TTL"`
 	ReplicaTTL         int64  `envconfig:"REPLICA_TTL"`
 	AllocTTL           int64  `envconfig:"ALLOC_TTL"`
+	LogTTL             int64  `envconfig:"LOG_TTL"`
 	MaxRetry           int    `envconfig:"MAX_RETRY"`
 	ScheduleDLQueueURL string `envconfig:"SCHEDULE_DLQUEUE_URL"`
 
@@ -43,6 +46,18 @@ type Conf struct {
 	WorkersCapIdxName  string `envconfig:"TABLE_IDX_WORKERS_CAP"`
 	AllocsTableName    string `envconfig:"TABLE_NAME_ALLOCS"`
 	AllocsTTLIdxName   string `envconfig:"TABLE_IDX_ALLOCS_TTL"`
+	EvalsTableName     string `envconfig:"TABLE_NAME_EVALS"`
+	EvalsDeferIdxName  string `envconfig:"TABLE_IDX_EVALS_DEFER"`
+	SchedulesTableName string `envconfig:"TABLE_NAME_SCHEDULES"`
+	WorkflowsTableName string `envconfig:"TABLE_NAME_WORKFLOWS"`
+	RunsTableName      string `envconfig:"TABLE_NAME_RUNS"`
+	TriggersTableName  string `envconfig:"TABLE_NAME_TRIGGERS"`
+	FiringsTableName   string `envconfig:"TABLE_NAME_FIRINGS"`
+	DatasetsTableName  string `envconfig:"TABLE_NAME_DATASETS"`
+	VersionsTableName  string `envconfig:"TABLE_NAME_VERSIONS"`
+	CheckoutsTableName string `envconfig:"TABLE_NAME_CHECKOUTS"`
+	LineageTableName   string `envconfig:"TABLE_NAME_LINEAGE"`
+	LogsTableName      string `envconfig:"TABLE_NAME_LOGS"`
 }
 
 //Handler describes a Lambda handler that matches a specific suffic
@@ -0,0 +1,259 @@
+package line
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+//MaxLineageDepth limits how many steps are followed when walking the lineage of a version
+const MaxLineageDepth = 32
+
+//LineagePK describes the lineage item's primary key in the base table
+type LineagePK struct {
+	PoolID    string `dynamodbav:"pool"`
+	LineageID string `dynamodbav:"lin"`
+}
+
+//Lineage records a step that turned input versions into output versions. Each step is stored once for each of its outputs, to walk upstream, and once for each of its inputs, to walk downstream
+type Lineage struct {
+	LineagePK
+	AllocID string        `dynamodbav:"alloc"`
+	EvalID  string        `dynamodbav:"eval"`
+	Image   string        `dynamodbav:"img,omitempty"`
+	Inputs  []*DatasetRef `dynamodbav:"in,omitempty"`
+	Outputs []*DatasetRef `dynamodbav:"out"`
+	TS      int64         `dynamodbav:"ts"`
+}
+
+//FmtProducerID formats the id of the lineage item that records which step produced a version
+func FmtProducerID(datasetID, version string) string {
+	return fmt.Sprintf("out:%s@%s", datasetID, version)
+}
+
+//FmtConsumerID formats the id of the lineage item that records a step took a version as input, the consumers of a version can be queried by prefix
+func FmtConsumerID(datasetID, version, allocID string) string {
+	return fmt.Sprintf("in:%s@%s:%s", datasetID, version, allocID)
+}
+
+//RecordLineage stores the step of an alloc that completed with outputs
+func RecordLineage(conf *Conf, db DB, alloc *Alloc, outputs []*DatasetRef) (err error) {
+	if alloc.Eval == nil || len(outputs) < 1 {
+		return nil
+	}
+
+	step := &Lineage{
+		AllocID: alloc.AllocID,
+		EvalID:  alloc.Eval.EvalID,
+		Inputs:  alloc.Eval.Inputs,
+		Outputs: outputs,
+		TS:      time.Now().Unix(),
+	}
+
+	if alloc.Eval.Task != nil {
+		step.Image = alloc.Eval.Task.Image
+	}
+
+	var ids []string
+	for _, out := range outputs {
+		ids = append(ids, FmtProducerID(out.DatasetID, out.Version))
+	}
+
+	for _, in := range step.Inputs {
+		ids = append(ids, FmtConsumerID(in.DatasetID, in.Version, alloc.AllocID))
+	}
+
+	for _, id := range ids {
+		rec := *step
+		rec.LineagePK = LineagePK{PoolID: alloc.PoolID, LineageID: id}
+		item, err := dynamodbattribute.MarshalMap(rec)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal item map")
+		}
+
+		if _, err = db.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(conf.LineageTableName),
+			Item:      item,
+		}); err != nil {
+			return errors.Wrap(err, "failed to put item")
+		}
+	}
+
+	return nil
+}
+
+//GetProducer returns the step that produced a version, or nil if it wasn't recorded
+func GetProducer(conf *Conf, db DB, poolID, datasetID, version string) (step *Lineage, err error) {
+	ipk, err := dynamodbattribute.MarshalMap(LineagePK{PoolID: poolID, LineageID: FmtProducerID(datasetID, version)})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	var out *dynamodb.GetItemOutput
+	if out, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(conf.LineageTableName),
+		Key:       ipk,
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to get item")
+	}
+
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	step = &Lineage{}
+	err = dynamodbattribute.UnmarshalMap(out.Item, step)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return step, nil
+}
+
+//ListConsumers returns the steps that took a version as input and produced outputs
+func ListConsumers(conf *Conf, db DB, poolID, datasetID, version string) (steps []*Lineage, err error) {
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		PoolID string `dynamodbav:":poolID"`
+		Prefix string `dynamodbav:":prefix"`
+	}{poolID, FmtConsumerID(datasetID, version, "")})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal query values")
+	}
+
+	var ierr error
+	if err = db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.LineageTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID AND begins_with (#lin, :prefix)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+			"#lin":  aws.String("lin"),
+		},
+		ExpressionAttributeValues: vals,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			step := &Lineage{}
+			ierr = dynamodbattribute.UnmarshalMap(item, step)
+			if ierr != nil {
+				return false
+			}
+
+			steps = append(steps, step)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query lineage")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal lineage")
+	}
+
+	return steps, nil
+}
+
+//WalkLineage returns the steps upstream (that led to) or downstream (that followed from) a version, breadth first up to the given depth
+func WalkLineage(conf *Conf, db DB, poolID, datasetID, version string, downstream bool, depth int) (steps []*Lineage, err error) {
+	if depth < 1 || depth > MaxLineageDepth {
+		depth = MaxLineageDepth
+	}
+
+	seen := map[string]bool{}
+	visited := map[string]bool{}
+	frontier := []*DatasetRef{{DatasetID: datasetID, Version: version}}
+	for i := 0; i < depth && len(frontier) > 0; i++ {
+		var next []*DatasetRef
+		for _, ref := range frontier {
+			key := ref.DatasetID + "@" + ref.Version
+			if visited[key] {
+				continue
+			}
+
+			visited[key] = true
+			var found []*Lineage
+			if downstream {
+				if found, err = ListConsumers(conf, db, poolID, ref.DatasetID, ref.Version); err != nil {
+					return nil, errors.Wrap(err, "failed to list consumers")
+				}
+			} else {
+				producer, err := GetProducer(conf, db, poolID, ref.DatasetID, ref.Version)
+				if err != nil {
+					return nil, errors.Wrap(err, "failed to get producer")
+				}
+
+				if producer != nil {
+					found = append(found, producer)
+				}
+			}
+
+			for _, step := range found {
+				if seen[step.AllocID] {
+					continue
+				}
+
+				seen[step.AllocID] = true
+				steps = append(steps, step)
+				if downstream {
+					next = append(next, step.Outputs...)
+				} else {
+					next = append(next, step.Inputs...)
+				}
+			}
+		}
+
+		frontier = next
+	}
+
+	return steps, nil
+}
+
+//LineageDOT renders lineage steps as a Graphviz graph: versions are ellipses, steps are boxes labeled with their image and alloc
+func LineageDOT(steps []*Lineage) string {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintln(buf, "digraph lineage {")
+	fmt.Fprintln(buf, "\trankdir=LR;")
+
+	versions := map[string]bool{}
+	for _, step := range steps {
+		for _, ref := range append(append([]*DatasetRef{}, step.Inputs...), step.Outputs...) {
+			versions[ref.DatasetID+"@"+ref.Version] = true
+		}
+	}
+
+	var vids []string
+	for vid := range versions {
+		vids = append(vids, vid)
+	}
+
+	sort.Strings(vids)
+	for _, vid := range vids {
+		fmt.Fprintf(buf, "\t%q [shape=ellipse];\n", vid)
+	}
+
+	for _, step := range steps {
+		node := "alloc:" + step.AllocID
+		label := step.AllocID
+		if step.Image != "" {
+			label = step.Image + "\\n" + step.AllocID
+		}
+
+		fmt.Fprintf(buf, "\t%q [shape=box, label=\"%s\"];\n", node, strings.Replace(label, `"`, `\"`, -1))
+		for _, in := range step.Inputs {
+			fmt.Fprintf(buf, "\t%q -> %q;\n", in.DatasetID+"@"+in.Version, node)
+		}
+
+		for _, out := range step.Outputs {
+			fmt.Fprintf(buf, "\t%q -> %q;\n", node, out.DatasetID+"@"+out.Version)
+		}
+	}
+
+	fmt.Fprintln(buf, "}")
+	return buf.String()
+}
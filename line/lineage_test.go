@@ -0,0 +1,32 @@
+package line
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineageDOT(t *testing.T) {
+	dot := LineageDOT([]*Lineage{{
+		AllocID: "a1",
+		Image:   "busybox",
+		Inputs:  []*DatasetRef{{DatasetID: "raw", Version: "c1"}},
+		Outputs: []*DatasetRef{{DatasetID: "clean", Version: "c2"}},
+	}})
+
+	for _, exp := range []string{
+		"digraph lineage {",
+		`"clean@c2" [shape=ellipse];`,
+		`"raw@c1" [shape=ellipse];`,
+		`"alloc:a1" [shape=box, label="busybox\na1"];`,
+		`"raw@c1" -> "alloc:a1";`,
+		`"alloc:a1" -> "clean@c2";`,
+	} {
+		if !strings.Contains(dot, exp) {
+			t.Errorf("expected dot output to contain %s, got:\n%s", exp, dot)
+		}
+	}
+
+	if strings.Index(dot, "clean@c2") > strings.Index(dot, "raw@c1") {
+		t.Error("expected versions to be rendered in sorted order")
+	}
+}
@@ -0,0 +1,284 @@
+package line
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	//MaxLogLines limits how many lines of output are returned at once
+	MaxLogLines = 1000
+
+	//MaxLogChunkBytes limits the size of a chunk of output a worker uploads, it must fit in a single item
+	MaxLogChunkBytes = 256 * 1024
+
+	//MaxLogWait limits how many seconds a request for output waits for new lines, it must be well below the timeout of the gateway
+	MaxLogWait = 5
+)
+
+//LogPollInterval is how long to wait before looking for new lines again while following output
+var LogPollInterval = time.Second
+
+//LogStore holds the output of allocs
+type LogStore interface {
+
+	//PutLogs stores a chunk of lines of an alloc, the lines must be in the order they were written
+	PutLogs(poolID, workerID, allocID string, lines []*client.LogLine) error
+
+	//GetLogs returns at most limit lines that come after a position or, without one, that were written after since. The position of the last line is returned, or the position that was given if there are no lines
+	GetLogs(poolID, allocID string, after *LogPos, since int64, limit int) ([]*client.LogLine, *LogPos, error)
+
+	//TailLogs returns the last n lines and the position of the last one
+	TailLogs(poolID, allocID string, n int) ([]*client.LogLine, *LogPos, error)
+}
+
+//LogPos is the position of a line in the output of an alloc, lines are ordered by their chunk and then by their index in it. Unlike the time lines were written at, a position is unique
+type LogPos struct {
+	ChunkID string
+	Index   int
+}
+
+//String formats the position as the next value of a request for output
+func (p *LogPos) String() string {
+	return fmt.Sprintf("%s/%d", p.ChunkID, p.Index)
+}
+
+//ParseLogPos parses a position as formatted by String, it must be a position in the output of the alloc
+func ParseLogPos(allocID, s string) (pos *LogPos, err error) {
+	i := strings.LastIndex(s, "/")
+	if i < 0 || !strings.HasPrefix(s, allocID+":") {
+		return nil, errors.Errorf("invalid log position '%s'", s)
+	}
+
+	pos = &LogPos{ChunkID: s[:i]}
+	if pos.Index, err = strconv.Atoi(s[i+1:]); err != nil || pos.Index < 0 {
+		return nil, errors.Errorf("invalid log position '%s'", s)
+	}
+
+	return pos, nil
+}
+
+//LogChunkPK describes the log chunk's primary key in the base table
+type LogChunkPK struct {
+	PoolID  string `dynamodbav:"pool"`
+	ChunkID string `dynamodbav:"chunk"`
+}
+
+//LogChunk is a consecutive part of the output of an alloc
+type LogChunk struct {
+	LogChunkPK
+	AllocID string            `dynamodbav:"alloc"`
+	First   int64             `dynamodbav:"first"`
+	Last    int64             `dynamodbav:"last"`
+	Lines   []*client.LogLine `dynamodbav:"lines"`
+	TTL     int64             `dynamodbav:"ttl"`
+}
+
+//FmtLogChunkID formats the id of a chunk such that the chunks of an alloc sort by the time of their first line
+func FmtLogChunkID(allocID string, first int64, workerID string) string {
+	return fmt.Sprintf("%s:%020d:%s", allocID, first, workerID)
+}
+
+//DynamoLogStore stores the output of allocs as chunks in the logs table, chunks expire after the log ttl
+type DynamoLogStore struct {
+	conf *Conf
+	db   DB
+}
+
+//NewDynamoLogStore creates a log store on top of the logs table
+func NewDynamoLogStore(conf *Conf, db DB) *DynamoLogStore {
+	return &DynamoLogStore{conf: conf, db: db}
+}
+
+//PutLogs puts the lines as a single chunk
+func (s *DynamoLogStore) PutLogs(poolID, workerID, allocID string, lines []*client.LogLine) (err error) {
+	if len(lines) < 1 {
+		return nil
+	}
+
+	first, last := lines[0].T, lines[len(lines)-1].T
+	item, err := dynamodbattribute.MarshalMap(&LogChunk{
+		LogChunkPK: LogChunkPK{PoolID: poolID, ChunkID: FmtLogChunkID(allocID, first, workerID)},
+		AllocID:    allocID,
+		First:      first,
+		Last:       last,
+		Lines:      lines,
+		TTL:        time.Now().Unix() + s.conf.LogTTL,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = s.db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.conf.LogsTableName),
+		Item:      item,
+	}); err != nil {
+		return errors.Wrap(err, "failed to put item")
+	}
+
+	return nil
+}
+
+//GetLogs queries the chunks from the one at the position, or those that end after since, in the order they were put
+func (s *DynamoLogStore) GetLogs(poolID, allocID string, after *LogPos, since int64, limit int) (lines []*client.LogLine, last *LogPos, err error) {
+	from := allocID + ":"
+	if after != nil {
+		from = after.ChunkID
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		PoolID string `dynamodbav:":poolID"`
+		From   string `dynamodbav:":from"`
+		To     string `dynamodbav:":to"`
+	}{poolID, from, allocID + ";"}) //';' sorts right after ':' so this covers all chunks of the alloc
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal query values")
+	}
+
+	query := &dynamodb.QueryInput{
+		TableName:              aws.String(s.conf.LogsTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID AND #chunk BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool":  aws.String("pool"),
+			"#chunk": aws.String("chunk"),
+		},
+		ExpressionAttributeValues: vals,
+	}
+
+	if after == nil {
+		query.FilterExpression = aws.String("#last > :since")
+		query.ExpressionAttributeNames["#last"] = aws.String("last")
+		if query.ExpressionAttributeValues[":since"], err = dynamodbattribute.Marshal(since); err != nil {
+			return nil, nil, errors.Wrap(err, "failed to marshal since")
+		}
+	}
+
+	var ierr error
+	var chunks []*LogChunk
+	count := 0
+	if err = s.db.QueryPages(query, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			chunk := &LogChunk{}
+			ierr = dynamodbattribute.UnmarshalMap(item, chunk)
+			if ierr != nil {
+				return false
+			}
+
+			chunks = append(chunks, chunk)
+			found, _ := LogLinesAfter([]*LogChunk{chunk}, after, since, limit)
+			count += len(found)
+		}
+
+		return count < limit
+	}); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to query logs")
+	}
+
+	if ierr != nil {
+		return nil, nil, errors.Wrap(ierr, "failed to unmarshal log chunk")
+	}
+
+	lines, last = LogLinesAfter(chunks, after, since, limit)
+	return lines, last, nil
+}
+
+//TailLogs queries the chunks from the last backwards until it found enough lines
+func (s *DynamoLogStore) TailLogs(poolID, allocID string, n int) (lines []*client.LogLine, last *LogPos, err error) {
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		PoolID string `dynamodbav:":poolID"`
+		Prefix string `dynamodbav:":prefix"`
+	}{poolID, allocID + ":"})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal query values")
+	}
+
+	var ierr error
+	var chunks []*LogChunk
+	count := 0
+	if err = s.db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(s.conf.LogsTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID AND begins_with (#chunk, :prefix)"),
+		ScanIndexForward:       aws.Bool(false),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool":  aws.String("pool"),
+			"#chunk": aws.String("chunk"),
+		},
+		ExpressionAttributeValues: vals,
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			chunk := &LogChunk{}
+			ierr = dynamodbattribute.UnmarshalMap(item, chunk)
+			if ierr != nil {
+				return false
+			}
+
+			chunks = append([]*LogChunk{chunk}, chunks...)
+			if count += len(chunk.Lines); count >= n {
+				return false
+			}
+		}
+
+		return true
+	}); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to query logs")
+	}
+
+	if ierr != nil {
+		return nil, nil, errors.Wrap(ierr, "failed to unmarshal log chunk")
+	}
+
+	lines, last = LastLogLines(chunks, n)
+	return lines, last, nil
+}
+
+//LogLinesAfter returns at most limit lines of the chunks that come after the position or, without one, that were written after since. Chunks must be in the order of their ids, the position of the last line is returned or the position that was given if there are no lines
+func LogLinesAfter(chunks []*LogChunk, after *LogPos, since int64, limit int) (lines []*client.LogLine, last *LogPos) {
+	last = after
+	for _, chunk := range chunks {
+		for i, line := range chunk.Lines {
+			if len(lines) >= limit {
+				return lines, last
+			}
+
+			if after != nil && (chunk.ChunkID < after.ChunkID || (chunk.ChunkID == after.ChunkID && i <= after.Index)) {
+				continue
+			}
+
+			if after == nil && line.T <= since {
+				continue
+			}
+
+			lines = append(lines, line)
+			last = &LogPos{ChunkID: chunk.ChunkID, Index: i}
+		}
+	}
+
+	return lines, last
+}
+
+//LastLogLines returns the last n lines of the chunks and the position of the last one, chunks must be in the order of their ids
+func LastLogLines(chunks []*LogChunk, n int) (lines []*client.LogLine, last *LogPos) {
+	for i := len(chunks) - 1; i >= 0 && len(lines) < n; i-- {
+		chunk := chunks[i]
+		if last == nil && len(chunk.Lines) > 0 {
+			last = &LogPos{ChunkID: chunk.ChunkID, Index: len(chunk.Lines) - 1}
+		}
+
+		from := len(chunk.Lines) - (n - len(lines))
+		if from < 0 {
+			from = 0
+		}
+
+		lines = append(append([]*client.LogLine{}, chunk.Lines[from:]...), lines...)
+	}
+
+	return lines, last
+}
@@ -0,0 +1,74 @@
+package line
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestLogChunkIDsSortByTime(t *testing.T) {
+	if !(FmtLogChunkID("a1", 999, "w2") < FmtLogChunkID("a1", 1000, "w1")) {
+		t.Error("expected chunk ids to sort by the time of their first line")
+	}
+}
+
+func TestLogLinesAfterPagesLinesOfTheSameTime(t *testing.T) {
+	chunks := []*LogChunk{
+		{LogChunkPK: LogChunkPK{ChunkID: FmtLogChunkID("a1", 1, "w1")}, Lines: []*client.LogLine{{T: 1, Line: "a"}, {T: 2, Line: "b1"}}},
+		{LogChunkPK: LogChunkPK{ChunkID: FmtLogChunkID("a1", 2, "w1")}, Lines: []*client.LogLine{{T: 2, Line: "b2"}, {T: 2, Line: "b3"}, {T: 3, Line: "c"}}},
+	}
+
+	var pages []string
+	var after *LogPos
+	for i := 0; i < 4; i++ {
+		lines, last := LogLinesAfter(chunks, after, 0, 2)
+		for _, line := range lines {
+			pages = append(pages, line.Line)
+		}
+
+		pages = append(pages, "|")
+		after = last
+	}
+
+	if act := strings.Join(pages, ","); act != "a,b1,|,b2,b3,|,c,|,|" {
+		t.Fatalf("expected every line to be paged exactly once, got %s", act)
+	}
+
+	if after.ChunkID != chunks[1].ChunkID || after.Index != 2 {
+		t.Fatalf("expected to end at the last line, got %+v", after)
+	}
+
+	if lines, last := LogLinesAfter(chunks, nil, 1, 10); len(lines) != 4 || lines[0].Line != "b1" || last.Index != 2 {
+		t.Fatalf("expected the lines after the time without a position, got %+v at %+v", lines, last)
+	}
+}
+
+func TestLastLogLines(t *testing.T) {
+	chunks := []*LogChunk{
+		{LogChunkPK: LogChunkPK{ChunkID: FmtLogChunkID("a1", 1, "w1")}, Lines: []*client.LogLine{{T: 1, Line: "a"}, {T: 2, Line: "b"}}},
+		{LogChunkPK: LogChunkPK{ChunkID: FmtLogChunkID("a1", 3, "w1")}, Lines: []*client.LogLine{{T: 3, Line: "c"}}},
+	}
+
+	lines, last := LastLogLines(chunks, 2)
+	if len(lines) != 2 || lines[0].Line != "b" || lines[1].Line != "c" || last.ChunkID != chunks[1].ChunkID || last.Index != 0 {
+		t.Fatalf("expected the last two lines in order, got %+v at %+v", lines, last)
+	}
+
+	if lines, last = LastLogLines(nil, 2); len(lines) != 0 || last != nil {
+		t.Fatalf("expected no lines without chunks, got %+v at %+v", lines, last)
+	}
+}
+
+func TestParseLogPos(t *testing.T) {
+	pos := &LogPos{ChunkID: FmtLogChunkID("a1", 1, "w1"), Index: 3}
+	if act, err := ParseLogPos("a1", pos.String()); err != nil || *act != *pos {
+		t.Fatalf("expected the position to round trip, got %+v (%v)", act, err)
+	}
+
+	for _, s := range []string{"", "a1", pos.String()[:len(pos.String())-2], "a2:1:w1/1", FmtLogChunkID("a1", 1, "w1") + "/-1"} {
+		if _, err := ParseLogPos("a1", s); err == nil {
+			t.Errorf("expected '%s' to be an invalid position", s)
+		}
+	}
+}
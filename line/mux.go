@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,6 +17,7 @@ import (
 	"github.com/microfactory/line/line/client"
 	"github.com/pkg/errors"
 	"github.com/pressly/chi"
+	"go.uber.org/zap"
 )
 
 //FmtReplicaID formats the combined pool and worker id of a replica
@@ -21,6 +25,11 @@ func FmtReplicaID(datasetID, workerID string) string {
 	return fmt.Sprintf("%s:%s", datasetID, workerID)
 }
 
+//FmtReplicaURL formats the url at which a worker serves its replica of a dataset as a bare git repository
+func FmtReplicaURL(endpoint, datasetID string) string {
+	return fmt.Sprintf("%s/%s.git", strings.TrimRight(endpoint, "/"), datasetID)
+}
+
 //FmtWorkerQueueName will format a sqs queue name consistently
 func FmtWorkerQueueName(conf *Conf, poolID, workerID string) string {
 	return fmt.Sprintf("%s-%s-%s", conf.Deployment, poolID, workerID)
@@ -44,6 +53,10 @@ func FmtWorkerQueueURL(conf *Conf, poolID, workerID string) string {
 //Mux sets up the HTTP multiplexer
 func Mux(conf *Conf, svc *Services) http.Handler {
 	r := chi.NewRouter()
+	logs := svc.AllocLogs
+	if logs == nil {
+		logs = NewDynamoLogStore(conf, svc.DB)
+	}
 
 	//
 	// Create Pool
@@ -107,6 +120,22 @@ func Mux(conf *Conf, svc *Services) http.Handler {
 			return errors.Wrap(err, "failed to generate random id bytes")
 		}
 
+		//the zone is the failure domain of the worker, it is also made available as a label such that it can be used in expressions and anti-affinity
+		labels := map[string]string{}
+		for k, v := range input.Labels {
+			labels[k] = v
+		}
+
+		if _, ok := labels["zone"]; !ok && input.Zone != "" {
+			labels["zone"] = input.Zone
+		}
+
+		if input.Endpoint != "" {
+			if _, err = url.ParseRequestURI(input.Endpoint); err != nil {
+				return errors.Wrap(err, "invalid endpoint")
+			}
+		}
+
 		workerID := hex.EncodeToString(idb)
 		var qout *sqs.CreateQueueOutput
 		if qout, err = svc.SQS.CreateQueue(&sqs.CreateQueueInput{
@@ -123,6 +152,27 @@ func Mux(conf *Conf, svc *Services) http.Handler {
 			QueueURL: aws.StringValue(qout.QueueUrl),
 			Capacity: input.Capacity,
 			TTL:      time.Now().Unix() + conf.WorkerTTL,
+			Labels:   labels,
+			Zone:     input.Zone,
+			Endpoint: input.Endpoint,
+		}
+
+		if input.CPUs < 0 || input.MemoryMB < 0 {
+			return errors.Errorf("worker resources can't be negative, got %v cpus and %d MB", input.CPUs, input.MemoryMB)
+		}
+
+		if input.CPUs > 0 {
+			worker.CPUs = aws.Float64(input.CPUs)
+		}
+
+		if input.MemoryMB > 0 {
+			worker.MemoryMB = aws.Int64(input.MemoryMB)
+		}
+
+		if input.Space < 0 {
+			return errors.Errorf("checkout space can't be negative, got %d", input.Space)
+		} else if input.Space > 0 {
+			worker.Disk = aws.Int64(input.Space)
 		}
 
 		err = PutNewWorker(conf, svc.DB, worker)
@@ -135,6 +185,11 @@ func Mux(conf *Conf, svc *Services) http.Handler {
 			WorkerID: worker.WorkerID,
 			QueueURL: worker.QueueURL,
 			Capacity: worker.Capacity,
+			Labels:   worker.Labels,
+			Zone:     worker.Zone,
+			Endpoint: worker.Endpoint,
+			CPUs:     aws.Float64Value(worker.CPUs),
+			MemoryMB: aws.Int64Value(worker.MemoryMB),
 		}
 
 		return encodeOutput(w, output)
@@ -166,6 +221,72 @@ func Mux(conf *Conf, svc *Services) http.Handler {
 		return encodeOutput(w, &client.DisbandPoolOutput{})
 	}))
 
+	//
+	// DeregisterWorker
+	//
+	r.Post("/DeregisterWorker", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.DeregisterWorkerInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		worker, err := GetWorker(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: input.WorkerID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get worker")
+		}
+
+		//allocs are released before the worker is deleted, releasing gives capacity back to the worker
+		allocs, err := ListWorkerAllocs(conf, svc.DB, worker.WorkerPK)
+		if err != nil {
+			return errors.Wrap(err, "failed to list worker allocs")
+		}
+
+		output := &client.DeregisterWorkerOutput{}
+		for _, alloc := range allocs {
+			if alloc.Eval == nil {
+				continue
+			}
+
+			if err = rescheduleAlloc(conf, svc, pool, alloc, "worker left the pool"); err != nil {
+				return errors.Wrap(err, "failed to reschedule alloc")
+			}
+
+			if err = releaseAlloc(conf, svc, alloc); err != nil {
+				return errors.Wrap(err, "failed to release alloc")
+			}
+
+			output.Rescheduled = append(output.Rescheduled, alloc.AllocID)
+		}
+
+		cos, err := ListCheckouts(conf, svc.DB, worker.WorkerPK)
+		if err != nil {
+			return errors.Wrap(err, "failed to list checkouts")
+		}
+
+		for _, co := range cos {
+			if _, err = DeleteCheckout(conf, svc.DB, co.CheckoutPK); err != nil && err != ErrCheckoutNotExists {
+				return errors.Wrap(err, "failed to delete checkout")
+			}
+		}
+
+		replicas, err := ListReplicas(conf, svc.DB, pool.PoolID, "")
+		if err != nil {
+			return errors.Wrap(err, "failed to list replicas")
+		}
+
+		if err = removeWorker(conf, svc, worker, replicas); err != nil {
+			return errors.Wrap(err, "failed to remove worker")
+		}
+
+		return encodeOutput(w, output)
+	}))
+
 	//
 	// SendHeartbeat
 	//
@@ -182,41 +303,244 @@ func Mux(conf *Conf, svc *Services) http.Handler {
 		}
 
 		now := time.Now().Unix()
-		if err = UpdateWorkerTTL(conf, svc.DB, now+conf.WorkerTTL, WorkerPK{
+		worker, err := UpdateWorkerTTL(conf, svc.DB, now+conf.WorkerTTL, WorkerPK{
 			PoolID:   pool.PoolID,
 			WorkerID: input.WorkerID,
-		}); err != nil {
+		})
+		if err != nil {
 			return errors.Wrap(err, "failed to update worker ttl")
 		}
 
-		//update replicas, resetting the ttl
+		//update allocs first, moving the ttl futher into the future such that nothing below can cause them to expire. Allocs that no longer exist (released or cancelled) are reported back such that the worker can stop them: a schedule that replaces its previous run cancels an eval while its alloc still runs, failing the heartbeat instead would fail every heartbeat of that worker from then on
+		output := &client.SendHeartbeatOutput{}
+		for _, allocID := range input.Allocs {
+			apk := AllocPK{
+				PoolID:  pool.PoolID,
+				AllocID: allocID,
+			}
+
+			if err = UpdateAllocTTL(conf, svc.DB, now+conf.AllocTTL, apk); err != nil {
+				if err == ErrAllocNotExists {
+					output.StopAllocs = append(output.StopAllocs, allocID)
+					continue
+				}
+
+				return errors.Wrapf(err, "failed to update alloc ttl: %+v", allocID)
+			}
+		}
+
+		//update replicas, resetting the ttl. Replicas may be reported with the commits they hold or just by their dataset
+		states := map[string]*client.ReplicaState{}
 		for _, datasetID := range input.Datasets {
+			states[datasetID] = &client.ReplicaState{DatasetID: datasetID}
+		}
+
+		for _, state := range input.Replicas {
+			states[state.DatasetID] = state
+		}
+
+		//replicas that are marked for eviction are no longer recorded, once the worker stops reporting them the mark is removed
+		var evicted []string
+		for _, datasetID := range worker.Evict {
+			if _, ok := states[datasetID]; ok {
+				output.EvictReplicas = append(output.EvictReplicas, datasetID)
+				delete(states, datasetID)
+				continue
+			}
+
+			evicted = append(evicted, datasetID)
+		}
+
+		if len(evicted) > 0 {
+			if err = UpdateWorkerEvictions(conf, svc.DB, worker.WorkerPK, false, evicted); err != nil {
+				return errors.Wrap(err, "failed to remove evictions")
+			}
+		}
+
+		var changed []*client.DatasetVersion
+		for datasetID, state := range states {
 			replica := &Replica{
 				ReplicaPK: ReplicaPK{
 					PoolID:    pool.PoolID,
-					ReplicaID: FmtReplicaID(datasetID, input.WorkerID),
+					ReplicaID: FmtReplicaID(datasetID, worker.WorkerID),
 				},
-				TTL: now + conf.ReplicaTTL,
+				TTL:       now + conf.ReplicaTTL,
+				DatasetID: datasetID,
+				WorkerID:  worker.WorkerID,
+				Zone:      worker.Zone,
+				Head:      state.Head,
+				Refs:      state.Refs,
 			}
 
-			if err = PutReplica(conf, svc.DB, replica); err != nil {
+			old, err := SwapReplica(conf, svc.DB, replica)
+			if err != nil {
 				return errors.Wrapf(err, "failed to update replica: %+v", replica)
 			}
+
+			//only branches that moved since the last heartbeat can hold versions that weren't recorded yet
+			changed = append(changed, ChangedVersions(old, datasetID, input.Versions)...)
+
+			//registered datasets may come with hints on how to keep the replica
+			set, err := GetDataset(conf, svc.DB, DatasetPK{PoolID: pool.PoolID, DatasetID: datasetID})
+			if err == ErrDatasetNotExists {
+				continue
+			} else if err != nil {
+				return errors.Wrap(err, "failed to get dataset")
+			}
+
+			if hint := set.Retention(); hint != nil {
+				if output.Retention == nil {
+					output.Retention = map[string]*client.Retention{}
+				}
+
+				output.Retention[datasetID] = hint
+			}
 		}
 
-		//update allocs, moving the ttl futher into the future
-		for _, allocID := range input.Allocs {
-			apk := AllocPK{
-				PoolID:  pool.PoolID,
-				AllocID: allocID,
+		//new versions on the branches of the replicas may fire triggers, a trigger that fails is no reason to fail the heartbeat
+		versions, err := NewDatasetRefs(changed)
+		if err != nil {
+			return errors.Wrap(err, "invalid versions")
+		}
+
+		if err = RecordVersions(conf, svc.DB, pool.PoolID, changed, ""); err != nil {
+			svc.Logs.Error("failed to record versions", zap.String("wrk", worker.WorkerID), zap.Error(err))
+		} else if err = FireTriggers(conf, svc, pool, versions); err != nil {
+			svc.Logs.Error("failed to fire triggers", zap.String("wrk", worker.WorkerID), zap.Error(err))
+		}
+
+		//the unreserved disk space follows from the free space and the reservations that haven't been checked out yet
+		if input.Space > 0 {
+			if err = ReconcileCheckouts(conf, svc.DB, worker.WorkerPK, input.Space, input.Checkouts); err != nil {
+				return errors.Wrap(err, "failed to reconcile checkouts")
 			}
+		}
 
-			if err = UpdateAllocTTL(conf, svc.DB, now+conf.AllocTTL, apk); err != nil {
-				return errors.Wrapf(err, "failed to update alloc ttl: %+v", allocID)
+		return encodeOutput(w, output)
+	}))
+
+	//
+	// RemoveCheckout
+	//
+	r.Post("/RemoveCheckout", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.RemoveCheckoutInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		co, err := DeleteCheckout(conf, svc.DB, CheckoutPK{
+			PoolID:     pool.PoolID,
+			CheckoutID: FmtCheckoutID(input.WorkerID, input.AllocID),
+		})
+		if err == ErrCheckoutNotExists {
+			return encodeOutput(w, &client.RemoveCheckoutOutput{}) //nothing was reserved, or the reservation expired
+		} else if err != nil {
+			return errors.Wrap(err, "failed to delete checkout")
+		}
+
+		err = ReleaseWorkerDisk(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: co.WorkerID}, co.Size)
+		if err != nil {
+			return errors.Wrap(err, "failed to release disk space")
+		}
+
+		return encodeOutput(w, &client.RemoveCheckoutOutput{})
+	}))
+
+	//
+	// RemoveReplica
+	//
+	r.Post("/RemoveReplica", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.RemoveReplicaInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		worker, err := GetWorker(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: input.WorkerID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get worker")
+		}
+
+		if err = DeleteReplica(conf, svc.DB, ReplicaPK{
+			PoolID:    pool.PoolID,
+			ReplicaID: FmtReplicaID(input.DatasetID, worker.WorkerID),
+		}); err != nil {
+			return errors.Wrap(err, "failed to delete replica")
+		}
+
+		//the replica is gone so an eviction that was asked for is done
+		for _, datasetID := range worker.Evict {
+			if datasetID != input.DatasetID {
+				continue
+			}
+
+			if err = UpdateWorkerEvictions(conf, svc.DB, worker.WorkerPK, false, []string{datasetID}); err != nil {
+				return errors.Wrap(err, "failed to remove eviction")
+			}
+		}
+
+		return encodeOutput(w, &client.RemoveReplicaOutput{})
+	}))
+
+	//
+	// ListReplicas
+	//
+	r.Post("/ListReplicas", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.ListReplicasInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		replicas, err := ListReplicas(conf, svc.DB, pool.PoolID, input.DatasetID)
+		if err != nil {
+			return errors.Wrap(err, "failed to list replicas")
+		}
+
+		//group replicas per dataset and flag the ones that have all their replicas in a single zone
+		output := &client.ListReplicasOutput{}
+		sets := map[string]*client.DatasetReplicas{}
+		for _, replica := range replicas {
+			set, ok := sets[replica.DatasetID]
+			if !ok {
+				set = &client.DatasetReplicas{DatasetID: replica.DatasetID}
+				sets[replica.DatasetID] = set
+				output.Datasets = append(output.Datasets, set)
+			}
+
+			set.Replicas = append(set.Replicas, &client.ReplicaInfo{
+				WorkerID: replica.WorkerID,
+				Zone:     replica.Zone,
+				Head:     replica.Head,
+				Refs:     replica.Refs,
+			})
+
+			if replica.Zone != "" && !contains(set.Zones, replica.Zone) {
+				set.Zones = append(set.Zones, replica.Zone)
 			}
 		}
 
-		return encodeOutput(w, &client.SendHeartbeatOutput{})
+		for _, set := range output.Datasets {
+			set.SingleZone = len(set.Zones) == 1
+		}
+
+		return encodeOutput(w, output)
 	}))
 
 	//
@@ -234,26 +558,32 @@ func Mux(conf *Conf, svc *Services) http.Handler {
 			return errors.Wrap(err, "failed to get active pool")
 		}
 
-		msg, err := json.Marshal(&Eval{Size: input.Size, Dataset: input.DatasetID})
+		eval, err := NewEval(input)
 		if err != nil {
-			return errors.Wrap(err, "failed to encode scheduling message")
+			return errors.Wrap(err, "invalid eval")
 		}
 
-		if _, err := svc.SQS.SendMessage(&sqs.SendMessageInput{
-			QueueUrl:    aws.String(pool.QueueURL),
-			MessageBody: aws.String(string(msg)),
-		}); err != nil {
-			return errors.Wrap(err, "failed to send message")
+		err = CheckDatasets(conf, svc.DB, pool.PoolID, eval)
+		if err != nil {
+			return errors.Wrap(err, "invalid dataset reference")
+		}
+
+		rec, err := SubmitEval(conf, svc, pool, eval)
+		if err != nil {
+			return errors.Wrap(err, "failed to submit eval")
 		}
 
-		return encodeOutput(w, &client.ScheduleEvalOutput{})
+		return encodeOutput(w, &client.ScheduleEvalOutput{
+			EvalID: rec.EvalID,
+			State:  rec.State,
+		})
 	}))
 
 	//
-	// CompleteAlloc
+	// GetReplicaPeers
 	//
-	r.Post("/CompleteAlloc", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
-		input := &client.CompleteAllocInput{}
+	r.Post("/GetReplicaPeers", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.GetReplicaPeersInput{}
 		err = decodeInput(r.Body, input)
 		if err != nil {
 			return err
@@ -264,55 +594,986 @@ func Mux(conf *Conf, svc *Services) http.Handler {
 			return errors.Wrap(err, "failed to get active pool")
 		}
 
-		alloc, err := GetAlloc(conf, svc.DB, AllocPK{
-			PoolID:  pool.PoolID,
-			AllocID: input.AllocID,
-		})
+		output := &client.GetReplicaPeersOutput{}
+		set, err := GetDataset(conf, svc.DB, DatasetPK{PoolID: pool.PoolID, DatasetID: input.DatasetID})
+		if err == nil {
+			output.Remote = set.Remote
+		} else if err != ErrDatasetNotExists {
+			return errors.Wrap(err, "failed to get dataset")
+		}
+
+		//the zone of the asking worker determines which peers are near
+		var zone string
+		if input.WorkerID != "" {
+			asking, err := GetWorker(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: input.WorkerID})
+			if err != nil && err != ErrWorkerNotExists {
+				return errors.Wrap(err, "failed to get asking worker")
+			}
+
+			if asking != nil {
+				zone = asking.Zone
+			}
+		}
+
+		replicas, err := ListReplicas(conf, svc.DB, pool.PoolID, input.DatasetID)
 		if err != nil {
-			return errors.Wrap(err, "failed to get alloc")
+			return errors.Wrap(err, "failed to list replicas")
 		}
 
-		//@TODO send the output/exit code somewhere?
-		//@TODO send releases on a queue(?)
-		//@TODO resend to scheduling queue on failure
-		//@TODO support for workflows, i.e auto-schedule new task?
+		now := time.Now().Unix()
+		for _, replica := range replicas {
+			if replica.WorkerID == input.WorkerID {
+				continue
+			}
+
+			peer, err := GetWorker(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: replica.WorkerID})
+			if err == ErrWorkerNotExists {
+				continue
+			} else if err != nil {
+				return errors.Wrap(err, "failed to get peer worker")
+			}
+
+			if peer.Endpoint == "" || peer.TTL < now {
+				continue //peer doesn't serve replicas or is gone
+			}
+
+			output.Peers = append(output.Peers, &client.Peer{
+				WorkerID:   peer.WorkerID,
+				Zone:       peer.Zone,
+				URL:        FmtReplicaURL(peer.Endpoint, replica.DatasetID),
+				HasVersion: input.Version == "" || replica.Has(input.Version),
+			})
+		}
+
+		//peers with the version come first, then peers in the same zone
+		sort.SliceStable(output.Peers, func(i, j int) bool {
+			pi, pj := output.Peers[i], output.Peers[j]
+			if pi.HasVersion != pj.HasVersion {
+				return pi.HasVersion
+			}
+
+			return zone != "" && pi.Zone == zone && pj.Zone != zone
+		})
+
+		return encodeOutput(w, output)
+	}))
 
-		err = releaseAlloc(conf, svc, alloc)
+	//
+	// GetEval
+	//
+	r.Post("/GetEval", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.GetEvalInput{}
+		err = decodeInput(r.Body, input)
 		if err != nil {
-			return errors.Wrap(err, "failed to release alloc")
+			return err
 		}
 
-		return encodeOutput(w, &client.CompleteAllocOutput{})
+		rec, err := GetEval(conf, svc.DB, EvalPK{PoolID: input.PoolID, EvalID: input.EvalID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get eval")
+		}
+
+		output := &client.GetEvalOutput{
+			EvalID:  rec.EvalID,
+			State:   rec.State,
+			Reason:  rec.Reason,
+			AllocID: rec.AllocID,
+		}
+
+		if rec.Eval != nil {
+			output.NotBefore = rec.Eval.NotBefore
+			output.Deadline = rec.Eval.Deadline
+			output.ParentEvalID = rec.Eval.ParentID
+			output.Count = rec.Eval.Count
+			output.Counts = rec.Counts
+		}
+
+		return encodeOutput(w, output)
 	}))
 
-	r.NotFound(notFoundHandler)
-	r.MethodNotAllowed(methodNotAllowedHandler)
-	return r
-}
+	//
+	// CreateSchedule
+	//
+	r.Post("/CreateSchedule", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.CreateScheduleInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
 
-func decodeInput(r io.Reader, in interface{}) (err error) {
-	dec := json.NewDecoder(r)
-	err = dec.Decode(in)
-	if err != nil {
-		return errors.Wrap(err, "failed to decode input")
-	}
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
 
-	return nil
-}
+		expr, err := ParseCron(input.Cron)
+		if err != nil {
+			return errors.Wrap(err, "invalid cron expression")
+		}
 
-func encodeOutput(w io.Writer, out interface{}) (err error) {
-	enc := json.NewEncoder(w)
-	err = enc.Encode(out)
-	if err != nil {
-		return errors.Wrap(err, "failed to encode output")
-	}
-	return nil
-}
+		next := expr.Next(time.Now())
+		if next.IsZero() {
+			return invalidInput("cron expression '%s' never matches", input.Cron)
+		}
+
+		if !ValidOverlap(input.Overlap) {
+			return errors.Errorf("unknown overlap policy '%s'", input.Overlap)
+		}
+
+		if input.Template == nil {
+			return errors.New("schedule requires an eval template")
+		}
+
+		tmpl, err := NewEval(input.Template)
+		if err != nil {
+			return errors.Wrap(err, "invalid eval template")
+		}
+
+		err = CheckDatasets(conf, svc.DB, pool.PoolID, tmpl)
+		if err != nil {
+			return errors.Wrap(err, "invalid dataset reference")
+		}
+
+		tmpl.EvalID = "" //each run gets its own id
+		tmpl.NotBefore = 0
+		tmpl.Deadline = 0
+
+		idb := make([]byte, 10)
+		_, err = rand.Read(idb)
+		if err != nil {
+			return errors.Wrap(err, "failed to generate random id bytes")
+		}
+
+		sched := &EvalSchedule{
+			EvalSchedulePK: EvalSchedulePK{
+				PoolID:     pool.PoolID,
+				ScheduleID: hex.EncodeToString(idb),
+			},
+			Cron:     input.Cron,
+			Overlap:  input.Overlap,
+			Template: tmpl,
+			NextRun:  next.Unix(),
+		}
+
+		err = PutNewSchedule(conf, svc.DB, sched)
+		if err != nil {
+			return errors.Wrap(err, "failed to put schedule")
+		}
+
+		return encodeOutput(w, &client.CreateScheduleOutput{
+			ScheduleID: sched.ScheduleID,
+			NextRun:    sched.NextRun,
+		})
+	}))
+
+	//
+	// ListSchedules
+	//
+	r.Post("/ListSchedules", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.ListSchedulesInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		scheds, err := ListSchedules(conf, svc.DB, input.PoolID)
+		if err != nil {
+			return errors.Wrap(err, "failed to list schedules")
+		}
+
+		output := &client.ListSchedulesOutput{}
+		for _, sched := range scheds {
+			output.Schedules = append(output.Schedules, &client.ScheduleInfo{
+				ScheduleID: sched.ScheduleID,
+				Cron:       sched.Cron,
+				Overlap:    sched.Overlap,
+				Paused:     sched.Paused,
+				NextRun:    sched.NextRun,
+				LastEvalID: sched.LastEvalID,
+			})
+		}
+
+		return encodeOutput(w, output)
+	}))
+
+	//
+	// PauseSchedule
+	//
+	r.Post("/PauseSchedule", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.PauseScheduleInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		if err = UpdateSchedulePaused(conf, svc.DB, true, EvalSchedulePK{
+			PoolID:     input.PoolID,
+			ScheduleID: input.ScheduleID,
+		}); err != nil {
+			return errors.Wrap(err, "failed to pause schedule")
+		}
+
+		return encodeOutput(w, &client.PauseScheduleOutput{})
+	}))
+
+	//
+	// ResumeSchedule
+	//
+	r.Post("/ResumeSchedule", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.ResumeScheduleInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		if err = UpdateSchedulePaused(conf, svc.DB, false, EvalSchedulePK{
+			PoolID:     input.PoolID,
+			ScheduleID: input.ScheduleID,
+		}); err != nil {
+			return errors.Wrap(err, "failed to resume schedule")
+		}
+
+		return encodeOutput(w, &client.ResumeScheduleOutput{})
+	}))
+
+	//
+	// DeleteSchedule
+	//
+	r.Post("/DeleteSchedule", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.DeleteScheduleInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		if err = DeleteSchedule(conf, svc.DB, EvalSchedulePK{
+			PoolID:     input.PoolID,
+			ScheduleID: input.ScheduleID,
+		}); err != nil {
+			return errors.Wrap(err, "failed to delete schedule")
+		}
+
+		return encodeOutput(w, &client.DeleteScheduleOutput{})
+	}))
+
+	//
+	// CreateDataset
+	//
+	r.Post("/CreateDataset", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.CreateDatasetInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		if !DatasetNameExp.MatchString(input.Name) {
+			return errors.Errorf("invalid dataset name '%s', expected it to match %s", input.Name, DatasetNameExp)
+		}
+
+		if input.Replicas < 0 {
+			return errors.Errorf("replicas can't be negative, got %d", input.Replicas)
+		}
+
+		if err = CheckRemote(input.Remote); err != nil {
+			return err
+		}
+
+		set := &Dataset{
+			DatasetPK: DatasetPK{PoolID: pool.PoolID, DatasetID: input.Name},
+			Remote:    input.Remote,
+			Created:   time.Now().Unix(),
+			Replicas:  input.Replicas,
+		}
+
+		if input.Retention != nil {
+			if input.Retention.KeepVersions < 0 {
+				return errors.Errorf("versions to keep can't be negative, got %d", input.Retention.KeepVersions)
+			}
+
+			set.Pinned, set.Keep = input.Retention.Pinned, input.Retention.KeepVersions
+		}
+
+		err = PutNewDataset(conf, svc.DB, set)
+		if err != nil {
+			return errors.Wrap(err, "failed to put dataset")
+		}
+
+		return encodeOutput(w, &client.CreateDatasetOutput{DatasetID: set.DatasetID})
+	}))
+
+	//
+	// GetDataset
+	//
+	r.Post("/GetDataset", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.GetDatasetInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		set, err := GetDataset(conf, svc.DB, DatasetPK{PoolID: input.PoolID, DatasetID: input.DatasetID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get dataset")
+		}
+
+		return encodeOutput(w, &client.GetDatasetOutput{
+			DatasetID: set.DatasetID,
+			Remote:    set.Remote,
+			CreatedAt: set.Created,
+			Replicas:  set.Replicas,
+			Retention: set.Retention(),
+		})
+	}))
+
+	//
+	// UpdateDataset
+	//
+	r.Post("/UpdateDataset", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.UpdateDatasetInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		if input.Replicas < 0 {
+			return errors.Errorf("replicas can't be negative, got %d", input.Replicas)
+		}
+
+		if input.Retention != nil && input.Retention.KeepVersions < 0 {
+			return errors.Errorf("versions to keep can't be negative, got %d", input.Retention.KeepVersions)
+		}
+
+		pk := DatasetPK{PoolID: input.PoolID, DatasetID: input.DatasetID}
+		if err = UpdateDatasetReplicas(conf, svc.DB, pk, input.Replicas); err != nil {
+			return errors.Wrap(err, "failed to update dataset")
+		}
+
+		if input.Retention != nil {
+			if err = UpdateDatasetRetention(conf, svc.DB, pk, input.Retention.Pinned, input.Retention.KeepVersions); err != nil {
+				return errors.Wrap(err, "failed to update dataset retention")
+			}
+		}
+
+		return encodeOutput(w, &client.UpdateDatasetOutput{})
+	}))
+
+	//
+	// ListDatasetVersions
+	//
+	r.Post("/ListDatasetVersions", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.ListDatasetVersionsInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pk := DatasetPK{PoolID: input.PoolID, DatasetID: input.DatasetID}
+		if _, err = GetDataset(conf, svc.DB, pk); err != nil {
+			return errors.Wrap(err, "failed to get dataset")
+		}
+
+		vers, err := ListVersions(conf, svc.DB, pk)
+		if err != nil {
+			return errors.Wrap(err, "failed to list versions")
+		}
+
+		output := &client.ListDatasetVersionsOutput{}
+		for _, ver := range vers {
+			output.Versions = append(output.Versions, &client.VersionInfo{
+				Version:   ver.Commit,
+				Parent:    ver.Parent,
+				Branch:    ver.Branch,
+				Size:      ver.Size,
+				AllocID:   ver.AllocID,
+				CreatedAt: ver.Created,
+			})
+		}
+
+		return encodeOutput(w, output)
+	}))
+
+	//
+	// GetLineage
+	//
+	r.Post("/GetLineage", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.GetLineageInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		if input.DatasetID == "" || input.Version == "" {
+			return errors.New("lineage requires both a dataset id and a version")
+		}
+
+		if input.Direction != "" && input.Direction != client.LineageUpstream && input.Direction != client.LineageDownstream {
+			return errors.Errorf("unknown lineage direction '%s'", input.Direction)
+		}
+
+		if input.Format != "" && input.Format != client.LineageFormatJSON && input.Format != client.LineageFormatDOT {
+			return errors.Errorf("unknown lineage format '%s'", input.Format)
+		}
+
+		steps, err := WalkLineage(conf, svc.DB, pool.PoolID, input.DatasetID, input.Version, input.Direction == client.LineageDownstream, input.Depth)
+		if err != nil {
+			return errors.Wrap(err, "failed to walk lineage")
+		}
+
+		output := &client.GetLineageOutput{}
+		if input.Format == client.LineageFormatDOT {
+			output.DOT = LineageDOT(steps)
+			return encodeOutput(w, output)
+		}
+
+		for _, step := range steps {
+			output.Steps = append(output.Steps, &client.LineageStep{
+				AllocID:   step.AllocID,
+				EvalID:    step.EvalID,
+				Image:     step.Image,
+				Inputs:    DatasetVersions(step.Inputs),
+				Outputs:   DatasetVersions(step.Outputs),
+				CreatedAt: step.TS,
+			})
+		}
+
+		return encodeOutput(w, output)
+	}))
+
+	//
+	// CreateTrigger
+	//
+	r.Post("/CreateTrigger", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.CreateTriggerInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		if _, err = GetDataset(conf, svc.DB, DatasetPK{PoolID: pool.PoolID, DatasetID: input.DatasetID}); err != nil {
+			return errors.Wrapf(err, "failed to get dataset '%s'", input.DatasetID)
+		}
+
+		if input.Template == nil {
+			return errors.New("trigger requires an eval template")
+		}
+
+		tmpl, err := NewEval(input.Template)
+		if err != nil {
+			return errors.Wrap(err, "invalid eval template")
+		}
+
+		err = CheckDatasets(conf, svc.DB, pool.PoolID, tmpl)
+		if err != nil {
+			return errors.Wrap(err, "invalid dataset reference")
+		}
+
+		tmpl.EvalID = "" //each version gets its own eval
+		tmpl.NotBefore = 0
+		tmpl.Deadline = 0
+
+		idb := make([]byte, 10)
+		_, err = rand.Read(idb)
+		if err != nil {
+			return errors.Wrap(err, "failed to generate random id bytes")
+		}
+
+		trig := &Trigger{
+			TriggerPK: TriggerPK{
+				PoolID:    pool.PoolID,
+				TriggerID: FmtTriggerID(input.DatasetID, hex.EncodeToString(idb)),
+			},
+			DatasetID: input.DatasetID,
+			Branch:    input.Branch,
+			Template:  tmpl,
+		}
+
+		err = PutNewTrigger(conf, svc.DB, trig)
+		if err != nil {
+			return errors.Wrap(err, "failed to put trigger")
+		}
+
+		return encodeOutput(w, &client.CreateTriggerOutput{TriggerID: trig.TriggerID})
+	}))
+
+	//
+	// ListTriggers
+	//
+	r.Post("/ListTriggers", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.ListTriggersInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		trigs, err := ListTriggers(conf, svc.DB, input.PoolID, input.DatasetID)
+		if err != nil {
+			return errors.Wrap(err, "failed to list triggers")
+		}
+
+		output := &client.ListTriggersOutput{}
+		for _, trig := range trigs {
+			output.Triggers = append(output.Triggers, &client.TriggerInfo{
+				TriggerID: trig.TriggerID,
+				DatasetID: trig.DatasetID,
+				Branch:    trig.Branch,
+			})
+		}
+
+		return encodeOutput(w, output)
+	}))
+
+	//
+	// DeleteTrigger
+	//
+	r.Post("/DeleteTrigger", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.DeleteTriggerInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		if err = DeleteTrigger(conf, svc.DB, TriggerPK{
+			PoolID:    input.PoolID,
+			TriggerID: input.TriggerID,
+		}); err != nil {
+			return errors.Wrap(err, "failed to delete trigger")
+		}
+
+		return encodeOutput(w, &client.DeleteTriggerOutput{})
+	}))
+
+	//
+	// CreateWorkflow
+	//
+	r.Post("/CreateWorkflow", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.CreateWorkflowInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		nodes, err := NewWorkflowNodes(input.Nodes)
+		if err != nil {
+			return errors.Wrap(err, "invalid workflow")
+		}
+
+		for _, node := range nodes {
+			if err = CheckDatasets(conf, svc.DB, pool.PoolID, node.Template); err != nil {
+				return errors.Wrapf(err, "invalid dataset reference in node '%s'", node.Name)
+			}
+		}
+
+		idb := make([]byte, 10)
+		_, err = rand.Read(idb)
+		if err != nil {
+			return errors.Wrap(err, "failed to generate random id bytes")
+		}
+
+		wf := &Workflow{
+			WorkflowPK: WorkflowPK{PoolID: pool.PoolID, WorkflowID: hex.EncodeToString(idb)},
+			Nodes:      nodes,
+		}
+
+		err = PutNewWorkflow(conf, svc.DB, wf)
+		if err != nil {
+			return errors.Wrap(err, "failed to put workflow")
+		}
+
+		return encodeOutput(w, &client.CreateWorkflowOutput{WorkflowID: wf.WorkflowID})
+	}))
+
+	//
+	// StartWorkflow
+	//
+	r.Post("/StartWorkflow", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.StartWorkflowInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		wf, err := GetWorkflow(conf, svc.DB, WorkflowPK{PoolID: pool.PoolID, WorkflowID: input.WorkflowID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get workflow")
+		}
+
+		inputs, err := NewDatasetRefs(input.Inputs)
+		if err != nil {
+			return errors.Wrap(err, "invalid inputs")
+		}
+
+		err = CheckDatasets(conf, svc.DB, pool.PoolID, &Eval{Inputs: inputs})
+		if err != nil {
+			return errors.Wrap(err, "invalid dataset reference")
+		}
+
+		run, err := StartWorkflowRun(conf, svc, pool, wf, inputs)
+		if err != nil {
+			return errors.Wrap(err, "failed to start workflow run")
+		}
+
+		return encodeOutput(w, &client.StartWorkflowOutput{RunID: run.RunID})
+	}))
+
+	//
+	// GetWorkflowRun
+	//
+	r.Post("/GetWorkflowRun", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.GetWorkflowRunInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		run, err := GetWorkflowRun(conf, svc.DB, WorkflowRunPK{PoolID: input.PoolID, RunID: input.RunID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get workflow run")
+		}
+
+		wf, err := GetWorkflow(conf, svc.DB, WorkflowPK{PoolID: run.PoolID, WorkflowID: run.WorkflowID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get workflow")
+		}
+
+		output := &client.GetWorkflowRunOutput{
+			RunID:      run.RunID,
+			WorkflowID: run.WorkflowID,
+			State:      run.State,
+		}
+
+		//nodes are reported in the order they were defined in
+		for _, node := range wf.Nodes {
+			nr, ok := run.Nodes[node.Name]
+			if !ok {
+				continue
+			}
+
+			output.Nodes = append(output.Nodes, &client.WorkflowNodeStatus{
+				Name:     node.Name,
+				State:    nr.State,
+				EvalID:   nr.EvalID,
+				Attempts: nr.Attempts,
+				Outputs:  DatasetVersions(nr.Outputs),
+			})
+		}
+
+		return encodeOutput(w, output)
+	}))
+
+	//
+	// CompleteAlloc
+	//
+	r.Post("/CompleteAlloc", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.CompleteAllocInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		alloc, err := GetAlloc(conf, svc.DB, AllocPK{
+			PoolID:  pool.PoolID,
+			AllocID: input.AllocID,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to get alloc")
+		}
+
+		switch input.Outcome {
+		case "", client.AllocOutcomeSucceeded, client.AllocOutcomeFailed:
+		case client.AllocOutcomeLost:
+			//the worker gave up on the alloc, e.g. because it shuts down. Its eval is scheduled again as if the alloc expired. A retry after the eval was rescheduled but the alloc wasn't released yet finds the eval no longer allocated to the alloc and doesn't schedule it twice
+			if alloc.Eval != nil {
+				rec, err := GetEval(conf, svc.DB, EvalPK{PoolID: pool.PoolID, EvalID: alloc.Eval.EvalID})
+				if err != nil && err != ErrEvalNotExists {
+					return errors.Wrap(err, "failed to get eval")
+				}
+
+				if rec != nil && rec.State == client.EvalStateAllocated && rec.AllocID == alloc.AllocID {
+					if err = rescheduleAlloc(conf, svc, pool, alloc, "alloc lost"); err != nil {
+						return errors.Wrap(err, "failed to reschedule alloc")
+					}
+				}
+			}
+
+			if err = releaseAlloc(conf, svc, alloc); err != nil {
+				return errors.Wrap(err, "failed to release alloc")
+			}
+
+			return encodeOutput(w, &client.CompleteAllocOutput{})
+		default:
+			return errors.Errorf("unknown alloc outcome '%s'", input.Outcome)
+		}
+
+		//the alloc is released last: every step below can be repeated, such that a worker that retries a completion that failed halfway still finds its alloc
+		if alloc.Eval == nil {
+			if err = releaseAlloc(conf, svc, alloc); err != nil {
+				return errors.Wrap(err, "failed to release alloc")
+			}
+
+			return encodeOutput(w, &client.CompleteAllocOutput{})
+		}
+
+		succeeded := input.Outcome != client.AllocOutcomeFailed
+		state, reason := client.EvalStateCompleted, ""
+		if !succeeded {
+			state, reason = client.EvalStateFailed, fmt.Sprintf("alloc failed with exit code %d", input.ExitCode)
+		}
+
+		//a task that reports outputs it didn't declare fails, its alloc is still released below
+		outputs, err := NewDatasetRefs(input.Outputs)
+		if err == nil && alloc.Eval.Task != nil {
+			err = alloc.Eval.Task.CheckOutputs(outputs)
+		}
+
+		if err != nil {
+			succeeded, outputs = false, nil
+			state, reason = client.EvalStateFailed, fmt.Sprintf("invalid outputs: %v", err)
+		} else if alloc.Eval.Task != nil {
+			for i, out := range outputs {
+				input.Outputs[i].Branch = out.Branch
+			}
+		}
+
+		if err = UpdateEvalState(conf, svc.DB, EvalPK{
+			PoolID: alloc.PoolID,
+			EvalID: alloc.Eval.EvalID,
+		}, state, reason, alloc.AllocID); err != nil && err != ErrEvalNotExists {
+			return errors.Wrap(err, "failed to update eval state")
+		}
+
+		//evals that are part of a workflow may cause new evals to be scheduled
+		err = AdvanceWorkflowRun(conf, svc, pool, alloc.Eval, succeeded, outputs)
+		if err != nil {
+			return errors.Wrap(err, "failed to advance workflow run")
+		}
+
+		//a finished replication is counted right away, such that the next release round doesn't schedule another one before the worker reports it
+		if succeeded && alloc.Eval.Replicate != "" {
+			worker, err := GetWorker(conf, svc.DB, WorkerPK{PoolID: pool.PoolID, WorkerID: alloc.WorkerID})
+			if err != nil {
+				return errors.Wrap(err, "failed to get worker")
+			}
+
+			if err = PutReplica(conf, svc.DB, &Replica{
+				ReplicaPK: ReplicaPK{
+					PoolID:    pool.PoolID,
+					ReplicaID: FmtReplicaID(alloc.Eval.Replicate, worker.WorkerID),
+				},
+				TTL:       time.Now().Unix() + conf.ReplicaTTL,
+				DatasetID: alloc.Eval.Replicate,
+				WorkerID:  worker.WorkerID,
+				Zone:      worker.Zone,
+			}); err != nil {
+				return errors.Wrap(err, "failed to put replica")
+			}
+		}
+
+		//output versions may fire triggers, regardless of the workflow they were produced in
+		if succeeded {
+			err = RecordVersions(conf, svc.DB, pool.PoolID, input.Outputs, alloc.AllocID)
+			if err != nil {
+				return errors.Wrap(err, "failed to record versions")
+			}
+
+			err = RecordLineage(conf, svc.DB, alloc, outputs)
+			if err != nil {
+				return errors.Wrap(err, "failed to record lineage")
+			}
+
+			err = FireTriggers(conf, svc, pool, outputs)
+			if err != nil {
+				return errors.Wrap(err, "failed to fire triggers")
+			}
+		}
+
+		//@TODO send releases on a queue(?)
+		if err = releaseAlloc(conf, svc, alloc); err != nil {
+			return errors.Wrap(err, "failed to release alloc")
+		}
+
+		return encodeOutput(w, &client.CompleteAllocOutput{})
+	}))
+
+	//
+	// PutAllocLogs
+	//
+	r.Post("/PutAllocLogs", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.PutAllocLogsInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		alloc, err := GetAlloc(conf, svc.DB, AllocPK{PoolID: pool.PoolID, AllocID: input.AllocID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get alloc")
+		}
+
+		if alloc.WorkerID != input.WorkerID {
+			return errors.Errorf("alloc '%s' doesn't run on worker '%s'", alloc.AllocID, input.WorkerID)
+		}
+
+		size := 0
+		for i, line := range input.Lines {
+			if i > 0 && line.T < input.Lines[i-1].T {
+				return errors.New("log lines must be in the order they were written")
+			}
+
+			size += len(line.Line)
+		}
+
+		if size > MaxLogChunkBytes {
+			return errors.Errorf("log chunk of %d bytes is larger than the maximum of %d", size, MaxLogChunkBytes)
+		}
+
+		err = logs.PutLogs(pool.PoolID, input.WorkerID, alloc.AllocID, input.Lines)
+		if err != nil {
+			return errors.Wrap(err, "failed to put logs")
+		}
+
+		return encodeOutput(w, &client.PutAllocLogsOutput{})
+	}))
+
+	//
+	// GetAllocLogs
+	//
+	r.Post("/GetAllocLogs", errh(func(w http.ResponseWriter, r *http.Request) (err error) {
+		input := &client.GetAllocLogsInput{}
+		err = decodeInput(r.Body, input)
+		if err != nil {
+			return err
+		}
+
+		pool, err := GetActivePool(conf, svc.DB, PoolPK{input.PoolID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get active pool")
+		}
+
+		if input.AllocID == "" {
+			return errors.New("alloc id is required")
+		}
+
+		if input.Wait > MaxLogWait {
+			input.Wait = MaxLogWait
+		}
+
+		var after *LogPos
+		if input.After != "" {
+			if after, err = ParseLogPos(input.AllocID, input.After); err != nil {
+				return err
+			}
+		}
+
+		//following waits for new lines until the alloc finished, lines are looked for once more after it finished as they are uploaded before it completes
+		output := &client.GetAllocLogsOutput{}
+		deadline := time.Now().Add(time.Duration(input.Wait) * time.Second)
+		for {
+			_, err = GetAlloc(conf, svc.DB, AllocPK{PoolID: pool.PoolID, AllocID: input.AllocID})
+			if err != nil && err != ErrAllocNotExists {
+				return errors.Wrap(err, "failed to get alloc")
+			}
+
+			finished := err == ErrAllocNotExists
+			var last *LogPos
+			if after == nil && input.Since == 0 && input.Tail > 0 {
+				output.Lines, last, err = logs.TailLogs(pool.PoolID, input.AllocID, minInt(input.Tail, MaxLogLines))
+			} else {
+				output.Lines, last, err = logs.GetLogs(pool.PoolID, input.AllocID, after, input.Since, MaxLogLines)
+			}
+
+			if err != nil {
+				return errors.Wrap(err, "failed to get logs")
+			}
+
+			if last != nil {
+				output.Next = last.String()
+			}
+
+			output.Done = finished && len(output.Lines) < MaxLogLines
+			if len(output.Lines) > 0 || finished || !time.Now().Add(LogPollInterval).Before(deadline) {
+				return encodeOutput(w, output)
+			}
+
+			time.Sleep(LogPollInterval)
+		}
+	}))
+
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
+	return r
+}
+
+func decodeInput(r io.Reader, in interface{}) (err error) {
+	dec := json.NewDecoder(r)
+	err = dec.Decode(in)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode input")
+	}
+
+	return nil
+}
+
+func encodeOutput(w io.Writer, out interface{}) (err error) {
+	enc := json.NewEncoder(w)
+	err = enc.Encode(out)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode output")
+	}
+	return nil
+}
+
+//inputError is an error that is caused by the input of a request rather than by the server
+type inputError struct{ error }
+
+//invalidInput formats an error that is reported with a bad request status
+func invalidInput(format string, args ...interface{}) error {
+	return inputError{errors.Errorf(format, args...)}
+}
 
 func errh(fn func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := fn(w, r); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			if _, ok := errors.Cause(err).(inputError); ok {
+				w.WriteHeader(http.StatusBadRequest)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+
 			enc := json.NewEncoder(w)
 			err = enc.Encode(struct {
 				Message string `json:"message"`
@@ -1,9 +1,12 @@
 package line
 
 import (
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/microfactory/line/line/client"
 	"github.com/pkg/errors"
 )
 
@@ -16,7 +19,42 @@ type ReplicaPK struct {
 //Replica represents the clone of a dataset available on a certain worker
 type Replica struct {
 	ReplicaPK
-	TTL int64 `dynamodbav:"ttl"`
+	TTL       int64             `dynamodbav:"ttl"`
+	DatasetID string            `dynamodbav:"set"`
+	WorkerID  string            `dynamodbav:"wrk"`
+	Zone      string            `dynamodbav:"zone,omitempty"` //zone of the worker that holds the replica
+	Head      string            `dynamodbav:"head,omitempty"` //commit that is checked out
+	Refs      map[string]string `dynamodbav:"refs,omitempty"` //branch and tag names to commits
+}
+
+//Has returns whether the replica holds a commit as its head or as one of its refs. Commits that are only reachable from refs are not known to the server
+func (replica *Replica) Has(commit string) bool {
+	if replica.Head == commit {
+		return true
+	}
+
+	for _, c := range replica.Refs {
+		if c == commit {
+			return true
+		}
+	}
+
+	return false
+}
+
+//HasAny returns whether the replica holds any of the commits
+func (replica *Replica) HasAny(commits map[string]struct{}) bool {
+	if _, ok := commits[replica.Head]; ok && replica.Head != "" {
+		return true
+	}
+
+	for _, c := range replica.Refs {
+		if _, ok := commits[c]; ok {
+			return true
+		}
+	}
+
+	return false
 }
 
 //PutReplica will put an replica with the condition the pk doesn't exist yet
@@ -36,6 +74,51 @@ func PutReplica(conf *Conf, db DB, replica *Replica) (err error) {
 	return nil
 }
 
+//SwapReplica puts a replica and returns the one it replaced, or nil if there was none
+func SwapReplica(conf *Conf, db DB, replica *Replica) (old *Replica, err error) {
+	item, err := dynamodbattribute.MarshalMap(replica)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal item map")
+	}
+
+	var out *dynamodb.PutItemOutput
+	if out, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:    aws.String(conf.ReplicasTableName),
+		Item:         item,
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to put item")
+	}
+
+	if len(out.Attributes) < 1 {
+		return nil, nil
+	}
+
+	old = &Replica{}
+	if err = dynamodbattribute.UnmarshalMap(out.Attributes, old); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return old, nil
+}
+
+//ChangedVersions returns the branch heads of a dataset that moved since the replica was last reported, all heads are new if there was no replica
+func ChangedVersions(old *Replica, datasetID string, dvs []*client.DatasetVersion) (changed []*client.DatasetVersion) {
+	for _, dv := range dvs {
+		if dv.DatasetID != datasetID {
+			continue
+		}
+
+		if old != nil && dv.Branch != "" && old.Refs[dv.Branch] == dv.Version {
+			continue
+		}
+
+		changed = append(changed, dv)
+	}
+
+	return changed
+}
+
 //DeleteReplica deletes a replica by pk
 func DeleteReplica(conf *Conf, db DB, pk ReplicaPK) (err error) {
 	ipk, err := dynamodbattribute.MarshalMap(pk)
@@ -52,3 +135,85 @@ func DeleteReplica(conf *Conf, db DB, pk ReplicaPK) (err error) {
 
 	return nil
 }
+
+//ListReplicas returns all replicas in a pool that haven't expired, optionally only those of a single dataset
+func ListReplicas(conf *Conf, db DB, poolID, datasetID string) (replicas []*Replica, err error) {
+	poolattr, err := dynamodbattribute.Marshal(poolID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal pool id")
+	}
+
+	qin := &dynamodb.QueryInput{
+		TableName:              aws.String(conf.ReplicasTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":poolID": poolattr,
+		},
+	}
+
+	if datasetID != "" {
+		setattr, err := dynamodbattribute.Marshal(FmtReplicaID(datasetID, ""))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal dataset prefix")
+		}
+
+		qin.KeyConditionExpression = aws.String("#pool = :poolID AND begins_with (#rpl, :datasetID)")
+		qin.ExpressionAttributeNames["#rpl"] = aws.String("rpl")
+		qin.ExpressionAttributeValues[":datasetID"] = setattr
+	}
+
+	now := time.Now().Unix()
+	var ierr error
+	if err = db.QueryPages(qin, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			replica := &Replica{}
+			ierr = dynamodbattribute.UnmarshalMap(item, replica)
+			if ierr != nil {
+				return false
+			}
+
+			if replica.TTL < now {
+				continue //skip expired replicas
+			}
+
+			replicas = append(replicas, replica)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query replicas")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal replica")
+	}
+
+	return replicas, nil
+}
+
+//PickEvictions selects n replicas to remove, replicas in the zone that holds the most replicas go first such that the remaining replicas are spread over as many zones as possible
+func PickEvictions(replicas []*Replica, n int) (evict []*Replica) {
+	remaining := append([]*Replica{}, replicas...)
+	for ; n > 0 && len(remaining) > 0; n-- {
+		zones := map[string]int{}
+		for _, replica := range remaining {
+			zones[replica.Zone]++
+		}
+
+		pick := 0
+		for i, replica := range remaining {
+			if zones[replica.Zone] > zones[remaining[pick].Zone] ||
+				(zones[replica.Zone] == zones[remaining[pick].Zone] && replica.WorkerID < remaining[pick].WorkerID) {
+				pick = i
+			}
+		}
+
+		evict = append(evict, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+
+	return evict
+}
@@ -0,0 +1,58 @@
+package line
+
+import (
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestPickEvictions(t *testing.T) {
+	replicas := []*Replica{
+		{WorkerID: "w1", Zone: "a"},
+		{WorkerID: "w2", Zone: "a"},
+		{WorkerID: "w3", Zone: "a"},
+		{WorkerID: "w4", Zone: "b"},
+		{WorkerID: "w5", Zone: "c"},
+	}
+
+	evict := PickEvictions(replicas, 2)
+	if len(evict) != 2 || evict[0].WorkerID != "w1" || evict[1].WorkerID != "w2" {
+		t.Fatalf("expected w1 and w2 to be evicted from the crowded zone, got %+v", evict)
+	}
+
+	if len(replicas) != 5 {
+		t.Fatal("expected input not to be modified")
+	}
+
+	if evict = PickEvictions(replicas, 10); len(evict) != 5 {
+		t.Fatalf("expected at most all replicas to be evicted, got %d", len(evict))
+	}
+}
+
+func TestReplicaHas(t *testing.T) {
+	replica := &Replica{Head: "c3", Refs: map[string]string{"master": "c2"}}
+	if !replica.Has("c3") || !replica.Has("c2") || replica.Has("c1") {
+		t.Error("expected replica to hold its head and refs only")
+	}
+
+	if !replica.HasAny(map[string]struct{}{"c1": {}, "c2": {}}) || replica.HasAny(map[string]struct{}{"c1": {}}) {
+		t.Error("expected replica to hold any of its head and refs only")
+	}
+}
+
+func TestChangedVersions(t *testing.T) {
+	dvs := []*client.DatasetVersion{
+		{DatasetID: "d1", Branch: "master", Version: "c2"},
+		{DatasetID: "d1", Branch: "dev", Version: "c3"},
+		{DatasetID: "d2", Branch: "master", Version: "c9"},
+	}
+
+	if changed := ChangedVersions(nil, "d1", dvs); len(changed) != 2 {
+		t.Errorf("expected all heads of a new replica to be changed, got %+v", changed)
+	}
+
+	old := &Replica{Refs: map[string]string{"master": "c2", "dev": "c1"}}
+	if changed := ChangedVersions(old, "d1", dvs); len(changed) != 1 || changed[0].Branch != "dev" {
+		t.Errorf("expected only the head that moved, got %+v", changed)
+	}
+}
@@ -0,0 +1,232 @@
+package line
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//EvalSchedulePK describes the schedule's primary key in the base table
+type EvalSchedulePK struct {
+	PoolID     string `dynamodbav:"pool"`
+	ScheduleID string `dynamodbav:"sched"`
+}
+
+//EvalSchedule periodically submits evals to a pool based on a cron expression
+type EvalSchedule struct {
+	EvalSchedulePK
+	Cron       string `dynamodbav:"cron"`
+	Overlap    string `dynamodbav:"ovl"`
+	Paused     bool   `dynamodbav:"paused"`
+	Template   *Eval  `dynamodbav:"tmpl"`
+	NextRun    int64  `dynamodbav:"next"`
+	LastEvalID string `dynamodbav:"last,omitempty"`
+}
+
+var (
+	//ErrScheduleExists means a schedule exists while it was expected not to
+	ErrScheduleExists = errors.New("schedule already exists")
+
+	//ErrScheduleNotExists means a schedule was not found while expecting it to exist
+	ErrScheduleNotExists = errors.New("schedule doesn't exist")
+
+	//ErrScheduleAdvanced means another round already moved the schedule forward
+	ErrScheduleAdvanced = errors.New("schedule was already advanced")
+)
+
+//Instantiate creates a new eval from a template eval, it gets a new id and a fresh retry count
+func (eval *Eval) Instantiate() (inst *Eval, err error) {
+	idb := make([]byte, 10)
+	_, err = rand.Read(idb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate random id bytes")
+	}
+
+	copied := *eval
+	inst = &copied
+	inst.EvalID = hex.EncodeToString(idb)
+	inst.Retry = 0
+	return inst, nil
+}
+
+//ValidOverlap returns whether the overlap policy is known, empty defaults to skipping
+func ValidOverlap(overlap string) bool {
+	switch overlap {
+	case "", client.OverlapSkip, client.OverlapAllow, client.OverlapReplace:
+		return true
+	default:
+		return false
+	}
+}
+
+//PutNewSchedule will put a schedule with the condition the pk doesn't exist yet
+func PutNewSchedule(conf *Conf, db DB, sched *EvalSchedule) (err error) {
+	item, err := dynamodbattribute.MarshalMap(sched)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.SchedulesTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#sched)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#sched": aws.String("sched"),
+		},
+		Item: item,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrScheduleExists
+	}
+
+	return nil
+}
+
+//ListSchedules returns all schedules of a pool
+func ListSchedules(conf *Conf, db DB, poolID string) (scheds []*EvalSchedule, err error) {
+	poolattr, err := dynamodbattribute.Marshal(poolID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal pool id")
+	}
+
+	var ierr error
+	if err = db.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(conf.SchedulesTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":poolID": poolattr,
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			sched := &EvalSchedule{}
+			ierr = dynamodbattribute.UnmarshalMap(item, sched)
+			if ierr != nil {
+				return false
+			}
+
+			scheds = append(scheds, sched)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query schedules")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal schedule")
+	}
+
+	return scheds, nil
+}
+
+//UpdateSchedulePaused pauses or resumes a schedule under the condition that it exists
+func UpdateSchedulePaused(conf *Conf, db DB, paused bool, pk EvalSchedulePK) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	pausedattr, err := dynamodbattribute.Marshal(paused)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal paused")
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.SchedulesTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String("SET #paused = :paused"),
+		ConditionExpression: aws.String("attribute_exists(#sched)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#paused": aws.String("paused"),
+			"#sched":  aws.String("sched"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":paused": pausedattr,
+		},
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrScheduleNotExists
+	}
+
+	return nil
+}
+
+//AdvanceSchedule moves the next run of a schedule forward under the condition that it wasn't advanced concurrently by another round
+func AdvanceSchedule(conf *Conf, db DB, sched *EvalSchedule, next int64, lastEvalID string) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(sched.EvalSchedulePK)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		Prev int64  `dynamodbav:":prev"`
+		Next int64  `dynamodbav:":next"`
+		Last string `dynamodbav:":last"`
+	}{sched.NextRun, next, lastEvalID})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal schedule values")
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.SchedulesTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String("SET #next = :next, #last = :last"),
+		ConditionExpression: aws.String("#next = :prev"),
+		ExpressionAttributeNames: map[string]*string{
+			"#next": aws.String("next"),
+			"#last": aws.String("last"),
+		},
+		ExpressionAttributeValues: vals,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrScheduleAdvanced
+	}
+
+	return nil
+}
+
+//DeleteSchedule deletes a schedule by pk
+func DeleteSchedule(conf *Conf, db DB, pk EvalSchedulePK) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	if _, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(conf.SchedulesTableName),
+		Key:                 ipk,
+		ConditionExpression: aws.String("attribute_exists(#sched)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#sched": aws.String("sched"),
+		},
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to delete item")
+		}
+
+		return ErrScheduleNotExists
+	}
+
+	return nil
+}
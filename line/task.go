@@ -0,0 +1,142 @@
+package line
+
+import (
+	"strings"
+
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//MaxTaskTimeout is the longest (in seconds) a task may be configured to run
+const MaxTaskTimeout = 7 * 24 * 3600
+
+//TaskOutput is a dataset that is committed to when the task finishes
+type TaskOutput struct {
+	DatasetID string `dynamodbav:"set"`
+	Branch    string `dynamodbav:"br,omitempty"`
+	Size      int64  `dynamodbav:"size,omitempty"`
+}
+
+//Task describes the container that is run for an eval, its inputs are kept on the eval as workflows and triggers add to them
+type Task struct {
+	Image    string            `dynamodbav:"img"`
+	Command  []string          `dynamodbav:"cmd,omitempty"`
+	Env      map[string]string `dynamodbav:"env,omitempty"`
+	Outputs  []*TaskOutput     `dynamodbav:"out,omitempty"`
+	MemoryMB int64             `dynamodbav:"mem,omitempty"`
+	CPUs     float64           `dynamodbav:"cpu,omitempty"`
+	Timeout  int64             `dynamodbav:"tmo,omitempty"`
+}
+
+//NewTask validates a task from client payloads and returns it together with its inputs
+func NewTask(in *client.Task) (task *Task, inputs []*DatasetRef, err error) {
+	if in.Image == "" || strings.ContainsAny(in.Image, " \t\n") {
+		return nil, nil, errors.Errorf("invalid image '%s'", in.Image)
+	}
+
+	task = &Task{
+		Image:   in.Image,
+		Command: in.Command,
+		Env:     in.Env,
+		Timeout: in.Timeout,
+	}
+
+	for k := range in.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return nil, nil, errors.Errorf("invalid environment variable name '%s'", k)
+		}
+	}
+
+	if task.Timeout < 0 || task.Timeout > MaxTaskTimeout {
+		return nil, nil, errors.Errorf("timeout must be between 0 and %d seconds, got %d", MaxTaskTimeout, task.Timeout)
+	}
+
+	if in.Limits != nil {
+		if in.Limits.MemoryMB < 0 || in.Limits.CPUs < 0 {
+			return nil, nil, errors.Errorf("resource limits can't be negative: %+v", in.Limits)
+		}
+
+		task.MemoryMB, task.CPUs = in.Limits.MemoryMB, in.Limits.CPUs
+	}
+
+	outputs := map[string]bool{}
+	for _, out := range in.Outputs {
+		if out.DatasetID == "" {
+			return nil, nil, errors.New("output without a dataset id")
+		}
+
+		if !DatasetNameExp.MatchString(out.DatasetID) {
+			return nil, nil, errors.Errorf("invalid output dataset id '%s', expected it to match %s", out.DatasetID, DatasetNameExp)
+		}
+
+		if outputs[out.DatasetID] {
+			return nil, nil, errors.Errorf("dataset '%s' is listed as output more then once", out.DatasetID)
+		}
+
+		outputs[out.DatasetID] = true
+		if out.Size < 0 {
+			return nil, nil, errors.Errorf("output '%s' can't have a negative size", out.DatasetID)
+		}
+
+		task.Outputs = append(task.Outputs, &TaskOutput{DatasetID: out.DatasetID, Branch: out.Branch, Size: out.Size})
+	}
+
+	inputs, err = NewDatasetRefs(in.Inputs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid inputs")
+	}
+
+	return task, inputs, nil
+}
+
+//TaskPayload converts the task of an eval to the client payload that is delivered to workers
+func TaskPayload(eval *Eval) *client.Task {
+	if eval.Task == nil {
+		if len(eval.Inputs) < 1 {
+			return nil
+		}
+
+		return &client.Task{Inputs: DatasetVersions(eval.Inputs)}
+	}
+
+	task := &client.Task{
+		Image:   eval.Task.Image,
+		Command: eval.Task.Command,
+		Env:     eval.Task.Env,
+		Inputs:  DatasetVersions(eval.Inputs),
+		Timeout: eval.Task.Timeout,
+	}
+
+	for _, out := range eval.Task.Outputs {
+		task.Outputs = append(task.Outputs, &client.TaskOutput{DatasetID: out.DatasetID, Branch: out.Branch, Size: out.Size})
+	}
+
+	if eval.Task.MemoryMB > 0 || eval.Task.CPUs > 0 {
+		task.Limits = &client.ResourceLimits{MemoryMB: eval.Task.MemoryMB, CPUs: eval.Task.CPUs}
+	}
+
+	return task
+}
+
+//CheckOutputs verifies that reported output versions are for datasets the task declared as output, versions without a branch get the branch of their declaration
+func (task *Task) CheckOutputs(refs []*DatasetRef) (err error) {
+	for _, ref := range refs {
+		var decl *TaskOutput
+		for _, out := range task.Outputs {
+			if out.DatasetID == ref.DatasetID {
+				decl = out
+				break
+			}
+		}
+
+		if decl == nil {
+			return errors.Errorf("dataset '%s' is not an output of the task", ref.DatasetID)
+		}
+
+		if ref.Branch == "" {
+			ref.Branch = decl.Branch
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package line
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/microfactory/line/line/client"
+)
+
+func TestNewTask(t *testing.T) {
+	for _, c := range []struct {
+		task *client.Task
+		ok   bool
+	}{
+		{&client.Task{Image: "busybox", Command: []string{"ls"}, Timeout: 60}, true},
+		{&client.Task{Image: "busybox", Inputs: []*client.DatasetVersion{{DatasetID: "a", Version: "1"}}}, true},
+		{&client.Task{}, false},
+		{&client.Task{Image: "busy box"}, false},
+		{&client.Task{Image: "busybox", Env: map[string]string{"A=B": "c"}}, false},
+		{&client.Task{Image: "busybox", Timeout: -1}, false},
+		{&client.Task{Image: "busybox", Limits: &client.ResourceLimits{MemoryMB: -1}}, false},
+		{&client.Task{Image: "busybox", Outputs: []*client.TaskOutput{{DatasetID: "a"}, {DatasetID: "a"}}}, false},
+		{&client.Task{Image: "busybox", Inputs: []*client.DatasetVersion{{DatasetID: "a"}}}, false},
+		{&client.Task{Image: "busybox", Outputs: []*client.TaskOutput{{DatasetID: "../../etc"}}}, false},
+		{&client.Task{Image: "busybox", Inputs: []*client.DatasetVersion{{DatasetID: "a/b", Version: "1"}}}, false},
+	} {
+		_, _, err := NewTask(c.task)
+		if (err == nil) != c.ok {
+			t.Errorf("task %+v: expected ok=%v, got err: %v", c.task, c.ok, err)
+		}
+	}
+}
+
+func TestTaskCheckOutputs(t *testing.T) {
+	task := &Task{Image: "busybox", Outputs: []*TaskOutput{{DatasetID: "a", Branch: "master"}}}
+	refs := []*DatasetRef{{DatasetID: "a", Version: "1"}}
+	if err := task.CheckOutputs(refs); err != nil {
+		t.Fatal(err)
+	}
+
+	if refs[0].Branch != "master" {
+		t.Errorf("expected branch of the declaration, got '%s'", refs[0].Branch)
+	}
+
+	if err := task.CheckOutputs([]*DatasetRef{{DatasetID: "b", Version: "1"}}); err == nil {
+		t.Error("expected undeclared output to fail")
+	}
+}
+
+func TestWorkerHasResources(t *testing.T) {
+	task := &Task{CPUs: 2, MemoryMB: 4096}
+	if !(&Worker{}).HasResources(task) {
+		t.Error("expected a worker that doesn't report resources to fit any task")
+	}
+
+	if w := (&Worker{CPUs: aws.Float64(4), MemoryMB: aws.Int64(4096)}); !w.HasResources(task) || !w.HasResources(nil) {
+		t.Error("expected the task to fit")
+	}
+
+	if w := (&Worker{CPUs: aws.Float64(1.5), MemoryMB: aws.Int64(8192)}); w.HasResources(task) {
+		t.Error("expected a task that asks for more cpus than the worker has to not fit")
+	}
+
+	if w := (&Worker{CPUs: aws.Float64(8), MemoryMB: aws.Int64(2048)}); w.HasResources(task) {
+		t.Error("expected a task that asks for more memory than the worker has to not fit")
+	}
+
+	if w := (&Worker{CPUs: aws.Float64(0), MemoryMB: aws.Int64(0)}); w.HasResources(task) {
+		t.Error("expected a worker that has all of its resources claimed to not fit")
+	}
+}
+
+func TestNewEvalDeprecatedInputs(t *testing.T) {
+	eval, err := NewEval(&client.ScheduleEvalInput{
+		Size:   1,
+		Inputs: []*client.DatasetVersion{{DatasetID: "b", Version: "2"}},
+		Task:   &client.Task{Image: "busybox", Inputs: []*client.DatasetVersion{{DatasetID: "a", Version: "1"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(eval.Inputs) != 2 || eval.Inputs[1].DatasetID != "b" {
+		t.Fatalf("expected inputs outside of the task to be merged with the task's, got %+v", eval.Inputs)
+	}
+
+	if TaskPayload(eval).Inputs[1].DatasetID != "b" {
+		t.Error("expected the merged inputs to be delivered with the task")
+	}
+}
+
+func TestNewEvalLimitsParameters(t *testing.T) {
+	params := make([]map[string]string, MaxArraySize)
+	for i := range params {
+		params[i] = map[string]string{"input": strings.Repeat("x", 20)}
+	}
+
+	if _, err := NewEval(&client.ScheduleEvalInput{Task: &client.Task{Image: "busybox"}, Params: params[:100]}); err != nil {
+		t.Fatalf("expected a small sweep to be accepted, got %v", err)
+	}
+
+	if _, err := NewEval(&client.ScheduleEvalInput{Task: &client.Task{Image: "busybox"}, Params: params}); err == nil {
+		t.Fatal("expected parameters that don't fit in the parent's record to be refused")
+	}
+}
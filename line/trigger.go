@@ -0,0 +1,266 @@
+package line
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/pkg/errors"
+)
+
+//TriggerPK describes the trigger's primary key in the base table
+type TriggerPK struct {
+	PoolID    string `dynamodbav:"pool"`
+	TriggerID string `dynamodbav:"trig"`
+}
+
+//Trigger submits an eval whenever a new version of a dataset appears
+type Trigger struct {
+	TriggerPK
+	DatasetID string `dynamodbav:"set"`
+	Branch    string `dynamodbav:"br,omitempty"` //empty matches versions on any branch
+	Template  *Eval  `dynamodbav:"tmpl"`
+}
+
+//FiringPK describes the firing's primary key in the base table
+type FiringPK struct {
+	PoolID   string `dynamodbav:"pool"`
+	FiringID string `dynamodbav:"fire"`
+}
+
+//Firing records that a trigger submitted an eval for a version, such that each version triggers only once
+type Firing struct {
+	FiringPK
+	EvalID string `dynamodbav:"eval"`
+}
+
+var (
+	//ErrTriggerExists means a trigger exists while it was expected not to
+	ErrTriggerExists = errors.New("trigger already exists")
+
+	//ErrTriggerNotExists means a trigger was not found while expecting it to exist
+	ErrTriggerNotExists = errors.New("trigger doesn't exist")
+
+	//ErrFiringExists means the trigger already fired for a version
+	ErrFiringExists = errors.New("trigger already fired")
+)
+
+//FmtTriggerID formats the trigger id such that the triggers of a dataset can be queried by prefix
+func FmtTriggerID(datasetID, id string) string {
+	return fmt.Sprintf("%s:%s", datasetID, id)
+}
+
+//FmtFiringID formats the id under which a trigger firing for a version is recorded
+func FmtFiringID(triggerID, version string) string {
+	return fmt.Sprintf("%s@%s", triggerID, version)
+}
+
+//Match returns whether a new dataset version should fire the trigger
+func (trig *Trigger) Match(ref *DatasetRef) bool {
+	return trig.DatasetID == ref.DatasetID && (trig.Branch == "" || trig.Branch == ref.Branch)
+}
+
+//PutNewTrigger will put a trigger with the condition the pk doesn't exist yet
+func PutNewTrigger(conf *Conf, db DB, trig *Trigger) (err error) {
+	item, err := dynamodbattribute.MarshalMap(trig)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.TriggersTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#trig)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#trig": aws.String("trig"),
+		},
+		Item: item,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrTriggerExists
+	}
+
+	return nil
+}
+
+//ListTriggers returns all triggers in a pool, optionally only those of a single dataset
+func ListTriggers(conf *Conf, db DB, poolID, datasetID string) (trigs []*Trigger, err error) {
+	poolattr, err := dynamodbattribute.Marshal(poolID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal pool id")
+	}
+
+	qin := &dynamodb.QueryInput{
+		TableName:              aws.String(conf.TriggersTableName),
+		KeyConditionExpression: aws.String("#pool = :poolID"),
+		ExpressionAttributeNames: map[string]*string{
+			"#pool": aws.String("pool"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":poolID": poolattr,
+		},
+	}
+
+	if datasetID != "" {
+		setattr, err := dynamodbattribute.Marshal(FmtTriggerID(datasetID, ""))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal dataset prefix")
+		}
+
+		qin.KeyConditionExpression = aws.String("#pool = :poolID AND begins_with (#trig, :datasetID)")
+		qin.ExpressionAttributeNames["#trig"] = aws.String("trig")
+		qin.ExpressionAttributeValues[":datasetID"] = setattr
+	}
+
+	var ierr error
+	if err = db.QueryPages(qin, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			trig := &Trigger{}
+			ierr = dynamodbattribute.UnmarshalMap(item, trig)
+			if ierr != nil {
+				return false
+			}
+
+			trigs = append(trigs, trig)
+		}
+
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to query triggers")
+	}
+
+	if ierr != nil {
+		return nil, errors.Wrap(ierr, "failed to unmarshal trigger")
+	}
+
+	return trigs, nil
+}
+
+//DeleteTrigger deletes a trigger by pk
+func DeleteTrigger(conf *Conf, db DB, pk TriggerPK) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	if _, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(conf.TriggersTableName),
+		Key:                 ipk,
+		ConditionExpression: aws.String("attribute_exists(#trig)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#trig": aws.String("trig"),
+		},
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to delete item")
+		}
+
+		return ErrTriggerNotExists
+	}
+
+	return nil
+}
+
+//PutNewFiring will put a firing with the condition the pk doesn't exist yet, this is what de-duplicates versions that are reported many times
+func PutNewFiring(conf *Conf, db DB, fire *Firing) (err error) {
+	item, err := dynamodbattribute.MarshalMap(fire)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.FiringsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#fire)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#fire": aws.String("fire"),
+		},
+		Item: item,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrFiringExists
+	}
+
+	return nil
+}
+
+//DeleteFiring deletes a firing by pk
+func DeleteFiring(conf *Conf, db DB, pk FiringPK) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	if _, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(conf.FiringsTableName),
+		Key:       ipk,
+	}); err != nil {
+		return errors.Wrap(err, "failed to delete item")
+	}
+
+	return nil
+}
+
+//FireTriggers submits evals for the triggers that match the reported dataset versions. Each trigger fires once per version, no matter how often or by how many workers the version is reported
+func FireTriggers(conf *Conf, svc *Services, pool *Pool, refs []*DatasetRef) (err error) {
+	trigsBySet := map[string][]*Trigger{}
+	for _, ref := range refs {
+		trigs, ok := trigsBySet[ref.DatasetID]
+		if !ok {
+			trigs, err = ListTriggers(conf, svc.DB, pool.PoolID, ref.DatasetID)
+			if err != nil {
+				return errors.Wrap(err, "failed to list triggers")
+			}
+
+			trigsBySet[ref.DatasetID] = trigs
+		}
+
+		for _, trig := range trigs {
+			if !trig.Match(ref) {
+				continue
+			}
+
+			eval, err := trig.Template.Instantiate()
+			if err != nil {
+				return errors.Wrap(err, "failed to instantiate trigger template")
+			}
+
+			if eval.Dataset == "" {
+				eval.Dataset = ref.DatasetID //prefer workers that already hold the new version
+			}
+
+			eval.Inputs = append(append([]*DatasetRef{}, eval.Inputs...), ref)
+			fire := &Firing{
+				FiringPK: FiringPK{PoolID: pool.PoolID, FiringID: FmtFiringID(trig.TriggerID, ref.Version)},
+				EvalID:   eval.EvalID,
+			}
+
+			err = PutNewFiring(conf, svc.DB, fire)
+			if err == ErrFiringExists {
+				continue
+			} else if err != nil {
+				return errors.Wrap(err, "failed to put firing")
+			}
+
+			if _, err = SubmitEval(conf, svc, pool, eval); err != nil {
+				//forget the firing such that the version triggers again when it is reported next
+				if derr := DeleteFiring(conf, svc.DB, fire.FiringPK); derr != nil {
+					return errors.Wrapf(derr, "failed to delete firing after failing to submit eval: %v", err)
+				}
+
+				return errors.Wrap(err, "failed to submit eval")
+			}
+		}
+	}
+
+	return nil
+}
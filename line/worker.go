@@ -17,9 +17,17 @@ type WorkerPK struct {
 //Worker represents a source of capacity
 type Worker struct {
 	WorkerPK
-	Capacity int    `dynamodbav:"cap"`
-	QueueURL string `dynamodbav:"que"`
-	TTL      int64  `dynamodbav:"ttl"`
+	Capacity int               `dynamodbav:"cap"`
+	QueueURL string            `dynamodbav:"que"`
+	TTL      int64             `dynamodbav:"ttl"`
+	Labels   map[string]string `dynamodbav:"lbl,omitempty"`
+	Zone     string            `dynamodbav:"zone,omitempty"`            //failure domain the worker is in
+	Evict    []string          `dynamodbav:"evict,stringset,omitempty"` //datasets the worker should remove its replica of
+	Endpoint string            `dynamodbav:"ep,omitempty"`              //base url at which replicas are served to peers
+	Disk     *int64            `dynamodbav:"disk,omitempty"`            //unreserved checkout space in bytes, nil if the worker doesn't account for disk
+	CPUs     *float64          `dynamodbav:"cpus,omitempty"`            //unclaimed cpus, nil if the worker doesn't account for cpus
+	MemoryMB *int64            `dynamodbav:"mem,omitempty"`             //unclaimed memory, nil if the worker doesn't account for memory
+	DiskVer  int64             `dynamodbav:"dver,omitempty"`            //counts the changes to the unreserved disk space
 }
 
 var (
@@ -28,6 +36,9 @@ var (
 
 	//ErrWorkerNotExists means a worker was not found while expecting it to exist
 	ErrWorkerNotExists = errors.New("worker doesn't exist")
+
+	//ErrWorkerDiskChanged means the disk space of a worker was claimed or released since it was read
+	ErrWorkerDiskChanged = errors.New("worker disk space changed")
 )
 
 //PutNewWorker will put an worker with the condition the pk doesn't exist yet
@@ -82,23 +93,25 @@ func DeleteWorker(conf *Conf, db DB, pk WorkerPK) (err error) {
 	return nil
 }
 
-//UpdateWorkerTTL under the condition that it exists
-func UpdateWorkerTTL(conf *Conf, db DB, ttl int64, pk WorkerPK) (err error) {
+//UpdateWorkerTTL under the condition that it exists, the updated worker is returned
+func UpdateWorkerTTL(conf *Conf, db DB, ttl int64, pk WorkerPK) (worker *Worker, err error) {
 	ipk, err := dynamodbattribute.MarshalMap(pk)
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal keys map")
+		return nil, errors.Wrap(err, "failed to marshal keys map")
 	}
 
 	ttlattr, err := dynamodbattribute.Marshal(ttl)
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal new ttl")
+		return nil, errors.Wrap(err, "failed to marshal new ttl")
 	}
 
-	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+	var out *dynamodb.UpdateItemOutput
+	if out, err = db.UpdateItem(&dynamodb.UpdateItemInput{
 		TableName:           aws.String(conf.WorkersTableName),
 		Key:                 ipk,
 		UpdateExpression:    aws.String("SET #ttl = :ttl"),
 		ConditionExpression: aws.String("attribute_exists(#pool)"),
+		ReturnValues:        aws.String(dynamodb.ReturnValueAllNew),
 		ExpressionAttributeNames: map[string]*string{
 			"#ttl":  aws.String("ttl"),
 			"#pool": aws.String("pool"),
@@ -109,13 +122,19 @@ func UpdateWorkerTTL(conf *Conf, db DB, ttl int64, pk WorkerPK) (err error) {
 	}); err != nil {
 		aerr, ok := err.(awserr.Error)
 		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
-			return errors.Wrap(err, "failed to update item")
+			return nil, errors.Wrap(err, "failed to update item")
 		}
 
-		return ErrWorkerNotExists
+		return nil, ErrWorkerNotExists
 	}
 
-	return nil
+	worker = &Worker{}
+	err = dynamodbattribute.UnmarshalMap(out.Attributes, worker)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return worker, nil
 }
 
 //GetWorker returns a worker by its primary key
@@ -145,3 +164,121 @@ func GetWorker(conf *Conf, db DB, pk WorkerPK) (worker *Worker, err error) {
 
 	return worker, nil
 }
+
+//UpdateWorkerEvictions adds datasets to, or removes them from, the set of replicas the worker is asked to evict
+func UpdateWorkerEvictions(conf *Conf, db DB, pk WorkerPK, add bool, datasetIDs []string) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	setattr := &dynamodb.AttributeValue{SS: aws.StringSlice(datasetIDs)}
+	expr := "DELETE #evict :sets"
+	if add {
+		expr = "ADD #evict :sets"
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.WorkersTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String(expr),
+		ConditionExpression: aws.String("attribute_exists(#pool)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#evict": aws.String("evict"),
+			"#pool":  aws.String("pool"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sets": setattr,
+		},
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return ErrWorkerNotExists
+	}
+
+	return nil
+}
+
+//HasDisk returns whether the worker has room for checkouts of the given size, workers that don't account for disk always do
+func (w *Worker) HasDisk(size int64) bool {
+	return w.Disk == nil || *w.Disk >= size
+}
+
+//HasResources returns whether the task's resource limits fit in what is left on the worker, resources the worker doesn't account for are not checked
+func (w *Worker) HasResources(task *Task) bool {
+	if task == nil {
+		return true
+	}
+
+	if w.CPUs != nil && task.CPUs > *w.CPUs {
+		return false
+	}
+
+	return w.MemoryMB == nil || task.MemoryMB <= *w.MemoryMB
+}
+
+//SetWorkerDisk sets the unreserved checkout space of a worker under the condition that it didn't change since the given version was read
+func SetWorkerDisk(conf *Conf, db DB, pk WorkerPK, disk, ver int64) (err error) {
+	cond := "attribute_exists(#pool) AND #dver = :dver"
+	if ver == 0 {
+		cond = "attribute_exists(#pool) AND attribute_not_exists(#dver)"
+	}
+
+	return updateWorkerDisk(conf, db, pk, "SET #disk = :disk ADD #dver :one", cond, disk, &ver, ErrWorkerDiskChanged)
+}
+
+//ReleaseWorkerDisk returns reserved checkout space to a worker, workers that don't account for disk are left alone
+func ReleaseWorkerDisk(conf *Conf, db DB, pk WorkerPK, size int64) (err error) {
+	err = updateWorkerDisk(conf, db, pk, "SET #disk = #disk + :disk ADD #dver :one", "attribute_exists(#pool) AND attribute_exists(#disk)", size, nil, ErrWorkerNotExists)
+	if err == ErrWorkerNotExists {
+		return nil
+	}
+
+	return err
+}
+
+func updateWorkerDisk(conf *Conf, db DB, pk WorkerPK, expr, cond string, disk int64, ver *int64, failed error) (err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	vals, err := dynamodbattribute.MarshalMap(struct {
+		Disk int64 `dynamodbav:":disk"`
+		One  int64 `dynamodbav:":one"`
+	}{disk, 1})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal disk space")
+	}
+
+	if ver != nil && *ver > 0 {
+		if vals[":dver"], err = dynamodbattribute.Marshal(*ver); err != nil {
+			return errors.Wrap(err, "failed to marshal disk version")
+		}
+	}
+
+	if _, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(conf.WorkersTableName),
+		Key:                 ipk,
+		UpdateExpression:    aws.String(expr),
+		ConditionExpression: aws.String(cond),
+		ExpressionAttributeNames: map[string]*string{
+			"#disk": aws.String("disk"),
+			"#dver": aws.String("dver"),
+			"#pool": aws.String("pool"),
+		},
+		ExpressionAttributeValues: vals,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to update item")
+		}
+
+		return failed
+	}
+
+	return nil
+}
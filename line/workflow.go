@@ -0,0 +1,539 @@
+package line
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+//WorkflowPK describes the workflow's primary key in the base table
+type WorkflowPK struct {
+	PoolID     string `dynamodbav:"pool"`
+	WorkflowID string `dynamodbav:"wf"`
+}
+
+//WorkflowNode is an eval template that is submitted when all nodes it depends on succeeded
+type WorkflowNode struct {
+	Name      string   `dynamodbav:"name"`
+	DependsOn []string `dynamodbav:"deps,omitempty"`
+	Retries   int      `dynamodbav:"retries"`
+	Template  *Eval    `dynamodbav:"tmpl"`
+}
+
+//Workflow describes a directed acyclic graph of eval templates
+type Workflow struct {
+	WorkflowPK
+	Nodes []*WorkflowNode `dynamodbav:"nodes"`
+}
+
+//WorkflowRunPK describes the workflow run's primary key in the base table
+type WorkflowRunPK struct {
+	PoolID string `dynamodbav:"pool"`
+	RunID  string `dynamodbav:"run"`
+}
+
+//NodeRun holds the progress of a single node in a workflow run
+type NodeRun struct {
+	State    string        `dynamodbav:"st"`
+	EvalID   string        `dynamodbav:"eval,omitempty"`
+	Attempts int           `dynamodbav:"try"`
+	Inputs   []*DatasetRef `dynamodbav:"in,omitempty"`
+	Outputs  []*DatasetRef `dynamodbav:"out,omitempty"`
+}
+
+//WorkflowRun is a single execution of a workflow
+type WorkflowRun struct {
+	WorkflowRunPK
+	WorkflowID string              `dynamodbav:"wf"`
+	State      string              `dynamodbav:"st"`
+	Nodes      map[string]*NodeRun `dynamodbav:"nodes"`
+	Version    int64               `dynamodbav:"ver"` //optimistic locking, completions of parallel branches may race
+}
+
+var (
+	//ErrWorkflowExists means a workflow exists while it was expected not to
+	ErrWorkflowExists = errors.New("workflow already exists")
+
+	//ErrWorkflowNotExists means a workflow was not found while expecting it to exist
+	ErrWorkflowNotExists = errors.New("workflow doesn't exist")
+
+	//ErrWorkflowRunNotExists means a workflow run was not found while expecting it to exist
+	ErrWorkflowRunNotExists = errors.New("workflow run doesn't exist")
+
+	//ErrWorkflowRunChanged means the run was updated concurrently and should be read again
+	ErrWorkflowRunChanged = errors.New("workflow run was changed concurrently")
+)
+
+//NewWorkflowNodes converts and validates nodes from client payloads, the nodes must form a directed acyclic graph
+func NewWorkflowNodes(nodes []*client.WorkflowNode) (wnodes []*WorkflowNode, err error) {
+	if len(nodes) < 1 {
+		return nil, errors.New("workflow has no nodes")
+	}
+
+	byName := map[string]*WorkflowNode{}
+	for _, n := range nodes {
+		if n.Name == "" {
+			return nil, errors.New("workflow node without a name")
+		}
+
+		if _, ok := byName[n.Name]; ok {
+			return nil, errors.Errorf("duplicate workflow node '%s'", n.Name)
+		}
+
+		if n.Template == nil {
+			return nil, errors.Errorf("workflow node '%s' has no eval template", n.Name)
+		}
+
+		tmpl, err := NewEval(n.Template)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template for workflow node '%s'", n.Name)
+		}
+
+		if tmpl.Count > 0 {
+			return nil, errors.Errorf("workflow node '%s' can't be an array eval", n.Name)
+		}
+
+		tmpl.EvalID = "" //each attempt gets its own id
+		tmpl.NotBefore = 0
+		tmpl.Deadline = 0
+
+		wn := &WorkflowNode{Name: n.Name, DependsOn: n.DependsOn, Retries: n.Retries, Template: tmpl}
+		byName[n.Name] = wn
+		wnodes = append(wnodes, wn)
+	}
+
+	//depth first search for dependencies that don't exist or form a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	marks := map[string]int{}
+	var visit func(n *WorkflowNode) error
+	visit = func(n *WorkflowNode) error {
+		switch marks[n.Name] {
+		case visiting:
+			return errors.Errorf("workflow node '%s' is part of a cycle", n.Name)
+		case visited:
+			return nil
+		}
+
+		marks[n.Name] = visiting
+		for _, dep := range n.DependsOn {
+			dn, ok := byName[dep]
+			if !ok {
+				return errors.Errorf("workflow node '%s' depends on unknown node '%s'", n.Name, dep)
+			}
+
+			if err := visit(dn); err != nil {
+				return err
+			}
+		}
+
+		marks[n.Name] = visited
+		return nil
+	}
+
+	for _, n := range wnodes {
+		if err = visit(n); err != nil {
+			return nil, err
+		}
+	}
+
+	return wnodes, nil
+}
+
+//Node returns a node by its name or nil if it doesn't exist
+func (wf *Workflow) Node(name string) *WorkflowNode {
+	for _, n := range wf.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+
+	return nil
+}
+
+//PutNewWorkflow will put a workflow with the condition the pk doesn't exist yet
+func PutNewWorkflow(conf *Conf, db DB, wf *Workflow) (err error) {
+	item, err := dynamodbattribute.MarshalMap(wf)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.WorkflowsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#wf)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#wf": aws.String("wf"),
+		},
+		Item: item,
+	}); err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrWorkflowExists
+	}
+
+	return nil
+}
+
+//GetWorkflow returns a workflow by its primary key
+func GetWorkflow(conf *Conf, db DB, pk WorkflowPK) (wf *Workflow, err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	var out *dynamodb.GetItemOutput
+	if out, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(conf.WorkflowsTableName),
+		Key:       ipk,
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to get item")
+	}
+
+	if out.Item == nil {
+		return nil, ErrWorkflowNotExists
+	}
+
+	wf = &Workflow{}
+	err = dynamodbattribute.UnmarshalMap(out.Item, wf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return wf, nil
+}
+
+//GetWorkflowRun returns a workflow run by its primary key
+func GetWorkflowRun(conf *Conf, db DB, pk WorkflowRunPK) (run *WorkflowRun, err error) {
+	ipk, err := dynamodbattribute.MarshalMap(pk)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal keys map")
+	}
+
+	var out *dynamodb.GetItemOutput
+	if out, err = db.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(conf.RunsTableName),
+		Key:            ipk,
+		ConsistentRead: aws.Bool(true),
+	}); err != nil {
+		return nil, errors.Wrap(err, "failed to get item")
+	}
+
+	if out.Item == nil {
+		return nil, ErrWorkflowRunNotExists
+	}
+
+	run = &WorkflowRun{}
+	err = dynamodbattribute.UnmarshalMap(out.Item, run)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal item")
+	}
+
+	return run, nil
+}
+
+//PutWorkflowRun will put a workflow run under the condition that it wasn't changed since it was read, the version is incremented
+func PutWorkflowRun(conf *Conf, db DB, run *WorkflowRun) (err error) {
+	prev := run.Version
+	run.Version++
+	item, err := dynamodbattribute.MarshalMap(run)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal item map")
+	}
+
+	prevattr, err := dynamodbattribute.Marshal(prev)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal version")
+	}
+
+	if _, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(conf.RunsTableName),
+		ConditionExpression: aws.String("attribute_not_exists(#run) OR #ver = :prev"),
+		ExpressionAttributeNames: map[string]*string{
+			"#run": aws.String("run"),
+			"#ver": aws.String("ver"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prev": prevattr,
+		},
+		Item: item,
+	}); err != nil {
+		run.Version = prev
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.Wrap(err, "failed to put item")
+		}
+
+		return ErrWorkflowRunChanged
+	}
+
+	return nil
+}
+
+//startNode prepares the eval for a node in the run, the eval is returned such that it can be submitted once the run is stored
+func startNode(run *WorkflowRun, node *WorkflowNode, inputs []*DatasetRef) (eval *Eval, err error) {
+	eval, err = node.Template.Instantiate()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to instantiate node template")
+	}
+
+	eval.RunID = run.RunID
+	eval.Node = node.Name
+	eval.Inputs = append(append([]*DatasetRef{}, node.Template.Inputs...), inputs...)
+
+	nr := run.Nodes[node.Name]
+	nr.State = client.NodeStateRunning
+	nr.EvalID = eval.EvalID
+	nr.Inputs = inputs
+	nr.Attempts++
+	return eval, nil
+}
+
+//StartWorkflowRun creates a new run of the workflow and submits evals for all nodes without dependencies
+func StartWorkflowRun(conf *Conf, svc *Services, pool *Pool, wf *Workflow, inputs []*DatasetRef) (run *WorkflowRun, err error) {
+	idb := make([]byte, 10)
+	_, err = rand.Read(idb)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate random id bytes")
+	}
+
+	run = &WorkflowRun{
+		WorkflowRunPK: WorkflowRunPK{PoolID: pool.PoolID, RunID: hex.EncodeToString(idb)},
+		WorkflowID:    wf.WorkflowID,
+		State:         client.RunStateRunning,
+		Nodes:         map[string]*NodeRun{},
+	}
+
+	for _, node := range wf.Nodes {
+		run.Nodes[node.Name] = &NodeRun{State: client.NodeStateWaiting}
+	}
+
+	var evals []*Eval
+	for _, node := range wf.Nodes {
+		if len(node.DependsOn) > 0 {
+			continue
+		}
+
+		eval, err := startNode(run, node, inputs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to start node '%s'", node.Name)
+		}
+
+		evals = append(evals, eval)
+	}
+
+	err = PutWorkflowRun(conf, svc.DB, run)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to put workflow run")
+	}
+
+	if err = submitNodeEvals(conf, svc, pool, wf, evals); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+//AdvanceWorkflowRun is called when the eval of a workflow node finished. On success the outputs are passed to the children that have all their dependencies satisfied, on failure the node is retried or its branch is stopped
+func AdvanceWorkflowRun(conf *Conf, svc *Services, pool *Pool, eval *Eval, succeeded bool, outputs []*DatasetRef) (err error) {
+	if eval.RunID == "" {
+		return nil //not part of a workflow
+	}
+
+	wf, run, evals := (*Workflow)(nil), (*WorkflowRun)(nil), []*Eval(nil)
+	for i := 0; i < 5; i++ {
+		run, err = GetWorkflowRun(conf, svc.DB, WorkflowRunPK{PoolID: pool.PoolID, RunID: eval.RunID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get workflow run")
+		}
+
+		if wf == nil {
+			wf, err = GetWorkflow(conf, svc.DB, WorkflowPK{PoolID: pool.PoolID, WorkflowID: run.WorkflowID})
+			if err != nil {
+				return errors.Wrap(err, "failed to get workflow")
+			}
+		}
+
+		var changed bool
+		evals, changed, err = advanceNode(wf, run, eval, succeeded, outputs)
+		if err != nil {
+			return errors.Wrap(err, "failed to advance node")
+		}
+
+		if !changed {
+			return nil //stale notification, the node already moved on
+		}
+
+		err = PutWorkflowRun(conf, svc.DB, run)
+		if err == ErrWorkflowRunChanged {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "failed to put workflow run")
+		}
+
+		if err = submitNodeEvals(conf, svc, pool, wf, evals); err != nil {
+			return err
+		}
+
+		svc.Logs.Info("advanced workflow run", zap.String("run", run.RunID), zap.String("node", eval.Node), zap.String("state", run.State))
+		return nil
+	}
+
+	return errors.Wrap(ErrWorkflowRunChanged, "gave up advancing")
+}
+
+//submitNodeEvals submits the evals of nodes that were stored as running. A node whose eval couldn't be submitted is marked as failed, such that the run doesn't wait for a completion that never comes, the first error is returned
+func submitNodeEvals(conf *Conf, svc *Services, pool *Pool, wf *Workflow, evals []*Eval) (err error) {
+	for _, eval := range evals {
+		_, serr := SubmitEval(conf, svc, pool, eval)
+		if serr == nil {
+			continue
+		}
+
+		if ferr := failNode(conf, svc.DB, wf, eval); ferr != nil {
+			svc.Logs.Error("failed to fail unsubmitted workflow node", zap.String("run", eval.RunID), zap.String("node", eval.Node), zap.Error(ferr))
+		}
+
+		if err == nil {
+			err = errors.Wrapf(serr, "failed to submit eval for node '%s'", eval.Node)
+		}
+	}
+
+	return err
+}
+
+//failNode marks the node of an eval as failed and skips its descendants, under the condition that the node still runs that eval. Nodes are not retried as their eval never started
+func failNode(conf *Conf, db DB, wf *Workflow, eval *Eval) (err error) {
+	var run *WorkflowRun
+	for i := 0; i < 5; i++ {
+		run, err = GetWorkflowRun(conf, db, WorkflowRunPK{PoolID: wf.PoolID, RunID: eval.RunID})
+		if err != nil {
+			return errors.Wrap(err, "failed to get workflow run")
+		}
+
+		nr := run.Nodes[eval.Node]
+		if nr == nil || nr.EvalID != eval.EvalID || nr.State != client.NodeStateRunning {
+			return nil //the node already moved on
+		}
+
+		nr.State = client.NodeStateFailed
+		skipDescendants(wf, run, eval.Node)
+		finishRun(run)
+
+		err = PutWorkflowRun(conf, db, run)
+		if err == ErrWorkflowRunChanged {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "failed to put workflow run")
+		}
+
+		return nil
+	}
+
+	return errors.Wrap(ErrWorkflowRunChanged, "gave up failing node")
+}
+
+//advanceNode updates the run in memory and returns the evals that need to be submitted
+func advanceNode(wf *Workflow, run *WorkflowRun, eval *Eval, succeeded bool, outputs []*DatasetRef) (evals []*Eval, changed bool, err error) {
+	node := wf.Node(eval.Node)
+	nr := run.Nodes[eval.Node]
+	if node == nil || nr == nil {
+		return nil, false, errors.Errorf("workflow has no node '%s'", eval.Node)
+	}
+
+	if nr.EvalID != eval.EvalID || nr.State != client.NodeStateRunning {
+		return nil, false, nil
+	}
+
+	if succeeded {
+		nr.State = client.NodeStateSucceeded
+		nr.Outputs = outputs
+
+		//children that now have all their dependencies satisfied receive the outputs of their dependencies as inputs
+		for _, child := range wf.Nodes {
+			cr := run.Nodes[child.Name]
+			if cr.State != client.NodeStateWaiting || !contains(child.DependsOn, node.Name) {
+				continue
+			}
+
+			var inputs []*DatasetRef
+			ready := true
+			for _, dep := range child.DependsOn {
+				if run.Nodes[dep].State != client.NodeStateSucceeded {
+					ready = false
+					break
+				}
+
+				inputs = append(inputs, run.Nodes[dep].Outputs...)
+			}
+
+			if !ready {
+				continue
+			}
+
+			e, err := startNode(run, child, inputs)
+			if err != nil {
+				return nil, false, errors.Wrapf(err, "failed to start node '%s'", child.Name)
+			}
+
+			evals = append(evals, e)
+		}
+	} else if nr.Attempts <= node.Retries {
+		e, err := startNode(run, node, nr.Inputs)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "failed to retry node '%s'", node.Name)
+		}
+
+		evals = append(evals, e)
+	} else {
+		nr.State = client.NodeStateFailed
+		skipDescendants(wf, run, node.Name)
+	}
+
+	finishRun(run)
+	return evals, true, nil
+}
+
+//finishRun sets the state of the run once no node is waiting or running anymore
+func finishRun(run *WorkflowRun) {
+	done, failed := true, false
+	for _, r := range run.Nodes {
+		switch r.State {
+		case client.NodeStateWaiting, client.NodeStateRunning:
+			done = false
+		case client.NodeStateFailed, client.NodeStateSkipped:
+			failed = true
+		}
+	}
+
+	if done && failed {
+		run.State = client.RunStateFailed
+	} else if done {
+		run.State = client.RunStateSucceeded
+	}
+}
+
+//skipDescendants marks all waiting nodes that (indirectly) depend on the named node as skipped
+func skipDescendants(wf *Workflow, run *WorkflowRun, name string) {
+	for _, n := range wf.Nodes {
+		if !contains(n.DependsOn, name) || run.Nodes[n.Name].State != client.NodeStateWaiting {
+			continue
+		}
+
+		run.Nodes[n.Name].State = client.NodeStateSkipped
+		skipDescendants(wf, run, n.Name)
+	}
+}
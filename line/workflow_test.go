@@ -0,0 +1,74 @@
+package line
+
+import (
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestNewWorkflowNodes(t *testing.T) {
+	tmpl := &client.ScheduleEvalInput{Size: 1}
+	for _, c := range []struct {
+		nodes []*client.WorkflowNode
+		ok    bool
+	}{
+		{[]*client.WorkflowNode{{Name: "a", Template: tmpl}, {Name: "b", DependsOn: []string{"a"}, Template: tmpl}}, true},
+		{[]*client.WorkflowNode{{Name: "a", DependsOn: []string{"b"}, Template: tmpl}, {Name: "b", DependsOn: []string{"a"}, Template: tmpl}}, false},
+		{[]*client.WorkflowNode{{Name: "a", DependsOn: []string{"x"}, Template: tmpl}}, false},
+		{[]*client.WorkflowNode{{Name: "a", Template: tmpl}, {Name: "a", Template: tmpl}}, false},
+		{[]*client.WorkflowNode{{Name: "a"}}, false},
+		{nil, false},
+	} {
+		_, err := NewWorkflowNodes(c.nodes)
+		if (err == nil) != c.ok {
+			t.Errorf("nodes %+v: expected ok=%v, got err: %v", c.nodes, c.ok, err)
+		}
+	}
+}
+
+func TestAdvanceNode(t *testing.T) {
+	tmpl := &client.ScheduleEvalInput{Size: 1}
+	nodes, err := NewWorkflowNodes([]*client.WorkflowNode{
+		{Name: "a", Template: tmpl},
+		{Name: "b", Template: tmpl, Retries: 1},
+		{Name: "c", DependsOn: []string{"a", "b"}, Template: tmpl},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wf := &Workflow{Nodes: nodes}
+	run := &WorkflowRun{State: client.RunStateRunning, Nodes: map[string]*NodeRun{}}
+	for _, n := range nodes {
+		run.Nodes[n.Name] = &NodeRun{State: client.NodeStateWaiting}
+	}
+
+	ea, _ := startNode(run, wf.Node("a"), nil)
+	eb, _ := startNode(run, wf.Node("b"), nil)
+
+	out := []*DatasetRef{{DatasetID: "d1", Version: "v1"}}
+	evals, changed, err := advanceNode(wf, run, ea, true, out)
+	if err != nil || !changed || len(evals) != 0 {
+		t.Fatalf("expected no evals for c while b is running, got %d (changed=%v, err=%v)", len(evals), changed, err)
+	}
+
+	//b fails once and is retried with a new eval
+	evals, _, _ = advanceNode(wf, run, eb, false, nil)
+	if len(evals) != 1 || evals[0].Node != "b" || run.Nodes["b"].Attempts != 2 {
+		t.Fatalf("expected b to be retried, got %d evals", len(evals))
+	}
+
+	//the old eval of b is stale now
+	if _, changed, _ = advanceNode(wf, run, eb, true, nil); changed {
+		t.Fatal("expected stale notification to be ignored")
+	}
+
+	evals, _, _ = advanceNode(wf, run, evals[0], true, nil)
+	if len(evals) != 1 || evals[0].Node != "c" || len(evals[0].Inputs) != 1 || evals[0].Inputs[0].Version != "v1" {
+		t.Fatalf("expected c to start with outputs of a, got %+v", evals)
+	}
+
+	if _, _, _ = advanceNode(wf, run, evals[0], false, nil); run.State != client.RunStateFailed {
+		t.Fatalf("expected run to fail, got '%s'", run.State)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//ReplicaCache keeps track of the local replicas and evicts the least recently used ones when they take more space than allowed. Replicas in use by running allocs and pinned replicas are never evicted
+type ReplicaCache struct {
+	Dir      string
+	MaxBytes int64 //zero disables size based eviction
+
+	mu     sync.Mutex
+	used   map[string]time.Time
+	inUse  map[string]int
+	hints  map[string]*client.Retention
+	evicts map[string]bool
+}
+
+//NewReplicaCache creates a cache for the replicas in dir, replicas that are already on disk count as used when they were last modified
+func NewReplicaCache(dir string, maxBytes int64) (cache *ReplicaCache, err error) {
+	cache = &ReplicaCache{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		used:     map[string]time.Time{},
+		inUse:    map[string]int{},
+		hints:    map[string]*client.Retention{},
+		evicts:   map[string]bool{},
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create replica directory")
+	}
+
+	repos, err := filepath.Glob(filepath.Join(dir, "*.git"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list replicas")
+	}
+
+	for _, repo := range repos {
+		fi, err := os.Stat(repo)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to stat replica")
+		}
+
+		cache.used[strings.TrimSuffix(filepath.Base(repo), ".git")] = fi.ModTime()
+	}
+
+	return cache, nil
+}
+
+//Datasets returns the datasets that are replicated locally
+func (c *ReplicaCache) Datasets() (datasetIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for datasetID := range c.used {
+		datasetIDs = append(datasetIDs, datasetID)
+	}
+
+	sort.Strings(datasetIDs)
+	return datasetIDs
+}
+
+//Acquire marks a replica as in use by an alloc, it is not evicted until it is released
+func (c *ReplicaCache) Acquire(datasetID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inUse[datasetID]++
+	c.used[datasetID] = time.Now()
+}
+
+//Release marks a replica as no longer in use by an alloc
+func (c *ReplicaCache) Release(datasetID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inUse[datasetID]--; c.inUse[datasetID] < 1 {
+		delete(c.inUse, datasetID)
+	}
+
+	c.used[datasetID] = time.Now()
+}
+
+//Depth returns how many versions of each branch to fetch for a dataset according to its retention hint, zero fetches all history
+func (c *ReplicaCache) Depth(datasetID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hint := c.hints[datasetID]; hint != nil {
+		return hint.KeepVersions
+	}
+
+	return 0
+}
+
+//Update takes the retention hints and evictions the server returned on a heartbeat
+func (c *ReplicaCache) Update(out *client.SendHeartbeatOutput) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hints = map[string]*client.Retention{}
+	for datasetID, hint := range out.Retention {
+		c.hints[datasetID] = hint
+	}
+
+	c.evicts = map[string]bool{}
+	for _, datasetID := range out.EvictReplicas {
+		c.evicts[datasetID] = true
+	}
+}
+
+//Evict removes the replicas the server asked to evict and then the least recently used ones until the replicas fit in the maximum size. The datasets whose replica was removed are returned
+func (c *ReplicaCache) Evict() (removed []string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sizes := map[string]int64{}
+	var total int64
+	for datasetID := range c.used {
+		size, err := dirSize(ReplicaPath(c.Dir, datasetID))
+		if err != nil && !os.IsNotExist(err) {
+			return removed, errors.Wrapf(err, "failed to determine size of replica '%s'", datasetID)
+		}
+
+		sizes[datasetID] = size
+		total += size
+	}
+
+	var candidates []string
+	for datasetID := range c.used {
+		if c.inUse[datasetID] > 0 {
+			continue
+		}
+
+		if c.evicts[datasetID] {
+			if err = c.remove(datasetID); err != nil {
+				return removed, err
+			}
+
+			removed = append(removed, datasetID)
+			total -= sizes[datasetID]
+			continue
+		}
+
+		if hint := c.hints[datasetID]; hint != nil && hint.Pinned {
+			continue
+		}
+
+		candidates = append(candidates, datasetID)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return c.used[candidates[i]].Before(c.used[candidates[j]])
+	})
+
+	for _, datasetID := range candidates {
+		if c.MaxBytes < 1 || total <= c.MaxBytes {
+			break
+		}
+
+		if err = c.remove(datasetID); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, datasetID)
+		total -= sizes[datasetID]
+	}
+
+	return removed, nil
+}
+
+//remove deletes a replica from disk, the lock must be held
+func (c *ReplicaCache) remove(datasetID string) (err error) {
+	err = os.RemoveAll(ReplicaPath(c.Dir, datasetID))
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove replica '%s'", datasetID)
+	}
+
+	delete(c.used, datasetID)
+	delete(c.evicts, datasetID)
+	return nil
+}
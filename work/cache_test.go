@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microfactory/line/line/client"
+)
+
+//writeReplica puts a replica of the given size on disk that was last used some time ago
+func writeReplica(t *testing.T, dir, datasetID string, size int, age time.Duration) {
+	repo := ReplicaPath(dir, datasetID)
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(repo, "data"), make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	used := time.Now().Add(-age)
+	if err := os.Chtimes(repo, used, used); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicaCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	writeReplica(t, dir, "oldest", 100, 3*time.Hour)
+	writeReplica(t, dir, "older", 100, 2*time.Hour)
+	writeReplica(t, dir, "recent", 100, time.Hour)
+
+	cache, err := NewReplicaCache(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := strings.Join(cache.Datasets(), ","); ids != "older,oldest,recent" {
+		t.Fatalf("expected the replicas on disk to be known, got %s", ids)
+	}
+
+	removed, err := cache.Evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0] != "oldest" {
+		t.Fatalf("expected only the least recently used replica to be evicted, got %v", removed)
+	}
+
+	if _, err = os.Stat(ReplicaPath(dir, "oldest")); !os.IsNotExist(err) {
+		t.Fatalf("expected the evicted replica to be removed from disk, got %v", err)
+	}
+}
+
+func TestReplicaCacheNeverEvictsReplicasInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	writeReplica(t, dir, "a", 100, 3*time.Hour)
+	writeReplica(t, dir, "b", 100, 2*time.Hour)
+	writeReplica(t, dir, "c", 100, time.Hour)
+
+	cache, err := NewReplicaCache(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Acquire("a")
+	cache.Acquire("a")
+	cache.Update(&client.SendHeartbeatOutput{
+		Retention:     map[string]*client.Retention{"b": {Pinned: true}},
+		EvictReplicas: []string{"a"},
+	})
+
+	removed, err := cache.Evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 1 || removed[0] != "c" {
+		t.Fatalf("expected replicas in use and pinned replicas to be kept even when asked to evict, got %v", removed)
+	}
+
+	//the replica stays in use until every alloc released it
+	cache.Release("a")
+	if removed, err = cache.Evict(); err != nil || len(removed) != 0 {
+		t.Fatalf("expected a replica that is still in use to be kept, got %v (%v)", removed, err)
+	}
+
+	cache.Release("a")
+	if removed, err = cache.Evict(); err != nil || len(removed) != 1 || removed[0] != "a" {
+		t.Fatalf("expected the released replica to be evicted as the server asked, got %v (%v)", removed, err)
+	}
+
+	if ids := cache.Datasets(); len(ids) != 1 || ids[0] != "b" {
+		t.Fatalf("expected only the pinned replica to be left, got %v", ids)
+	}
+}
+
+func TestReplicaCacheDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_cache_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	cache, err := NewReplicaCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Update(&client.SendHeartbeatOutput{Retention: map[string]*client.Retention{"a": {KeepVersions: 3}}})
+	if cache.Depth("a") != 3 || cache.Depth("b") != 0 {
+		t.Fatalf("expected the depth of the retention hint and all history otherwise, got %d and %d", cache.Depth("a"), cache.Depth("b"))
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//DefaultBranch is committed to when a task output doesn't name a branch
+const DefaultBranch = "master"
+
+//Checkout is a local copy of a dataset version that is mounted into a task container
+type Checkout struct {
+	DatasetID string
+	Branch    string //branch an output is committed to
+	Parent    string //version the checkout was materialised from, empty for the first version of an output
+	Path      string
+	Output    bool
+}
+
+//Mount returns how the checkout is made available to the task, inputs are mounted read-only
+func (co *Checkout) Mount() Mount {
+	if co.Output {
+		return Mount{Source: co.Path, Target: "/out/" + co.DatasetID}
+	}
+
+	return Mount{Source: co.Path, Target: "/in/" + co.DatasetID, ReadOnly: true}
+}
+
+//CheckoutManager materialises dataset versions from the local replicas into per-alloc directories and commits outputs back into the replicas
+type CheckoutManager struct {
+	ReplicaDir  string
+	CheckoutDir string
+	Reserve     int64 //bytes of the checkout file system that are not offered for checkouts
+}
+
+//AllocDir returns the directory that holds all checkouts of an alloc
+func (m *CheckoutManager) AllocDir(allocID string) string {
+	return filepath.Join(m.CheckoutDir, allocID)
+}
+
+//Prepare materialises the inputs of a task and prepares its outputs from the head of their branch. Inputs must be present in the local replicas at the exact version
+func (m *CheckoutManager) Prepare(allocID string, task *client.Task) (cos []*Checkout, err error) {
+	for _, in := range task.Inputs {
+		if !DatasetIDExp.MatchString(in.DatasetID) {
+			return nil, errors.Errorf("invalid input dataset id '%s'", in.DatasetID)
+		}
+	}
+
+	for _, out := range task.Outputs {
+		if !DatasetIDExp.MatchString(out.DatasetID) {
+			return nil, errors.Errorf("invalid output dataset id '%s'", out.DatasetID)
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			os.RemoveAll(m.AllocDir(allocID))
+		}
+	}()
+
+	for _, in := range task.Inputs {
+		co := &Checkout{
+			DatasetID: in.DatasetID,
+			Parent:    in.Version,
+			Path:      filepath.Join(m.AllocDir(allocID), "in", in.DatasetID),
+		}
+
+		repo := ReplicaPath(m.ReplicaDir, in.DatasetID)
+		if !hasCommit(repo, in.Version) {
+			return nil, errors.Errorf("version '%s' of dataset '%s' is not replicated locally", in.Version, in.DatasetID)
+		}
+
+		if err = materialise(repo, in.Version, co.Path); err != nil {
+			return nil, errors.Wrapf(err, "failed to materialise input '%s'", in.DatasetID)
+		}
+
+		cos = append(cos, co)
+	}
+
+	for _, out := range task.Outputs {
+		co := &Checkout{
+			DatasetID: out.DatasetID,
+			Branch:    out.Branch,
+			Path:      filepath.Join(m.AllocDir(allocID), "out", out.DatasetID),
+			Output:    true,
+		}
+
+		if co.Branch == "" {
+			co.Branch = DefaultBranch
+		}
+
+		repo := ReplicaPath(m.ReplicaDir, out.DatasetID)
+		if _, err = os.Stat(repo); os.IsNotExist(err) {
+			if err = git("", "init", "--bare", repo); err != nil {
+				return nil, errors.Wrapf(err, "failed to init replica for output '%s'", out.DatasetID)
+			}
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to stat replica")
+		}
+
+		if co.Parent, err = gitOutput(gitCmd(repo, "rev-parse", "--verify", "--quiet", "refs/heads/"+co.Branch)); err != nil {
+			co.Parent = "" //the branch doesn't exist yet, the output starts empty
+		}
+
+		if co.Parent == "" {
+			err = os.MkdirAll(co.Path, 0755)
+		} else {
+			err = materialise(repo, co.Parent, co.Path)
+		}
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to prepare output '%s'", out.DatasetID)
+		}
+
+		cos = append(cos, co)
+	}
+
+	return cos, nil
+}
+
+//Commit records the contents of output checkouts as new versions on their branch, outputs that didn't change are not reported
+func (m *CheckoutManager) Commit(allocID string, cos []*Checkout) (versions []*client.DatasetVersion, err error) {
+	for _, co := range cos {
+		if !co.Output {
+			continue
+		}
+
+		v, err := m.commit(allocID, co)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to commit output '%s'", co.DatasetID)
+		}
+
+		if v != nil {
+			versions = append(versions, v)
+		}
+	}
+
+	return versions, nil
+}
+
+//commit writes the checkout into a tree using a throw-away index, such that the replica can stay bare, and moves the branch only if nobody else moved it in the meantime
+func (m *CheckoutManager) commit(allocID string, co *Checkout) (v *client.DatasetVersion, err error) {
+	repo := ReplicaPath(m.ReplicaDir, co.DatasetID)
+	index := filepath.Join(m.AllocDir(allocID), fmt.Sprintf("%s.index", co.DatasetID))
+	defer os.Remove(index)
+
+	add := gitCmd(repo, "--work-tree", co.Path, "add", "--all", ".")
+	add.Env = append(add.Env, "GIT_INDEX_FILE="+index)
+	if _, err = gitOutput(add); err != nil {
+		return nil, errors.Wrap(err, "failed to stage output")
+	}
+
+	write := gitCmd(repo, "write-tree")
+	write.Env = append(write.Env, "GIT_INDEX_FILE="+index)
+	tree, err := gitOutput(write)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write tree")
+	}
+
+	args := []string{"commit-tree", tree, "-m", fmt.Sprintf("output of alloc %s", allocID)}
+	if co.Parent != "" {
+		ptree, err := gitOutput(gitCmd(repo, "rev-parse", co.Parent+"^{tree}"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to resolve parent tree")
+		}
+
+		if ptree == tree {
+			return nil, nil //nothing changed
+		}
+
+		args = append(args, "-p", co.Parent)
+	}
+
+	ct := gitCmd(repo, args...)
+	ct.Env = append(ct.Env,
+		"GIT_AUTHOR_NAME=line", "GIT_AUTHOR_EMAIL=line@localhost",
+		"GIT_COMMITTER_NAME=line", "GIT_COMMITTER_EMAIL=line@localhost",
+	)
+
+	commit, err := gitOutput(ct)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to commit tree")
+	}
+
+	//an empty old value makes git verify that the branch doesn't exist yet
+	if err = git(repo, "update-ref", "refs/heads/"+co.Branch, commit, co.Parent); err != nil {
+		return nil, errors.Wrap(err, "failed to update branch")
+	}
+
+	size, err := dirSize(co.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to determine output size")
+	}
+
+	return &client.DatasetVersion{
+		DatasetID: co.DatasetID,
+		Version:   commit,
+		Branch:    co.Branch,
+		Parent:    co.Parent,
+		Size:      size,
+	}, nil
+}
+
+//Release removes all checkouts of an alloc, the disk space that was reserved for them should be released with RemoveCheckout afterwards
+func (m *CheckoutManager) Release(allocID string) (err error) {
+	return os.RemoveAll(m.AllocDir(allocID))
+}
+
+//materialise writes the files of a version into a directory
+func materialise(repo, version, dir string) (err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create checkout directory")
+	}
+
+	archive := gitCmd(repo, "archive", "--format=tar", version)
+	extract := exec.Command("tar", "-x", "-C", dir)
+	if extract.Stdin, err = archive.StdoutPipe(); err != nil {
+		return errors.Wrap(err, "failed to pipe archive")
+	}
+
+	if err = archive.Start(); err != nil {
+		return errors.Wrap(err, "failed to start archive")
+	}
+
+	if _, err = gitOutput(extract); err != nil {
+		archive.Wait()
+		return errors.Wrap(err, "failed to extract archive")
+	}
+
+	return archive.Wait()
+}
+
+//dirSize sums the size of the regular files in a directory
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+//Usage returns the free space for checkouts and how much space the checkout of each dataset takes per alloc
+func (m *CheckoutManager) Usage() (free int64, states []*client.CheckoutState, err error) {
+	err = os.MkdirAll(m.CheckoutDir, 0755)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to create checkout directory")
+	}
+
+	var fs syscall.Statfs_t
+	if err = syscall.Statfs(m.CheckoutDir, &fs); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to stat checkout file system")
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(m.CheckoutDir, "*", "*", "*"))
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to list checkouts")
+	}
+
+	for _, dir := range dirs {
+		size, err := dirSize(dir)
+		if err != nil {
+			return 0, nil, errors.Wrapf(err, "failed to determine size of checkout '%s'", dir)
+		}
+
+		rel, _ := filepath.Rel(m.CheckoutDir, dir)
+		parts := strings.SplitN(rel, string(filepath.Separator), 3)
+		states = append(states, &client.CheckoutState{AllocID: parts[0], DatasetID: parts[2], Size: size})
+	}
+
+	free = int64(fs.Bavail)*int64(fs.Bsize) - m.Reserve
+	if free < 1 {
+		free = 1 //zero would tell the server that the worker doesn't account for disk
+	}
+
+	return free, states, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestCheckoutManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_checkouts_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	m := &CheckoutManager{ReplicaDir: filepath.Join(dir, "replicas"), CheckoutDir: filepath.Join(dir, "checkouts")}
+
+	//the first output of a dataset starts empty and creates its replica
+	cos, err := m.Prepare("a1", &client.Task{Outputs: []*client.TaskOutput{{DatasetID: "ds"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cos) != 1 || !cos[0].Output || cos[0].Parent != "" || cos[0].Branch != DefaultBranch {
+		t.Fatalf("expected an empty output on the default branch, got %+v", cos[0])
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(cos[0].Path, "data"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := m.Commit("a1", cos)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 1 || versions[0].Version == "" || versions[0].Parent != "" || versions[0].Size != 3 {
+		t.Fatalf("expected a first version of the output, got %+v", versions)
+	}
+
+	v1 := versions[0].Version
+	if err = m.Release("a1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(m.AllocDir("a1")); !os.IsNotExist(err) {
+		t.Fatalf("expected the checkouts of the alloc to be removed, got %v", err)
+	}
+
+	//inputs are materialised at their version, outputs continue from the head of their branch
+	cos, err = m.Prepare("a2", &client.Task{
+		Inputs:  []*client.DatasetVersion{{DatasetID: "ds", Version: v1}},
+		Outputs: []*client.TaskOutput{{DatasetID: "ds"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, out := cos[0], cos[1]
+	if data, err := ioutil.ReadFile(filepath.Join(in.Path, "data")); err != nil || string(data) != "foo" || in.Mount().Target != "/in/ds" || !in.Mount().ReadOnly {
+		t.Fatalf("expected the input at its version mounted read-only, got '%s' (%v) %+v", data, err, in.Mount())
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(out.Path, "data")); err != nil || string(data) != "foo" || out.Parent != v1 || out.Mount().ReadOnly {
+		t.Fatalf("expected the output to start from the head of its branch, got '%s' (%v) %+v", data, err, out)
+	}
+
+	if versions, err = m.Commit("a2", cos); err != nil || len(versions) != 0 {
+		t.Fatalf("expected an unchanged output to not be reported, got %+v (%v)", versions, err)
+	}
+
+	free, states, err := m.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if free < 1 || len(states) != 2 || states[0].AllocID != "a2" || states[0].DatasetID != "ds" || states[0].Size != 3 {
+		t.Fatalf("expected the checkouts of a2 to be reported, got %d free and %+v", free, states)
+	}
+
+	//a checkout that was prepared before another alloc moved the branch can't be committed
+	other, err := m.Prepare("a3", &client.Task{Outputs: []*client.TaskOutput{{DatasetID: "ds"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(out.Path, "data"), []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if versions, err = m.Commit("a2", cos); err != nil || len(versions) != 1 || versions[0].Parent != v1 {
+		t.Fatalf("expected a new version on top of the first, got %+v (%v)", versions, err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(other[0].Path, "data"), []byte("baz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = m.Commit("a3", other); err == nil {
+		t.Fatal("expected a commit on a branch that moved in the meantime to fail")
+	}
+
+	//a version that isn't replicated can't be prepared and leaves nothing behind
+	if _, err = m.Prepare("a4", &client.Task{Inputs: []*client.DatasetVersion{{DatasetID: "ds", Version: "0000000000000000000000000000000000000000"}}}); err == nil {
+		t.Fatal("expected a missing version to fail")
+	}
+
+	if _, err = os.Stat(m.AllocDir("a4")); !os.IsNotExist(err) {
+		t.Fatalf("expected a failed preparation to be cleaned up, got %v", err)
+	}
+
+	//dataset ids are path segments, anything that could escape the replica or checkout dir is refused
+	if _, err = m.Prepare("a5", &client.Task{Outputs: []*client.TaskOutput{{DatasetID: "../escaped"}}}); err == nil {
+		t.Fatal("expected a dataset id that is a path to be refused")
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "escaped.git")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be created outside the replica dir, got %v", err)
+	}
+}
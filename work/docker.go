@@ -0,0 +1,404 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//DockerAPIVersion is the version of the engine api that is used, it is the first that supports cpu limits
+const DockerAPIVersion = "v1.25"
+
+//DockerStopTimeout is how many seconds a container gets to exit after it was asked to stop before it is killed
+var DockerStopTimeout = 10
+
+//DockerError is returned when the engine api responds with an error
+type DockerError struct {
+	StatusCode int
+	Message    string `json:"message"`
+}
+
+func (e *DockerError) Error() string {
+	return fmt.Sprintf("docker responded with %d: %s", e.StatusCode, e.Message)
+}
+
+//dockerContainer is the part of an inspected container we care about
+type dockerContainer struct {
+	ID    string `json:"Id"`
+	State struct {
+		Running  bool `json:"Running"`
+		ExitCode int  `json:"ExitCode"`
+	} `json:"State"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+//DockerExecutor runs executions as containers by talking to the docker engine api over its unix socket
+type DockerExecutor struct {
+	client *http.Client
+}
+
+//NewDockerExecutor creates an executor that talks to the engine listening on the given unix socket
+func NewDockerExecutor(socket string) (e *DockerExecutor, err error) {
+	e = &DockerExecutor{client: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}}
+
+	if _, err = e.do("GET", "/_ping", nil, nil, nil); err != nil {
+		return nil, errors.Wrap(err, "failed to reach docker")
+	}
+
+	return e, nil
+}
+
+//Start creates a container that is labeled with its alloc and starts it, the image is pulled if it isn't present
+func (e *DockerExecutor) Start(spec *ExecSpec) (id string, err error) {
+	in := struct {
+		Image      string            `json:"Image"`
+		Cmd        []string          `json:"Cmd,omitempty"`
+		Env        []string          `json:"Env,omitempty"`
+		Labels     map[string]string `json:"Labels"`
+		HostConfig struct {
+			Binds      []string `json:"Binds,omitempty"`
+			Memory     int64    `json:"Memory,omitempty"`
+			MemorySwap int64    `json:"MemorySwap,omitempty"`
+			NanoCPUs   int64    `json:"NanoCpus,omitempty"`
+			CPUShares  int64    `json:"CpuShares,omitempty"`
+		} `json:"HostConfig"`
+	}{Image: spec.Image, Cmd: spec.Command, Labels: map[string]string{AllocLabel: spec.AllocID}}
+
+	for key, val := range spec.Env {
+		in.Env = append(in.Env, fmt.Sprintf("%s=%s", key, val))
+	}
+
+	for _, m := range spec.Mounts {
+		bind := fmt.Sprintf("%s:%s", m.Source, m.Target)
+		if m.ReadOnly {
+			bind = bind + ":ro"
+		}
+
+		in.HostConfig.Binds = append(in.HostConfig.Binds, bind)
+	}
+
+	//the quota caps the cpu time of a task, shares divide the cpus fairly when tasks compete. Swap is disabled such that the memory limit is a hard one
+	if spec.Limits != nil {
+		in.HostConfig.Memory = spec.Limits.MemoryMB * 1024 * 1024
+		in.HostConfig.MemorySwap = in.HostConfig.Memory
+		in.HostConfig.NanoCPUs = int64(spec.Limits.CPUs * 1e9)
+		in.HostConfig.CPUShares = int64(spec.Limits.CPUs * 1024)
+	}
+
+	out := struct {
+		ID string `json:"Id"`
+	}{}
+
+	_, err = e.do("POST", "/containers/create", nil, in, &out)
+	if derr, ok := err.(*DockerError); ok && derr.StatusCode == http.StatusNotFound {
+		if err = e.pull(spec.Image); err != nil {
+			return "", err
+		}
+
+		_, err = e.do("POST", "/containers/create", nil, in, &out)
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create container")
+	}
+
+	if _, err = e.do("POST", "/containers/"+out.ID+"/start", nil, nil, nil); err != nil {
+		e.Remove(out.ID)
+		return "", errors.Wrap(err, "failed to start container")
+	}
+
+	return out.ID, nil
+}
+
+//Wait follows the event stream until the container dies and then inspects its exit code. The stream is opened before the container is inspected so a container that dies in between isn't missed
+func (e *DockerExecutor) Wait(id string) (code int, err error) {
+	filters, err := json.Marshal(map[string][]string{
+		"type":      {"container"},
+		"container": {id},
+		"event":     {"die"},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to encode filters")
+	}
+
+	events, err := e.stream("GET", "/events", url.Values{"filters": {string(filters)}})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to follow events")
+	}
+
+	defer events.Close()
+	c, err := e.inspect(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.State.Running {
+		dec := json.NewDecoder(events)
+		ev := struct {
+			Action string `json:"Action"`
+		}{}
+
+		for ev.Action != "die" {
+			if err = dec.Decode(&ev); err != nil {
+				return 0, errors.Wrap(err, "failed to decode event")
+			}
+		}
+
+		if c, err = e.inspect(id); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.State.ExitCode, nil
+}
+
+//Inspect reads the state and alloc label of a container
+func (e *DockerExecutor) Inspect(id string) (status *ExecStatus, err error) {
+	c, err := e.inspect(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExecStatus{
+		ID:       c.ID,
+		AllocID:  c.Config.Labels[AllocLabel],
+		Running:  c.State.Running,
+		ExitCode: c.State.ExitCode,
+	}, nil
+}
+
+//Logs follows the timestamped output of a container until it exits, the stdout and stderr streams the engine multiplexes are merged
+func (e *DockerExecutor) Logs(id string, w io.Writer) error {
+	logs, err := e.stream("GET", "/containers/"+id+"/logs", url.Values{
+		"follow":     {"1"},
+		"stdout":     {"1"},
+		"stderr":     {"1"},
+		"timestamps": {"1"},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to follow logs")
+	}
+
+	defer logs.Close()
+	return demuxLogs(logs, w)
+}
+
+//CopyOut copies a file out of a container, the engine sends it as a tar archive
+func (e *DockerExecutor) CopyOut(id, path string, w io.Writer) (err error) {
+	archive, err := e.stream("GET", "/containers/"+id+"/archive", url.Values{"path": {path}})
+	if err != nil {
+		return errors.Wrap(err, "failed to copy from container")
+	}
+
+	defer archive.Close()
+	return untarFile(archive, w)
+}
+
+//Stop stops a running container, stopping a container that isn't running is not an error
+func (e *DockerExecutor) Stop(id string) error {
+	if _, err := e.do("POST", "/containers/"+id+"/stop", url.Values{"t": {fmt.Sprint(DockerStopTimeout)}}, nil, nil); err != nil {
+		return errors.Wrap(err, "failed to stop container")
+	}
+
+	return nil
+}
+
+//Remove forcefully removes a container and its anonymous volumes
+func (e *DockerExecutor) Remove(id string) error {
+	if _, err := e.do("DELETE", "/containers/"+id, url.Values{"force": {"1"}, "v": {"1"}}, nil, nil); err != nil {
+		return errors.Wrap(err, "failed to remove container")
+	}
+
+	return nil
+}
+
+//List inspects all containers that carry the alloc label, the list endpoint doesn't report exit codes
+func (e *DockerExecutor) List() (statuses []*ExecStatus, err error) {
+	filters, err := json.Marshal(map[string][]string{"label": {AllocLabel}})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode filters")
+	}
+
+	var cs []*dockerContainer
+	if _, err = e.do("GET", "/containers/json", url.Values{"all": {"1"}, "filters": {string(filters)}}, nil, &cs); err != nil {
+		return nil, errors.Wrap(err, "failed to list containers")
+	}
+
+	for _, c := range cs {
+		status, err := e.Inspect(c.ID)
+		if err == ErrExecutionNotExists {
+			continue //removed in the meantime
+		} else if err != nil {
+			return nil, err
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+//inspect returns the engine's view of a container
+func (e *DockerExecutor) inspect(id string) (c *dockerContainer, err error) {
+	c = &dockerContainer{}
+	_, err = e.do("GET", "/containers/"+id+"/json", nil, nil, c)
+	if derr, ok := err.(*DockerError); ok && derr.StatusCode == http.StatusNotFound {
+		return nil, ErrExecutionNotExists
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to inspect container")
+	}
+
+	return c, nil
+}
+
+//pull pulls an image, the engine reports failures in the progress it streams
+func (e *DockerExecutor) pull(image string) (err error) {
+	progress, err := e.stream("POST", "/images/create", url.Values{"fromImage": {image}})
+	if err != nil {
+		return errors.Wrapf(err, "failed to pull image '%s'", image)
+	}
+
+	defer progress.Close()
+	dec := json.NewDecoder(progress)
+	for {
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+
+		err = dec.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to decode pull progress")
+		}
+
+		if msg.Error != "" {
+			return errors.Errorf("failed to pull image '%s': %s", image, msg.Error)
+		}
+	}
+}
+
+//do sends a request with an optional json body and decodes the json response into out if it is given. Error responses are returned as a DockerError
+func (e *DockerExecutor) do(method, path string, query url.Values, in, out interface{}) (resp *http.Response, err error) {
+	var body io.Reader
+	if in != nil {
+		buf := bytes.NewBuffer(nil)
+		if err = json.NewEncoder(buf).Encode(in); err != nil {
+			return nil, errors.Wrap(err, "failed to encode request body")
+		}
+
+		body = buf
+	}
+
+	resp, err = e.request(method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if out != nil {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, errors.Wrap(err, "failed to decode response body")
+		}
+	}
+
+	return resp, nil
+}
+
+//stream sends a request and returns the response body for the caller to read and close
+func (e *DockerExecutor) stream(method, path string, query url.Values) (body io.ReadCloser, err error) {
+	resp, err := e.request(method, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+//request sends a request to the engine, responses with an error status are closed and returned as a DockerError
+func (e *DockerExecutor) request(method, path string, query url.Values, body io.Reader) (resp *http.Response, err error) {
+	loc := &url.URL{Scheme: "http", Host: "docker", Path: "/" + DockerAPIVersion + path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, loc.String(), body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err = e.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to perform request")
+	}
+
+	if resp.StatusCode > 299 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+		derr := &DockerError{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(data, derr) != nil || derr.Message == "" {
+			derr.Message = strings.TrimSpace(string(data))
+		}
+
+		return nil, derr
+	}
+
+	return resp, nil
+}
+
+//demuxLogs writes the payload of each frame of a multiplexed log stream, every frame starts with a header holding the stream it belongs to and the size of its payload
+func demuxLogs(r io.Reader, w io.Writer) error {
+	hdr := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, hdr)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read frame header")
+		}
+
+		if _, err = io.CopyN(w, r, int64(binary.BigEndian.Uint32(hdr[4:]))); err != nil {
+			return errors.Wrap(err, "failed to copy frame")
+		}
+	}
+}
+
+//untarFile writes the content of the first regular file in a tar archive
+func untarFile(r io.Reader, w io.Writer) (err error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("archive contains no file")
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read archive")
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if _, err = io.Copy(w, tr); err != nil {
+			return errors.Wrap(err, "failed to copy file")
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+//fakeEngine implements the parts of the docker engine api the executor uses, containers run until they are stopped
+type fakeEngine struct {
+	mu      sync.Mutex
+	pulled  map[string]bool
+	created map[string]map[string]interface{}
+	running map[string]bool
+	died    chan string
+}
+
+func (f *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+DockerAPIVersion)
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	id := ""
+	if len(parts) > 1 && parts[0] == "containers" {
+		id = parts[1]
+		if _, ok := f.created[id]; !ok && id != "create" && id != "json" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"message": "No such container: %s"}`, id)
+			return
+		}
+	}
+
+	switch {
+	case path == "/_ping":
+		fmt.Fprint(w, "OK")
+	case path == "/images/create":
+		f.pulled[r.URL.Query().Get("fromImage")] = true
+		fmt.Fprintln(w, `{"status": "Pulling"}`)
+	case path == "/containers/create":
+		in := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&in)
+		if !f.pulled[in["Image"].(string)] {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "No such image"}`)
+			return
+		}
+
+		id = fmt.Sprintf("c%d", len(f.created)+1)
+		f.created[id] = in
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id": %q}`, id)
+	case path == "/containers/json":
+		for id := range f.created {
+			fmt.Fprintf(w, `[{"Id": %q}]`, id)
+		}
+	case len(parts) == 3 && parts[2] == "start":
+		f.running[id] = true
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[2] == "stop":
+		if !f.running[id] {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		f.running[id] = false
+		f.died <- id
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[2] == "json":
+		labels, _ := json.Marshal(f.created[id]["Labels"])
+		code := 0
+		if !f.running[id] {
+			code = 137
+		}
+
+		fmt.Fprintf(w, `{"Id": %q, "State": {"Running": %t, "ExitCode": %d}, "Config": {"Labels": %s}}`, id, f.running[id], code, labels)
+	case len(parts) == 3 && parts[2] == "logs":
+		for i, line := range []string{"2017-01-01T00:00:00Z out\n", "2017-01-01T00:00:01Z err\n"} {
+			hdr := make([]byte, 8)
+			hdr[0] = byte(i + 1)
+			binary.BigEndian.PutUint32(hdr[4:], uint32(len(line)))
+			w.Write(append(hdr, line...))
+		}
+	case len(parts) == 3 && parts[2] == "archive":
+		tw := tar.NewWriter(w)
+		tw.WriteHeader(&tar.Header{Name: filepath.Base(r.URL.Query().Get("path")), Mode: 0644, Size: 3, Typeflag: tar.TypeReg})
+		tw.Write([]byte("foo"))
+		tw.Close()
+	case r.Method == "DELETE":
+		delete(f.created, id)
+		w.WriteHeader(http.StatusNoContent)
+	case path == "/events":
+		w.(http.Flusher).Flush()
+		f.mu.Unlock()
+		id := <-f.died //only the test's container dies
+		f.mu.Lock()
+		fmt.Fprintf(w, `{"Action": "die", "id": %q}`, id)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestDockerExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_docker_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine := &fakeEngine{
+		pulled:  map[string]bool{},
+		created: map[string]map[string]interface{}{},
+		running: map[string]bool{},
+		died:    make(chan string, 1),
+	}
+
+	srv := httptest.NewUnstartedServer(engine)
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	exe, err := NewDockerExecutor(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := exe.Start(&ExecSpec{
+		AllocID: "a1",
+		Image:   "busybox",
+		Mounts:  []Mount{{Source: "/tmp/in", Target: "/in/ds", ReadOnly: true}},
+		Limits:  &client.ResourceLimits{MemoryMB: 256, CPUs: 0.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !engine.pulled["busybox"] {
+		t.Error("expected the missing image to be pulled")
+	}
+
+	if binds := engine.created[id]["HostConfig"].(map[string]interface{})["Binds"].([]interface{}); binds[0] != "/tmp/in:/in/ds:ro" {
+		t.Errorf("expected read-only bind, got %v", binds)
+	}
+
+	hc := engine.created[id]["HostConfig"].(map[string]interface{})
+	if hc["Memory"] != float64(256<<20) || hc["MemorySwap"] != hc["Memory"] || hc["NanoCpus"] != 5e8 || hc["CpuShares"] != float64(512) {
+		t.Errorf("expected the limits to be applied to the container, got %v", hc)
+	}
+
+	if status, err := exe.Inspect(id); err != nil || !status.Running || status.AllocID != "a1" {
+		t.Fatalf("expected running container for a1, got %+v (%v)", status, err)
+	}
+
+	if statuses, err := exe.List(); err != nil || len(statuses) != 1 {
+		t.Fatalf("expected one managed container, got %+v (%v)", statuses, err)
+	}
+
+	codeCh := make(chan int)
+	go func() {
+		code, err := exe.Wait(id)
+		if err != nil {
+			t.Error(err)
+		}
+
+		codeCh <- code
+	}()
+
+	if err = exe.Stop(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := <-codeCh; code != 137 {
+		t.Fatalf("expected exit code 137, got %d", code)
+	}
+
+	if err = exe.Stop(id); err != nil {
+		t.Fatalf("expected stopping a stopped container to succeed, got %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = exe.Logs(id, buf); err != nil || buf.String() != "2017-01-01T00:00:00Z out\n2017-01-01T00:00:01Z err\n" {
+		t.Fatalf("expected demultiplexed logs, got '%s' (%v)", buf.String(), err)
+	}
+
+	buf.Reset()
+	if err = exe.CopyOut(id, "/out/ds/data", buf); err != nil || buf.String() != "foo" {
+		t.Fatalf("expected file content, got '%s' (%v)", buf.String(), err)
+	}
+
+	if err = exe.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = exe.Inspect(id); err != ErrExecutionNotExists {
+		t.Fatalf("expected container to be removed, got %v", err)
+	}
+}
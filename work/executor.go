@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//AllocLabel marks the executions that are managed by the worker with the alloc they run
+const AllocLabel = "line-alloc"
+
+//ErrExecutionNotExists is returned when an execution is not known to the executor
+var ErrExecutionNotExists = errors.New("execution doesn't exist")
+
+//Mount makes a directory on the host available to an execution
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+//ExecSpec describes what an executor should start for an alloc
+type ExecSpec struct {
+	AllocID string
+	Image   string
+	Command []string
+	Env     map[string]string
+	Mounts  []Mount
+	Limits  *client.ResourceLimits
+}
+
+//ExecStatus is the state of an execution
+type ExecStatus struct {
+	ID       string
+	AllocID  string
+	Running  bool
+	ExitCode int
+	Pid      int //process group of a process execution, zero for executions that outlive the worker on their own
+}
+
+//Executor runs the tasks of allocs, e.g. in containers or as local processes
+type Executor interface {
+
+	//Start starts an execution and returns its id without waiting for it to finish
+	Start(spec *ExecSpec) (id string, err error)
+
+	//Wait blocks until an execution finished and returns its exit code
+	Wait(id string) (code int, err error)
+
+	//Inspect returns the current state of an execution
+	Inspect(id string) (status *ExecStatus, err error)
+
+	//Logs writes the output of an execution to w until it finished, each line is prefixed with an RFC3339 timestamp and a space
+	Logs(id string, w io.Writer) error
+
+	//CopyOut writes the content of a file in the execution to w
+	CopyOut(id, path string, w io.Writer) error
+
+	//Stop stops an execution that is running
+	Stop(id string) error
+
+	//Remove removes an execution and its resources, running executions are killed
+	Remove(id string) error
+
+	//List returns the executions that are managed by the worker
+	List() (statuses []*ExecStatus, err error)
+}
+
+//FakeExecution is an execution of the fake executor, it runs until it is exited
+type FakeExecution struct {
+	Spec    *ExecSpec
+	Logs    []string
+	Files   map[string][]byte
+	Stopped bool
+
+	status *ExecStatus
+	done   chan struct{}
+}
+
+//FakeExecutor keeps executions in memory without running anything, tests decide when and how they exit
+type FakeExecutor struct {
+	mu    sync.Mutex
+	execs map[string]*FakeExecution
+	seq   int
+}
+
+//NewFakeExecutor creates an executor without executions
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{execs: map[string]*FakeExecution{}}
+}
+
+//Execution returns a started execution, or nil if it doesn't exist
+func (e *FakeExecutor) Execution(id string) *FakeExecution {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.execs[id]
+}
+
+//Exit finishes a running execution with the given output and exit code
+func (e *FakeExecutor) Exit(id string, code int, logs ...string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	exe, ok := e.execs[id]
+	if !ok {
+		return ErrExecutionNotExists
+	}
+
+	if !exe.status.Running {
+		return nil
+	}
+
+	exe.Logs = append(exe.Logs, logs...)
+	exe.status.Running = false
+	exe.status.ExitCode = code
+	close(exe.done)
+	return nil
+}
+
+//Start records the spec and returns a running execution
+func (e *FakeExecutor) Start(spec *ExecSpec) (id string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.seq++
+	id = fmt.Sprintf("fake-%d", e.seq)
+	e.execs[id] = &FakeExecution{
+		Spec:   spec,
+		Files:  map[string][]byte{},
+		status: &ExecStatus{ID: id, AllocID: spec.AllocID, Running: true},
+		done:   make(chan struct{}),
+	}
+
+	return id, nil
+}
+
+//Wait blocks until the execution is exited or stopped
+func (e *FakeExecutor) Wait(id string) (code int, err error) {
+	exe := e.Execution(id)
+	if exe == nil {
+		return 0, ErrExecutionNotExists
+	}
+
+	<-exe.done
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return exe.status.ExitCode, nil
+}
+
+//Inspect returns a copy of the execution's status
+func (e *FakeExecutor) Inspect(id string) (status *ExecStatus, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	exe, ok := e.execs[id]
+	if !ok {
+		return nil, ErrExecutionNotExists
+	}
+
+	cp := *exe.status
+	return &cp, nil
+}
+
+//Logs waits for the execution to finish and then writes its log lines
+func (e *FakeExecutor) Logs(id string, w io.Writer) error {
+	if _, err := e.Wait(id); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ts := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, line := range e.execs[id].Logs {
+		if _, err := fmt.Fprintf(w, "%s %s\n", ts, line); err != nil {
+			return errors.Wrap(err, "failed to write logs")
+		}
+	}
+
+	return nil
+}
+
+//CopyOut writes a file that was put in the execution's files
+func (e *FakeExecutor) CopyOut(id, path string, w io.Writer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	exe, ok := e.execs[id]
+	if !ok {
+		return ErrExecutionNotExists
+	}
+
+	data, ok := exe.Files[path]
+	if !ok {
+		return errors.Errorf("file '%s' doesn't exist", path)
+	}
+
+	_, err := io.Copy(w, bytes.NewReader(data))
+	return err
+}
+
+//Stop exits a running execution as docker would when it was killed
+func (e *FakeExecutor) Stop(id string) error {
+	exe := e.Execution(id)
+	if exe == nil {
+		return ErrExecutionNotExists
+	}
+
+	e.mu.Lock()
+	exe.Stopped = true
+	e.mu.Unlock()
+	return e.Exit(id, 137)
+}
+
+//Remove forgets an execution, running executions are stopped first
+func (e *FakeExecutor) Remove(id string) error {
+	if err := e.Stop(id); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.execs, id)
+	return nil
+}
+
+//List returns the status of all executions that weren't removed
+func (e *FakeExecutor) List() (statuses []*ExecStatus, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, exe := range e.execs {
+		cp := *exe.status
+		statuses = append(statuses, &cp)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+
+	return statuses, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFakeExecutor(t *testing.T) {
+	var exe Executor = NewFakeExecutor()
+	id, err := exe.Start(&ExecSpec{AllocID: "a1", Image: "busybox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := exe.Inspect(id); !status.Running || status.AllocID != "a1" {
+		t.Fatalf("expected a running execution for a1, got %+v", status)
+	}
+
+	exe.(*FakeExecutor).Exit(id, 3, "hello")
+	if code, err := exe.Wait(id); err != nil || code != 3 {
+		t.Fatalf("expected exit code 3, got %d (%v)", code, err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = exe.Logs(id, buf); err != nil || !strings.HasSuffix(buf.String(), " hello\n") {
+		t.Fatalf("expected timestamped log line, got '%s' (%v)", buf.String(), err)
+	}
+
+	if err = exe.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = exe.Inspect(id); err != ErrExecutionNotExists {
+		t.Fatalf("expected execution to be removed, got %v", err)
+	}
+}
+
+func TestProcessExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_exec_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "input")
+	if err = os.MkdirAll(in, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(in, "data"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exe, err := NewProcessExecutor(filepath.Join(dir, "execs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("LINE_AWS_SECRET_ACCESS_KEY", "secret") //the worker's environment must not leak into tasks
+	defer os.Unsetenv("LINE_AWS_SECRET_ACCESS_KEY")
+	id, err := exe.Start(&ExecSpec{
+		AllocID: "a1",
+		Command: []string{"/bin/sh", "-c", "cat in/ds/data; echo \" $GREETING$LINE_AWS_SECRET_ACCESS_KEY\"; exit 2"},
+		Env:     map[string]string{"GREETING": "bar"},
+		Mounts:  []Mount{{Source: in, Target: "/in/ds", ReadOnly: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = exe.Logs(id, buf); err != nil || !strings.HasSuffix(buf.String(), " foo bar\n") {
+		t.Fatalf("expected timestamped output, got '%s' (%v)", buf.String(), err)
+	}
+
+	if code, err := exe.Wait(id); err != nil || code != 2 {
+		t.Fatalf("expected exit code 2, got %d (%v)", code, err)
+	}
+
+	buf.Reset()
+	if err = exe.CopyOut(id, "in/ds/data", buf); err != nil || buf.String() != "foo" {
+		t.Fatalf("expected to copy the mounted file, got '%s' (%v)", buf.String(), err)
+	}
+
+	if statuses, _ := exe.List(); len(statuses) != 1 || statuses[0].Running {
+		t.Fatalf("expected one finished execution, got %+v", statuses)
+	}
+
+	if err = exe.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "execs", id)); !os.IsNotExist(err) {
+		t.Fatalf("expected execution directory to be removed, got %v", err)
+	}
+}
+
+func TestProcessExecutorKillOrphan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_exec_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	prev, err := NewProcessExecutor(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := prev.Start(&ExecSpec{AllocID: "a1", Command: []string{"sleep", "10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := prev.Inspect(id)
+	if err != nil || status.Pid < 1 {
+		t.Fatalf("expected the process group to be reported, got %+v (%v)", status, err)
+	}
+
+	//a restarted worker only knows the execution from its state file
+	exe, err := NewProcessExecutor(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = exe.KillOrphan("a1-2", status.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ = prev.Inspect(id); !status.Running {
+		t.Fatal("expected a process that belongs to another execution to be left alone")
+	}
+
+	if err = exe.KillOrphan(id, status.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, err := prev.Wait(id); err != nil || code != 128+9 {
+		t.Fatalf("expected the orphan to be killed, got %d (%v)", code, err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, id)); !os.IsNotExist(err) {
+		t.Fatalf("expected execution directory to be removed, got %v", err)
+	}
+}
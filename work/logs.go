@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//LogEvent is a line of output of an execution
+type LogEvent struct {
+	T    time.Time
+	Line string
+}
+
+//LogSink stores batches of log events in named streams, each execution ships to its own stream. Sinks are used by many executions at once
+type LogSink interface {
+
+	//Put stores events in a stream, the shipper retries batches that failed
+	Put(stream string, evs []*LogEvent) error
+
+	//Close releases the sink's resources after all streams were flushed
+	Close() error
+}
+
+const (
+	logBufSize      = 30
+	logBufTimeout   = time.Second * 5
+	logPutAttempts  = 3
+	logRetryBackoff = time.Second
+	logFlushTimeout = time.Second * 30
+	logMaxLineSize  = 1024 * 1024
+)
+
+//ShipLogs follows the output of an execution and ships it to a sink in batches until the execution finished or the context is done, buffered events are flushed either way. Lines up to the offset (in nanoseconds) were shipped before and are skipped, progress is called with the new offset after every batch that was put
+func ShipLogs(ctx context.Context, sink LogSink, exe Executor, stream, id string, offset int64, progress func(offset int64)) {
+	pr, pw := io.Pipe()
+	evCh := make(chan *LogEvent, logBufSize)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pr.Close() //stops the scanner, which closes the events channel
+		case <-done:
+		}
+	}()
+
+	go pipeLogs(exe, pw, id)
+	go func() {
+		pr.CloseWithError(scanLogs(pr, evCh, offset)) //unblocks the writer when scanning stopped early
+	}()
+	pushLogs(sink, evCh, stream, progress)
+}
+
+//pipeLogs writes the timestamped output of an execution to an I/O pipe for scanning, the pipe is closed when the execution finished
+func pipeLogs(exe Executor, w *io.PipeWriter, id string) {
+	err := exe.Logs(id, w) //blocks until the execution finished
+	if err != nil && errors.Cause(err) != io.ErrClosedPipe {
+		fmt.Fprintln(os.Stderr, "failed to follow logs:", err)
+	}
+
+	w.Close()
+}
+
+//scanLogs will read a stream of execution output and split and parse it into lines as log events that can be stored remotely. Lines written at or before the offset are skipped. Scanning stops at a line longer than the maximum, the error is returned
+func scanLogs(r io.Reader, evCh chan<- *LogEvent, offset int64) (err error) {
+	defer close(evCh)
+	logscan := bufio.NewScanner(r)
+	logscan.Buffer(make([]byte, 64*1024), logMaxLineSize)
+	for logscan.Scan() {
+		fields := strings.SplitN(logscan.Text(), " ", 2)
+		if len(fields) < 2 {
+			fmt.Fprintln(os.Stderr, "unexpected log line:", logscan.Text())
+			continue
+		}
+
+		if fields[1] == "" {
+			continue //ignore empty lines
+		}
+
+		ev := &LogEvent{Line: fields[1]}
+		if ev.T, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			fmt.Fprintln(os.Stderr, "unexpected time stamp:", err)
+			continue
+		}
+
+		if ev.T.UnixNano() <= offset {
+			continue //shipped before a restart
+		}
+
+		evCh <- ev
+	}
+
+	if err = logscan.Err(); err != nil && err != io.ErrClosedPipe {
+		fmt.Fprintln(os.Stderr, "failed to scan logs:", err)
+	}
+
+	return err
+}
+
+//pushLogs moves the actual log events to the sink, it is responsible for batching events together as to not run into throttling issues or keeping state too long. What is buffered is put when the events channel closes
+func pushLogs(sink LogSink, evCh <-chan *LogEvent, stream string, progress func(offset int64)) {
+	var batch []*LogEvent
+	put := func() {
+		if len(batch) < 1 {
+			return
+		}
+
+		var err error
+		for i := 0; i < logPutAttempts; i++ {
+			if i > 0 {
+				time.Sleep(logRetryBackoff * time.Duration(1<<uint(i-1)))
+			}
+
+			if err = sink.Put(stream, batch); err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to put %d log events to stream '%s': %+v\n", len(batch), stream, err)
+		} else if progress != nil {
+			progress(batch[len(batch)-1].T.UnixNano())
+		}
+
+		batch = nil
+	}
+
+	timer := time.NewTimer(logBufTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			put()
+			timer.Reset(logBufTimeout)
+		case ev, ok := <-evCh:
+			if !ok {
+				put() //send what is buffered when the execution is done
+				return
+			}
+
+			batch = append(batch, ev)
+			if len(batch) >= logBufSize {
+				put()
+			}
+		}
+	}
+}
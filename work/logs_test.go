@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//memSink keeps the events that were put in memory
+type memSink struct {
+	mu  sync.Mutex
+	evs map[string][]*LogEvent
+}
+
+func (s *memSink) Put(stream string, evs []*LogEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evs[stream] = append(s.evs[stream], evs...)
+	return nil
+}
+
+func (s *memSink) Close() error { return nil }
+
+func TestShipLogsFlushesOnExit(t *testing.T) {
+	exe := NewFakeExecutor()
+	id, _ := exe.Start(&ExecSpec{AllocID: "a1"})
+	exe.Exit(id, 0, "one", "two", "three")
+
+	sink := &memSink{evs: map[string][]*LogEvent{}}
+	ShipLogs(context.Background(), sink, exe, "a1-w1", id, 0, nil)
+	if evs := sink.evs["a1-w1"]; len(evs) != 3 || evs[2].Line != "three" {
+		t.Fatalf("expected all lines to be flushed, got %+v", evs)
+	}
+}
+
+func TestShipLogsFlushesOnShutdown(t *testing.T) {
+	exe := NewFakeExecutor()
+	id, _ := exe.Start(&ExecSpec{AllocID: "a1"}) //never exits
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ShipLogs(ctx, &memSink{evs: map[string][]*LogEvent{}}, exe, "a1-w1", id, 0, nil)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected shipping to stop when the context is done")
+	}
+}
+
+//followedExecutor reports when following the logs of an execution stopped
+type followedExecutor struct {
+	Executor
+	followed chan error
+}
+
+func (e *followedExecutor) Logs(id string, w io.Writer) error {
+	err := e.Executor.Logs(id, w)
+	e.followed <- err
+	return err
+}
+
+func TestShipLogsStopsFollowingOnTooLongLines(t *testing.T) {
+	fake := NewFakeExecutor()
+	id, _ := fake.Start(&ExecSpec{AllocID: "a1"})
+	fake.Exit(id, 0, "one", strings.Repeat("x", logMaxLineSize+1), "two")
+
+	exe := &followedExecutor{Executor: fake, followed: make(chan error, 1)}
+	sink := &memSink{evs: map[string][]*LogEvent{}}
+	ShipLogs(context.Background(), sink, exe, "a1-w1", id, 0, nil)
+	if evs := sink.evs["a1-w1"]; len(evs) != 1 || evs[0].Line != "one" {
+		t.Fatalf("expected the lines before the long one to be shipped, got %+v", evs)
+	}
+
+	select {
+	case err := <-exe.followed:
+		if errors.Cause(err) != bufio.ErrTooLong {
+			t.Fatalf("expected following to stop with the scan error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected following the logs to stop when scanning stopped")
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_logs_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	sink, err := NewFileSink(dir, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err = sink.Put("a1-w1", []*LogEvent{{T: time.Now(), Line: "a line of output that is long enough"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "a1-w1.log*"))
+	if len(files) != 3 {
+		t.Fatalf("expected the current file and two rotated ones, got %v", files)
+	}
+
+	for _, f := range files {
+		if fi, _ := os.Stat(f); fi.Size() > 100 {
+			t.Errorf("expected '%s' to be rotated before it grew past 100 bytes, got %d", f, fi.Size())
+		}
+	}
+}
+
+func TestScanLogsSkipsShippedLines(t *testing.T) {
+	evCh := make(chan *LogEvent, 3)
+	scanLogs(strings.NewReader("2017-01-01T00:00:01Z one\n2017-01-01T00:00:02Z two\n2017-01-01T00:00:03Z three\n"), evCh, time.Date(2017, 1, 1, 0, 0, 2, 0, time.UTC).UnixNano())
+
+	var lines []string
+	for ev := range evCh {
+		lines = append(lines, ev.Line)
+	}
+
+	if len(lines) != 1 || lines[0] != "three" {
+		t.Fatalf("expected only the line after the offset, got %v", lines)
+	}
+}
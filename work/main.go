@@ -1,81 +1,92 @@
 package main
 
 import (
-	"archive/tar"
-	"bufio"
-	"bytes"
-	"crypto/sha1"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strconv"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
-	"github.com/aws/aws-sdk-go/service/sfn"
-	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/kelseyhightower/envconfig"
-	"github.com/nerdalize/nerd/nerd/payload"
+	"github.com/microfactory/line/line/client"
 	"github.com/pkg/errors"
 )
 
-//TaskStatus describes the container status of a task
-type TaskStatus struct {
-	TaskContainer
-	code   int      //exit code
-	err    error    //application error
-	mounts []string //mount ids
-}
-
-//TaskLogEvent is a log event for a certain task container
-type TaskLogEvent struct {
-	*TaskContainer
-	t   time.Time
-	msg string
-}
-
-//TaskContainer is a unique execution for a specific task
-type TaskContainer struct {
-	cid   string //container id
-	tid   string //task id
-	pid   string //project id
-	token string //activity token
-}
-
 //Conf holds our configuration taken from the environment
 type Conf struct {
-	Deployment         string `envconfig:"DEPLOYMENT"`
-	StateMachineARN    string `envconfig:"STATE_MACHINE_ARN"`
-	RunActivityARN     string `envconfig:"RUN_ACTIVITY_ARN"`
-	WorkersTableName   string `envconfig:"TABLE_WORKERS_NAME"`
-	WorkersTableCapIdx string `envconfig:"TABLE_WORKERS_IDX_CAP"`
-	AWSAccessKeyID     string `envconfig:"AWS_ACCESS_KEY_ID"`
-	AWSSecretAccessKey string `envconfig:"AWS_SECRET_ACCESS_KEY"`
-	AWSRegion          string `envconfig:"AWS_REGION"`
-	PoolQueueURL       string `envconfig:"POOL_QUEUE_URL"`
+	Endpoint           string            `envconfig:"ENDPOINT"` //url of the line server
+	PoolID             string            `envconfig:"POOL_ID"`
+	Capacity           int               `envconfig:"CAPACITY" default:"5"`
+	ReserveCPUs        float64           `envconfig:"RESERVE_CPUS"`
+	ReserveMemoryMB    int64             `envconfig:"RESERVE_MEMORY_MB" default:"512"`
+	ReserveDisk        int64             `envconfig:"RESERVE_DISK" default:"1073741824"` //bytes of the checkout file system kept free
+	Zone               string            `envconfig:"ZONE"`
+	Labels             map[string]string `envconfig:"LABELS"`
+	HeartbeatInterval  time.Duration     `envconfig:"HEARTBEAT_INTERVAL" default:"10s"`
+	AWSAccessKeyID     string            `envconfig:"AWS_ACCESS_KEY_ID"`
+	AWSSecretAccessKey string            `envconfig:"AWS_SECRET_ACCESS_KEY"`
+	AWSRegion          string            `envconfig:"AWS_REGION"`
+	LogSink            string            `envconfig:"LOG_SINK"`       //either 'line', 'cloudwatch', 'file', 'stdout' or 'http', defaults to cloudwatch when a log group is set and line otherwise
+	LogGroupName       string            `envconfig:"LOG_GROUP_NAME"` //cloudwatch log group task output is shipped to
+	LogDir             string            `envconfig:"LOG_DIR" default:"/var/log/line"`
+	LogMaxBytes        int64             `envconfig:"LOG_MAX_BYTES" default:"10485760"` //size at which log files are rotated
+	LogMaxFiles        int               `envconfig:"LOG_MAX_FILES" default:"5"`
+	LogURL             string            `envconfig:"LOG_URL"` //endpoint that batches of task output are posted to
+	ReplicaDir         string            `envconfig:"REPLICA_DIR" default:"/var/lib/line/replicas"`
+	ReplicaMaxBytes    int64             `envconfig:"REPLICA_MAX_BYTES"`
+	ReplicaAddr        string            `envconfig:"REPLICA_ADDR"`     //address to serve replicas to peers on, replicas are served without authentication so it must only be bound to a private network
+	ReplicaEndpoint    string            `envconfig:"REPLICA_ENDPOINT"` //url at which peers reach the replica server
+	CheckoutDir        string            `envconfig:"CHECKOUT_DIR" default:"/var/lib/line/checkouts"`
+	Executor           string            `envconfig:"EXECUTOR" default:"docker"` //either 'docker' or 'process'
+	ExecutionDir       string            `envconfig:"EXECUTION_DIR" default:"/var/lib/line/executions"`
+	DockerSocket       string            `envconfig:"DOCKER_SOCKET" default:"/var/run/docker.sock"`
+	StateFile          string            `envconfig:"STATE_FILE" default:"/var/lib/line/worker.json"` //allocs are resumed from it after a restart
+	ShutdownGrace      time.Duration     `envconfig:"SHUTDOWN_GRACE" default:"30s"`                   //time running allocs get to finish on shutdown, the rest is stopped and scheduled again
 }
 
-//Worker configures the process that pulls tasks if necessary
+//Worker runs the allocs the server places on it
 type Worker struct {
-	LogGroupName string
-	WorkerID     string
-	QueueURL     string
+	conf      *Conf
+	client    *client.Client
+	sink      LogSink
+	shipping  sync.WaitGroup
+	exec      Executor
+	replicas  *ReplicaCache
+	checkouts *CheckoutManager
+	agent     *client.Agent
+	state     *StateFile
+
+	saveMu sync.Mutex
+	mu     sync.Mutex
+	runs   map[string]*Run
+	active int //runs that are not completed yet, including the completion request
+}
+
+//Run is an alloc that is being executed by the worker, it is persisted in the state file
+type Run struct {
+	Alloc     *client.Alloc `json:"alloc"`
+	ExecID    string        `json:"exec_id,omitempty"`    //id of the execution, once started
+	Pid       int           `json:"pid,omitempty"`        //process group of a process execution, killed when a restarted worker can't resume it
+	Started   int64         `json:"started,omitempty"`    //unix time at which the execution started
+	Checkouts []*Checkout   `json:"checkouts,omitempty"`  //checkouts that are mounted into the execution
+	LogOffset int64         `json:"log_offset,omitempty"` //time in nanoseconds of the last line that was shipped
+	Stopped   bool          `json:"-"`                    //the server no longer knows the alloc, it is not completed
+	Lost      bool          `json:"-"`                    //the worker shuts down, if the alloc doesn't finish it is completed as lost
 }
 
 func main() {
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
 	conf := &Conf{}
@@ -84,11 +95,6 @@ func main() {
 		log.Fatal("failed to process env config", zap.Error(err))
 	}
 
-	worker := &Worker{
-		LogGroupName: "foobar",
-		QueueURL:     conf.PoolQueueURL,
-	}
-
 	var sess *session.Session
 	if sess, err = session.NewSession(
 		&aws.Config{
@@ -103,397 +109,656 @@ func main() {
 		log.Fatal("failed to setup aws session", zap.Error(err))
 	}
 
-	messages := sqs.New(sess)
-	states := sfn.New(sess)
-	cwatch := cloudwatchlogs.New(sess)
+	worker, err := NewWorker(conf, sess)
+	if err != nil {
+		log.Fatal("failed to setup worker", zap.Error(err))
+	}
+
+	//serve local replicas to peers, they fetch from us before falling back to the upstream remote
+	if conf.ReplicaAddr != "" {
+		go func() {
+			err := http.ListenAndServe(conf.ReplicaAddr, &ReplicaServer{Dir: conf.ReplicaDir})
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "replica server stopped:", err)
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = worker.Recover(ctx); err != nil {
+		log.Fatal("failed to recover worker state", zap.Error(err))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- worker.agent.Run(ctx)
+	}()
+
+	select {
+	case err = <-done:
+		log.Fatal("failed to run worker", zap.Error(err))
+	case <-sigCh:
+	}
+
+	//a second signal skips the rest of the shutdown, what is left to do the server finds out when the worker expires
+	go func() {
+		<-sigCh
+		os.Exit(1)
+	}()
+
+	worker.Drain(conf.ShutdownGrace)
+	cancel() //heartbeats stop
+	<-done
+
+	worker.Close()
+	if err = worker.Deregister(); err != nil {
+		log.Fatal("failed to deregister worker", zap.Error(err))
+	}
+}
+
+//NewWorker sets up a worker that runs tasks with the configured executor and an agent that feeds it allocs
+func NewWorker(conf *Conf, sess *session.Session) (w *Worker, err error) {
+	w = &Worker{
+		conf:      conf,
+		checkouts: &CheckoutManager{ReplicaDir: conf.ReplicaDir, CheckoutDir: conf.CheckoutDir, Reserve: conf.ReserveDisk},
+		state:     &StateFile{Path: conf.StateFile},
+		runs:      map[string]*Run{},
+	}
+
+	switch conf.Executor {
+	case "docker":
+		w.exec, err = NewDockerExecutor(conf.DockerSocket)
+	case "process":
+		w.exec, err = NewProcessExecutor(conf.ExecutionDir)
+	default:
+		err = errors.Errorf("unknown executor '%s'", conf.Executor)
+	}
 
-	//for now, we just parse use the docker cli
-	exe, err := exec.LookPath("docker")
 	if err != nil {
-		log.Fatal(err)
+		return nil, errors.Wrap(err, "failed to setup executor")
 	}
 
-	//this function in run concurrently for each task container and writes output from 'docker log' to an I/O pipe for scanning and event handling
-	pipeLogs := func(w io.Writer, tc TaskContainer) {
-		args := []string{"logs", "-f", "-t", tc.cid}
-		cmd := exec.Command(exe, args...)
-		cmd.Stdout = w
-		cmd.Stderr = w
-		err = cmd.Run() //blocks until command ends
+	if w.client, err = client.NewClient(conf.Endpoint, sess); err != nil {
+		return nil, errors.Wrap(err, "failed to setup client")
+	}
+
+	switch conf.LogSink {
+	case "line":
+		w.sink = NewLineSink(w.client, conf.PoolID, w.WorkerID)
+	case "cloudwatch":
+		w.sink = NewCloudWatchSink(cloudwatchlogs.New(sess), conf.LogGroupName)
+	case "file":
+		w.sink, err = NewFileSink(conf.LogDir, conf.LogMaxBytes, conf.LogMaxFiles)
+	case "stdout":
+		w.sink = NewJSONSink(os.Stdout)
+	case "http":
+		w.sink = NewHTTPSink(conf.LogURL)
+	case "":
+		w.sink = NewLineSink(w.client, conf.PoolID, w.WorkerID)
+		if conf.LogGroupName != "" {
+			w.sink = NewCloudWatchSink(cloudwatchlogs.New(sess), conf.LogGroupName)
+		}
+	default:
+		err = errors.Errorf("unknown log sink '%s'", conf.LogSink)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to setup log sink")
+	}
+
+	if w.replicas, err = NewReplicaCache(conf.ReplicaDir, conf.ReplicaMaxBytes); err != nil {
+		return nil, errors.Wrap(err, "failed to setup replica cache")
+	}
+
+	space, _, err := w.checkouts.Usage()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to determine checkout space")
+	}
+
+	res := DetectResources().Reserve(conf.ReserveCPUs, conf.ReserveMemoryMB)
+	w.agent = client.NewAgent(w.client, &client.RegisterWorkerInput{
+		PoolID:   conf.PoolID,
+		Capacity: conf.Capacity,
+		Labels:   conf.Labels,
+		Zone:     conf.Zone,
+		Endpoint: conf.ReplicaEndpoint,
+		Space:    space,
+		CPUs:     res.CPUs,
+		MemoryMB: res.MemoryMB,
+	})
+
+	w.agent.Interval = conf.HeartbeatInterval
+	w.agent.HandleAlloc = w.Run
+	w.agent.PrepareHeartbeat = w.prepareHeartbeat
+	w.agent.HandleHeartbeat = w.handleHeartbeat
+	w.agent.StopAlloc = w.stop
+	w.agent.HandleError = func(err error) {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+	}
+
+	w.agent.Registered = func(out *client.RegisterWorkerOutput) {
+		w.save() //allocs that resume after a restart are reported by this registration
+	}
+
+	w.agent.Completed = func(in *client.CompleteAllocInput, err error) {
 		if err != nil {
-			fmt.Println("err starting log pipe", err)
-			//@TODO error following logs
+			fmt.Fprintf(os.Stderr, "failed to complete alloc %s: %+v\n", in.AllocID, err)
 		}
+	}
 
-		//@TODO main routine signals will also cancel, so the cancelling routine could wait for us to send remaining stuff over.
+	for _, datasetID := range w.replicas.Datasets() {
+		w.agent.AddDataset(datasetID)
 	}
 
-	//scanLogs will read a stream container output and split and parsed it into lines as log events that can be stored remotely.
-	scanLogs := func(r io.Reader, evCh chan<- TaskLogEvent, tc TaskContainer) {
-		logscan := bufio.NewScanner(r)
-		for logscan.Scan() {
-			fields := strings.SplitN(logscan.Text(), " ", 2)
-			if len(fields) < 2 {
-				fmt.Println("unexpected log line:", logscan.Text())
-				//@TODO show error that log line was not of expected format
-				continue
-			}
+	return w, nil
+}
 
-			if fields[1] == "" {
-				continue //ignore empty lines
-			}
+//Drain stops receiving allocs and gives the allocs that are running the grace period to finish. Allocs that are still running after it are stopped and completed as lost, such that the server schedules them again
+func (w *Worker) Drain(grace time.Duration) {
+	w.agent.Drain()
+	if w.waitRuns(grace) {
+		return
+	}
 
-			ev := TaskLogEvent{TaskContainer: &tc, msg: fields[1]}
-			if ev.t, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
-				fmt.Println("unexpected time stamp: ", err)
-				//@TODO handle error better
-				continue
-			}
+	var ids []string
+	w.mu.Lock()
+	for _, run := range w.runs {
+		run.Lost = true
+		if run.ExecID != "" {
+			ids = append(ids, run.ExecID)
+		}
+	}
+	w.mu.Unlock()
 
-			evCh <- ev
+	for _, id := range ids {
+		if err := w.exec.Stop(id); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to stop execution %s: %+v\n", id, err)
 		}
-		if err := logscan.Err(); err != nil {
-			fmt.Fprintln(os.Stderr, "failed to scan logs:", err)
+	}
+
+	if !w.waitRuns(logFlushTimeout) {
+		fmt.Fprintln(os.Stderr, "not all allocs were completed before shutdown")
+	}
+}
+
+//waitRuns waits at most the timeout for all runs to be completed, it returns whether they were
+func (w *Worker) waitRuns(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		w.mu.Lock()
+		active := w.active
+		w.mu.Unlock()
+		if active < 1 {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
 		}
+
+		time.Sleep(100 * time.Millisecond)
 	}
+}
 
-	//pushLogs moves the actual log events to the platform it is responsible for batching events together as to not run into throttling issues or keeping state too long
-	bufTimeout := time.Second * 5
-	bufSize := 30
-	pushLogs := func(evCh <-chan TaskLogEvent, group, stream string) {
-		logsEvIn := &cloudwatchlogs.PutLogEventsInput{}
-		put := func() {
-			if logsEvIn.LogGroupName == nil {
-				if _, err = cwatch.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
-					LogGroupName:  aws.String(group),
-					LogStreamName: aws.String(stream),
-				}); err != nil {
-					//@TODO better error handling
-					// fmt.Println("failed to create stream:", err)
-					return
-				}
+//Deregister leaves the pool, the state no longer holds a registration that is resumed on the next start
+func (w *Worker) Deregister() (err error) {
+	if err = w.agent.Deregister(); err != nil {
+		return err
+	}
 
-				logsEvIn.SetLogGroupName(group)
-				logsEvIn.SetLogStreamName(stream)
-			}
+	w.save()
+	return nil
+}
 
-			var out *cloudwatchlogs.PutLogEventsOutput
-			if out, err = cwatch.PutLogEvents(logsEvIn); err != nil {
-				//@TODO what if put logs fails?
-				fmt.Println("put logs failed:", err)
-				return
-			}
+//Close waits for the logs that are being shipped to be flushed and closes the log sink
+func (w *Worker) Close() {
+	flushed := make(chan struct{})
+	go func() {
+		w.shipping.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+	case <-time.After(logFlushTimeout):
+		fmt.Fprintln(os.Stderr, "not all logs were flushed before shutdown")
+	}
 
-			logsEvIn.LogEvents = nil
-			logsEvIn.SequenceToken = out.NextSequenceToken
+	if w.sink != nil {
+		if err := w.sink.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to close log sink: %+v\n", err)
 		}
+	}
+}
 
-		for {
-			to := time.After(bufTimeout)
-			select {
-			//@TODO send buffered logs when shutting down
-			case <-to:
-				if len(logsEvIn.LogEvents) > 0 {
-					put()
-				}
-			case ev := <-evCh:
-				logsEvIn.LogEvents = append(logsEvIn.LogEvents, &cloudwatchlogs.InputLogEvent{
-					Timestamp: aws.Int64(ev.t.UnixNano() / 1000 / 1000), //only milliseconds are accepted (visible)
-					Message:   aws.String(fmt.Sprintf(`{"t": %d, "line": "%s"}`, ev.t.UnixNano(), ev.msg)),
-				})
-
-				if len(logsEvIn.LogEvents) >= bufSize {
-					put()
+//WorkerID returns the id the worker is currently registered with
+func (w *Worker) WorkerID() string {
+	if worker := w.agent.Worker(); worker != nil {
+		return worker.WorkerID
+	}
+
+	return ""
+}
+
+//Run executes an alloc and completes it with its outcome
+func (w *Worker) Run(ctx context.Context, alloc *client.Alloc) {
+	run := &Run{Alloc: alloc}
+	w.mu.Lock()
+	w.runs[alloc.AllocID] = run
+	w.active++
+	w.mu.Unlock()
+	w.save()
+
+	var err error
+	var code int
+	var outputs []*client.DatasetVersion
+	if alloc.Replication != nil {
+		err = w.replicate(alloc)
+	} else {
+		code, outputs, err = w.execute(ctx, run)
+	}
+
+	w.complete(run, code, outputs, err)
+}
+
+//Recover loads the state of a previous process. The registration is resumed, allocs whose execution is still known to the executor are followed again and others are completed as failed. Executions of allocs that aren't in the state are removed
+func (w *Worker) Recover(ctx context.Context) (err error) {
+	st, err := w.state.Load()
+	if err != nil {
+		return err
+	}
+
+	if st.Worker != nil {
+		w.agent.Resume(st.Worker)
+	}
+
+	statuses, err := w.exec.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list executions")
+	}
+
+	execs := map[string]*ExecStatus{}
+	for _, status := range statuses {
+		execs[status.ID] = status
+	}
+
+	w.mu.Lock()
+	for allocID, run := range st.Runs {
+		w.runs[allocID] = run
+		w.active++
+		w.agent.Track(allocID)
+	}
+	w.mu.Unlock()
+
+	for _, run := range st.Runs {
+		status, ok := execs[run.ExecID]
+		if !ok || status.AllocID != run.Alloc.AllocID {
+			if pe, ok := w.exec.(*ProcessExecutor); ok && run.Pid > 0 {
+				if err = pe.KillOrphan(run.ExecID, run.Pid); err != nil {
+					fmt.Fprintf(os.Stderr, "failed to kill orphaned execution %s: %+v\n", run.ExecID, err)
 				}
 			}
+
+			//the alloc didn't fail by itself, the server schedules it again
+			w.mu.Lock()
+			run.Lost = true
+			w.mu.Unlock()
+			go w.complete(run, 0, nil, errors.New("interrupted by a restart of the worker"))
+			continue
 		}
+
+		delete(execs, run.ExecID)
+		go func(run *Run) {
+			code, outputs, err := w.finish(ctx, run)
+			w.complete(run, code, outputs, err)
+		}(run)
 	}
 
-	//the logging routine takes a containers found in the listing and fans out into a routine for each container that is resposible for shipping logs to the platform
-	containerCh := make(chan TaskContainer)
-	go func() {
-		containers := map[string]io.Reader{}
-		for taskc := range containerCh {
-			//if the container wasn't seen before we setup a logging pipeline
-			if _, ok := containers[taskc.cid]; !ok {
-				groupName := worker.LogGroupName
-				streamName := fmt.Sprintf("%s-%s-%s", taskc.tid, worker.WorkerID, taskc.cid)
-
-				//@TODO create a remote log stream for first sequence token
-				evCh := make(chan TaskLogEvent, bufSize)
-				pr, pw := io.Pipe()
-				containers[taskc.cid] = pr
-				go pipeLogs(pw, taskc)
-				go scanLogs(pr, evCh, taskc)
-				go pushLogs(evCh, groupName, streamName)
-			}
+	for id := range execs {
+		if err = w.exec.Remove(id); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to remove unknown execution %s: %+v\n", id, err)
 		}
-	}()
+	}
 
-	//receive tasks from the message queue and start the container run loop, it will attemp to create containers for tasks unconditionally if it keeps failing queue retry will backoff. If it succeeds, fails the feedback loop will notify
-	cap := 5
-	capCh := make(chan struct{}, cap)
-	go func() {
-		for range capCh {
-			var out *sqs.ReceiveMessageOutput
-			if out, err = messages.ReceiveMessage(&sqs.ReceiveMessageInput{
-				QueueUrl:            aws.String(worker.QueueURL),
-				WaitTimeSeconds:     aws.Int64(0),
-				MaxNumberOfMessages: aws.Int64(1),
-			}); err != nil {
-				fmt.Fprintf(os.Stderr, "failed to receive message: %+v", err)
-				//@TODO report async errors
-				return
-			}
+	return nil
+}
 
-			if len(out.Messages) > 0 {
-				for _, msg := range out.Messages {
-					task := &payload.Task{}
-					if err = json.Unmarshal([]byte(aws.StringValue(msg.Body)), task); err != nil {
-
-						//@TODO throw deserialization errors
-						fmt.Fprintf(os.Stderr, "failed to deserialize: %+v", err)
-						return
-					}
-
-					//@TODO execute a pre-run heartbeat to prevent starting containers for delayed but outdated task tokens. if the heartbeat returns a timed out error don't attempt to start it: (dont forget to delete the message)
-
-					fmt.Fprintf(os.Stderr, "starting task: %s, token: %x\n", task.TaskID, sha1.Sum([]byte(task.ActivityToken)))
-					args := []string{
-						"run", "-d",
-						//@TODO add logging to aws
-						fmt.Sprintf("--name=task-%x", sha1.Sum([]byte(task.ActivityToken))),
-						fmt.Sprintf("--label=nerd-project=%s", task.ProjectID),
-						fmt.Sprintf("--label=nerd-task=%s", task.TaskID),
-						fmt.Sprintf("--label=nerd-token=%s", task.ActivityToken),
-						fmt.Sprintf("-v=/in"), fmt.Sprintf("-v=/out"),
-						fmt.Sprintf("-e=NERD_PROJECT_ID=%s", task.ProjectID),
-						fmt.Sprintf("-e=NERD_TASK_ID=%s", task.TaskID),
-					}
-
-					if task.InputID != "" {
-						args = append(args, fmt.Sprintf("-e=NERD_DATASET_INPUT=%s", task.InputID))
-					}
-
-					for key, val := range task.Environment {
-						args = append(args, fmt.Sprintf("-e=%s=%s", key, val))
-					}
-
-					go func(msg *sqs.Message) {
-						args = append(args, task.Image)
-						cmd := exec.Command(exe, args...)
-						cmd.Stderr = os.Stderr
-						_ = cmd.Run() //any result is ok
-
-						//delete message, state is persisted in Docker, it is no longer relevant
-						if _, err := messages.DeleteMessage(&sqs.DeleteMessageInput{
-							QueueUrl:      aws.String(worker.QueueURL),
-							ReceiptHandle: msg.ReceiptHandle,
-						}); err != nil {
-							//@TODO error on return error
-							fmt.Fprintf(os.Stderr, "failed to delete message: %+v", err)
-							return
-						}
-					}(msg)
-				}
-			}
+//complete forgets a run and reports its outcome to the server, unless the server already forgot about it
+func (w *Worker) complete(run *Run, code int, outputs []*client.DatasetVersion, err error) {
+	in := &client.CompleteAllocInput{
+		PoolID:   run.Alloc.PoolID,
+		AllocID:  run.Alloc.AllocID,
+		Outcome:  client.AllocOutcomeSucceeded,
+		ExitCode: code,
+		Outputs:  outputs,
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "alloc %s failed: %+v\n", in.AllocID, err)
+		in.Outcome = client.AllocOutcomeFailed
+		if in.ExitCode == 0 {
+			in.ExitCode = 255
 		}
+	} else if in.ExitCode != 0 {
+		in.Outcome = client.AllocOutcomeFailed
+	}
+
+	if run.Alloc.Task != nil && run.Alloc.Replication == nil {
+		w.removeCheckouts(run.Alloc) //also releases the disk space of runs that were interrupted
+	}
+
+	w.mu.Lock()
+	delete(w.runs, in.AllocID)
+	stopped := run.Stopped
+	if run.Lost && in.Outcome == client.AllocOutcomeFailed {
+		in.Outcome = client.AllocOutcomeLost //stopped because the worker shuts down
+	}
+	w.mu.Unlock()
+	w.save()
+
+	defer func() {
+		w.mu.Lock()
+		w.active--
+		w.mu.Unlock()
 	}()
 
-	//the container loop feeds running task tokens to the feedback loop by polling the `docker ps` output
-	pr, pw := io.Pipe()
-	psTicker := time.NewTicker(time.Second * 5)
-	go func() {
-		for range psTicker.C {
-			args := []string{"ps", "-a",
-				"--no-trunc",
-				"--filter=label=nerd-token",
-				"--format={{.ID}}\t{{.Status}}\t{{.Label \"nerd-token\"}}\t{{.Label \"nerd-project\"}}\t{{.Label \"nerd-task\"}}\t{{.Mounts}}",
-			}
+	if stopped {
+		return //the server already forgot about the alloc
+	}
 
-			buf := bytes.NewBuffer(nil)
+	w.agent.Complete(in) //failures are reported by the completion hook
+}
 
-			cmd := exec.Command(exe, args...)
-			cmd.Stdout = io.MultiWriter(pw, buf)
-			cmd.Stderr = os.Stderr
-			err = cmd.Run()
-			if err != nil {
-				//@TODO handle errors
-				fmt.Fprintln(os.Stderr, "failed to list containers: ", err)
-				continue
-			}
+//save persists the registration and runs, failures are reported but don't stop the worker
+func (w *Worker) save() {
+	w.saveMu.Lock()
+	defer w.saveMu.Unlock()
 
-			n := bytes.Count(buf.Bytes(), []byte{'\n'})
-			for i := (cap - n); i > 0; i-- {
-				capCh <- struct{}{}
-			}
+	st := &WorkerState{Worker: w.agent.Worker(), Runs: map[string]*Run{}}
+	w.mu.Lock()
+	for allocID, run := range w.runs {
+		cp := *run
+		st.Runs[allocID] = &cp
+	}
+	w.mu.Unlock()
+
+	if err := w.state.Save(st); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save worker state: %+v\n", err)
+	}
+}
+
+//stop stops the execution of an alloc the server no longer knows about, it won't be completed
+func (w *Worker) stop(allocID string) {
+	w.mu.Lock()
+	run := w.runs[allocID]
+	if run != nil {
+		run.Stopped = true
+	}
+	w.mu.Unlock()
+
+	if run != nil && run.ExecID != "" {
+		if err := w.exec.Stop(run.ExecID); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to stop alloc %s: %+v\n", allocID, err)
 		}
-	}()
+	}
+}
 
-	//the scan loop will parse docker states into exit statuses
-	scanner := bufio.NewScanner(pr)
-	statusCh := make(chan TaskStatus)
-	go func() {
-		for scanner.Scan() {
-			fields := strings.SplitN(scanner.Text(), "\t", 6)
-			if len(fields) != 6 {
-				// statusCh <- TaskStatus{TaskContainer{fields[0], fields[4], fields[3], fields[2]}, 255, errors.New("unexpected ps line")}
-				continue //less then 2 fields, shouldnt happen, and unable to scope error the o project/task/token
-			}
+//replicate clones a dataset from peers or its remote
+func (w *Worker) replicate(alloc *client.Alloc) (err error) {
+	datasetID := alloc.Replication.DatasetID
+	w.replicas.Acquire(datasetID)
+	defer w.replicas.Release(datasetID)
 
-			//fields: | cid | status | token | project | task | mounts |
-			taskc := TaskContainer{fields[0], fields[4], fields[3], fields[2]}
-
-			//we would like to start routines that pipe log lines to cloudwatch
-
-			//second field can be interpreted by reversing state .String() https://github.com/docker/docker/blob/b59ee9486fad5fa19f3d0af0eb6c5ce100eae0fc/container/state.go#L70
-			status := fields[1]
-			if strings.HasPrefix(status, "Up") || strings.HasPrefix(status, "Restarting") || status == "Removal In Progress" || status == "Created" {
-				//container is not yet "done": still in progress without statuscode, send heartbeat and continue to next tick
-				statusCh <- TaskStatus{taskc, -1, nil, strings.Split(fields[5], ",")}
-				continue
-			} else {
-				//container has "exited" or is "dead"
-				if status == "Dead" {
-					//@See https://github.com/docker/docker/issues/5684
-					// There is also a new(ish) container state called "dead", which is set when there were issues removing the container. This is of course a work around for this particular issue, which lets you go and investigate why there is the device or resource busy error (probably a race condition), in which case you can attempt to remove again, or attempt to manually fix (e.g. unmount any left-over mounts, and then remove).
-					statusCh <- TaskStatus{taskc, 255, errors.New("failed to remove container"), strings.Split(fields[5], ",")}
-					continue
-
-				} else if strings.HasPrefix(status, "Exited") {
-					right := strings.TrimPrefix(status, "Exited (")
-					lefts := strings.SplitN(right, ")", 2)
-					if len(lefts) != 2 {
-						statusCh <- TaskStatus{taskc, 255, errors.New("unexpected exited format: " + status), strings.Split(fields[5], ",")}
-						continue
-					}
-
-					//write actual status code, can be zero in case of success
-					code, err := strconv.Atoi(lefts[0])
-					if err != nil {
-						statusCh <- TaskStatus{taskc, 255, errors.New("unexpected status code, not a number: " + status), strings.Split(fields[5], ",")}
-						continue
-					} else {
-						statusCh <- TaskStatus{taskc, code, nil, strings.Split(fields[5], ",")}
-						continue
-					}
-
-				} else {
-					statusCh <- TaskStatus{taskc, 255, errors.New("unexpected status: " + status), strings.Split(fields[5], ",")}
-					continue
-				}
-			}
+	srcs, err := w.sources(alloc.PoolID, datasetID, "")
+	if err != nil {
+		return err
+	}
+
+	if len(srcs) < 1 && alloc.Replication.Remote != "" {
+		srcs = []string{alloc.Replication.Remote}
+	}
+
+	if _, err = SyncReplica(w.conf.ReplicaDir, datasetID, "", w.replicas.Depth(datasetID), srcs); err != nil {
+		return err
+	}
+
+	w.agent.AddDataset(datasetID)
+	return nil
+}
+
+//execute prepares the checkouts of an alloc and starts its task, it then finishes the execution as a resumed one would
+func (w *Worker) execute(ctx context.Context, run *Run) (code int, outputs []*client.DatasetVersion, err error) {
+	alloc := run.Alloc
+	task := alloc.Task
+	if task == nil || task.Image == "" {
+		return 0, nil, errors.New("alloc has no task to run")
+	}
+
+	defer w.acquire(task)()
+	for _, in := range task.Inputs {
+		if hasCommit(ReplicaPath(w.conf.ReplicaDir, in.DatasetID), in.Version) {
+			continue
 		}
-		if err := scanner.Err(); err != nil {
-			//@TODO handle scanniong IO errors
-			fmt.Fprintln(os.Stderr, "reading standard input:", err)
+
+		srcs, err := w.sources(alloc.PoolID, in.DatasetID, in.Version)
+		if err != nil {
+			return 0, nil, err
 		}
-	}()
 
-	//the feedback loop holds a view of task states and tokens
-	for {
-		select {
-		case <-sigCh: //exit our main loop
-			return
-		case statusEv := <-statusCh: //sync docker status
-
-			//container is in a state we understand, pass on the container fanout logic
-			containerCh <- statusEv.TaskContainer
-			fmt.Fprintf(os.Stderr, "task-%x is %d\n", sha1.Sum([]byte(statusEv.token)), statusEv.code)
-
-			var err error
-			if statusEv.code < 0 {
-				fmt.Fprintln(os.Stderr, "heartbeat!")
-				_, err = states.SendTaskHeartbeat(&sfn.SendTaskHeartbeatInput{
-					TaskToken: aws.String(statusEv.token),
-				})
-			} else if statusEv.code == 0 {
-
-				//we're gonna read the output id from a file inside the container using the `docker cp` command and trusting that when successfull an output dataset id was written in the correct location.
-				idbuf := bytes.NewBuffer(nil)
-				var outdata []byte
-				func() { //new scope to prevent err shadowing
-
-					tarbuf := bytes.NewBuffer(nil)
-					outcmd := exec.Command(exe, "cp", fmt.Sprintf("%s:/out/.dataset", statusEv.cid), "-")
-					outcmd.Stdout = tarbuf
-					err := outcmd.Run()
-					if err != nil {
-						fmt.Println("failed to run dataset cp", err)
-					}
-
-					tr := tar.NewReader(tarbuf)
-					for {
-						_, err := tr.Next()
-						if err == io.EOF {
-							break // end of tar archive
-						}
-
-						if _, err := io.Copy(idbuf, tr); err != nil {
-							log.Println("failed to read tar file")
-							continue
-						}
-					}
-
-					if idbuf.Len() == 0 {
-						fmt.Fprint(idbuf, "d-ffffffff")
-					}
-
-					if outdata, err = json.Marshal(&payload.TaskResult{
-						ProjectID:  statusEv.pid,
-						TaskID:     statusEv.tid,
-						OutputID:   strings.TrimSpace(idbuf.String()),
-						ExitStatus: fmt.Sprintf("Exit Status: %d", statusEv.code),
-					}); err != nil {
-						fmt.Println("failed to marshal task result: ", err)
-						return
-					}
-				}()
-
-				//success
-				fmt.Fprintln(os.Stderr, "success!")
-				_, err = states.SendTaskSuccess(&sfn.SendTaskSuccessInput{
-					TaskToken: aws.String(statusEv.token),
-					Output:    aws.String(string(outdata)),
-				})
-
-			} else {
-				//failure
-				fmt.Fprintln(os.Stderr, "failed!")
-				//@TODO dont send cause if .err is nil
-				_, err = states.SendTaskFailure(&sfn.SendTaskFailureInput{
-					TaskToken: aws.String(statusEv.token),
-					Error:     aws.String(fmt.Sprintf(`{"error": "%d"}`, statusEv.code)),
-					Cause:     aws.String(fmt.Sprintf(`{"cause": "%v"}`, statusEv.err)),
-				})
-			}
+		if _, err = SyncReplica(w.conf.ReplicaDir, in.DatasetID, in.Version, w.replicas.Depth(in.DatasetID), srcs); err != nil {
+			return 0, nil, errors.Wrapf(err, "failed to sync input '%s'", in.DatasetID)
+		}
 
-			if err != nil {
-				aerr, ok := err.(awserr.Error)
-				if !ok {
-					fmt.Println("unexpected non-aws error:", err)
-					//@TODO not an aws error, connection issues or otherwise, do not undertake an specific action maybe next time it will be better
-					continue
-				}
+		w.agent.AddDataset(in.DatasetID)
+	}
 
-				if aerr.Code() == sfn.ErrCodeTaskTimedOut {
-					fmt.Println("aws err:", aerr)
-					cmd := exec.Command(exe, "stop", statusEv.cid)
-					err = cmd.Run()
-					if err != nil {
-						fmt.Println("failed to stop task container:", statusEv.cid, statusEv.code, err)
-						//@TODO report error
-					}
-
-					cmd = exec.Command(exe, "rm", statusEv.cid)
-					err = cmd.Run()
-					if err != nil {
-						fmt.Println("failed to remove timed out task container:", statusEv.cid, statusEv.code, err)
-						//@TODO report error
-					}
-				}
+	cos, err := w.checkouts.Prepare(alloc.AllocID, task)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to prepare checkouts")
+	}
+
+	spec := &ExecSpec{
+		AllocID: alloc.AllocID,
+		Image:   task.Image,
+		Command: task.Command,
+		Limits:  task.Limits,
+		Env: map[string]string{
+			"LINE_ALLOC_ID": alloc.AllocID,
+			"LINE_EVAL_ID":  alloc.EvalID,
+		},
+	}
+
+	if alloc.ParentEvalID != "" {
+		spec.Env["LINE_PARENT_EVAL_ID"] = alloc.ParentEvalID
+		spec.Env["LINE_INDEX"] = strconv.Itoa(alloc.Index)
+	}
+
+	for _, co := range cos {
+		spec.Mounts = append(spec.Mounts, co.Mount())
+	}
+
+	for key, val := range alloc.Params {
+		spec.Env["LINE_PARAM_"+key] = val
+	}
+
+	for key, val := range task.Env {
+		spec.Env[key] = val
+	}
+
+	w.mu.Lock()
+	lost := run.Lost
+	w.mu.Unlock()
+	if lost {
+		return 0, nil, errors.New("worker shuts down before the task started")
+	}
+
+	id, err := w.exec.Start(spec)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "failed to start execution")
+	}
+
+	var pid int
+	if status, err := w.exec.Inspect(id); err == nil {
+		pid = status.Pid
+	}
+
+	w.mu.Lock()
+	run.ExecID, run.Pid, run.Started, run.Checkouts = id, pid, time.Now().Unix(), cos
+	lost = run.Lost
+	w.mu.Unlock()
+	w.save()
+
+	if lost {
+		w.exec.Stop(id) //the worker started to shut down while the execution started
+	}
+
+	return w.finish(ctx, run)
+}
+
+//finish ships the output of a started execution, waits for it to exit and commits its outputs if it exited successfully. The execution is removed afterwards
+func (w *Worker) finish(ctx context.Context, run *Run) (code int, outputs []*client.DatasetVersion, err error) {
+	alloc, task, id := run.Alloc, run.Alloc.Task, run.ExecID
+	defer w.acquire(task)()
+	defer w.exec.Remove(id)
+
+	if w.sink != nil {
+		shipped := make(chan struct{})
+		w.shipping.Add(1)
+		go func() {
+			defer w.shipping.Done()
+			defer close(shipped)
+			ShipLogs(ctx, w.sink, w.exec, alloc.AllocID, id, run.LogOffset, func(offset int64) {
+				w.mu.Lock()
+				run.LogOffset = offset
+				w.mu.Unlock()
+				w.save()
+			})
+		}()
+
+		//the execution is only removed after its output was shipped
+		defer func() {
+			select {
+			case <-shipped:
+			case <-time.After(logFlushTimeout):
+				fmt.Fprintf(os.Stderr, "alloc %s is removed before its logs were shipped\n", alloc.AllocID)
 			}
+		}()
+	}
+
+	//tasks that run past their timeout are stopped, which makes waiting return. Resumed tasks get what is left of it
+	if task.Timeout > 0 {
+		left := time.Unix(run.Started+task.Timeout, 0).Sub(time.Now())
+		timer := time.AfterFunc(left, func() {
+			fmt.Fprintf(os.Stderr, "alloc %s timed out, stopping execution\n", alloc.AllocID)
+			w.exec.Stop(id)
+		})
+
+		defer timer.Stop()
+	}
+
+	if code, err = w.exec.Wait(id); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to wait for execution")
+	}
+
+	if code != 0 {
+		return code, nil, nil
+	}
+
+	if outputs, err = w.checkouts.Commit(alloc.AllocID, run.Checkouts); err != nil {
+		return 0, nil, errors.Wrap(err, "failed to commit outputs")
+	}
+
+	return 0, outputs, nil
+}
+
+//acquire keeps the replicas of the inputs and outputs of a task around while the alloc runs, the returned function releases them
+func (w *Worker) acquire(task *client.Task) (release func()) {
+	var datasets []string
+	for _, in := range task.Inputs {
+		datasets = append(datasets, in.DatasetID)
+	}
+
+	for _, out := range task.Outputs {
+		datasets = append(datasets, out.DatasetID)
+	}
+
+	for _, datasetID := range datasets {
+		w.replicas.Acquire(datasetID)
+	}
+
+	return func() {
+		for _, datasetID := range datasets {
+			w.replicas.Release(datasetID)
 		}
 	}
+}
 
+//sources asks the server for peers to fetch a dataset from
+func (w *Worker) sources(poolID, datasetID, version string) (srcs []string, err error) {
+	out, err := w.client.GetReplicaPeers(&client.GetReplicaPeersInput{
+		PoolID:    poolID,
+		WorkerID:  w.WorkerID(),
+		DatasetID: datasetID,
+		Version:   version,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get replica peers")
+	}
+
+	return FetchSources(out), nil
+}
+
+//removeCheckouts removes the checkouts of an alloc and releases the disk space that was reserved for them
+func (w *Worker) removeCheckouts(alloc *client.Alloc) {
+	if err := w.checkouts.Release(alloc.AllocID); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to remove checkouts of alloc %s: %+v\n", alloc.AllocID, err)
+		return
+	}
+
+	if _, err := w.client.RemoveCheckout(&client.RemoveCheckoutInput{
+		PoolID:   alloc.PoolID,
+		WorkerID: w.WorkerID(),
+		AllocID:  alloc.AllocID,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to release checkout space of alloc %s: %+v\n", alloc.AllocID, err)
+	}
+}
+
+//prepareHeartbeat adds the state of local replicas and checkouts to a heartbeat
+func (w *Worker) prepareHeartbeat(in *client.SendHeartbeatInput) {
+	for _, datasetID := range in.Datasets {
+		state, versions, err := LocalReplicaState(w.conf.ReplicaDir, datasetID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read replica '%s': %+v\n", datasetID, err)
+			continue
+		}
+
+		in.Replicas = append(in.Replicas, state)
+		in.Versions = append(in.Versions, versions...)
+	}
+
+	var err error
+	if in.Space, in.Checkouts, err = w.checkouts.Usage(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to determine checkout usage: %+v\n", err)
+	}
+}
+
+//handleHeartbeat evicts replicas as the server asked or when they take too much space
+func (w *Worker) handleHeartbeat(out *client.SendHeartbeatOutput) {
+	w.replicas.Update(out)
+	removed, err := w.replicas.Evict()
+	for _, datasetID := range removed {
+		w.agent.RemoveDataset(datasetID)
+		if _, rerr := w.client.RemoveReplica(&client.RemoveReplicaInput{
+			PoolID:    w.conf.PoolID,
+			WorkerID:  w.WorkerID(),
+			DatasetID: datasetID,
+		}); rerr != nil {
+			fmt.Fprintf(os.Stderr, "failed to report removed replica '%s': %+v\n", datasetID, rerr)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to evict replicas: %+v\n", err)
+	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestDrainCompletesStoppedAllocsAsLost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_drain_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	outcomes := map[string]string{}
+	deregistered := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/CompleteAlloc":
+			in := &client.CompleteAllocInput{}
+			json.NewDecoder(r.Body).Decode(in)
+			outcomes[in.AllocID] = in.Outcome
+		case "/DeregisterWorker":
+			deregistered = true
+		}
+
+		fmt.Fprintln(w, "{}")
+	}))
+
+	defer srv.Close()
+	c, err := client.NewClient(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exe := NewFakeExecutor()
+	done, _ := exe.Start(&ExecSpec{AllocID: "a1"})
+	running, _ := exe.Start(&ExecSpec{AllocID: "a2"})
+
+	w := &Worker{
+		client:    c,
+		exec:      exe,
+		checkouts: &CheckoutManager{ReplicaDir: filepath.Join(dir, "replicas"), CheckoutDir: filepath.Join(dir, "checkouts")},
+		state:     &StateFile{Path: filepath.Join(dir, "worker.json")},
+		agent:     client.NewAgent(c, &client.RegisterWorkerInput{PoolID: "p1"}),
+		runs:      map[string]*Run{},
+	}
+
+	if err = w.state.Save(&WorkerState{
+		Worker: &client.RegisterWorkerOutput{PoolID: "p1", WorkerID: "w1"},
+		Runs: map[string]*Run{
+			"a1": {Alloc: &client.Alloc{PoolID: "p1", AllocID: "a1", Task: &client.Task{}}, ExecID: done},
+			"a2": {Alloc: &client.Alloc{PoolID: "p1", AllocID: "a2", Task: &client.Task{}}, ExecID: running},
+			"a3": {Alloc: &client.Alloc{PoolID: "p1", AllocID: "a3", Task: &client.Task{}}, ExecID: "gone"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Recover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	exe.Exit(done, 0)
+	time.Sleep(200 * time.Millisecond)
+	w.Drain(10 * time.Millisecond)
+
+	mu.Lock()
+	if outcomes["a1"] != client.AllocOutcomeSucceeded || outcomes["a2"] != client.AllocOutcomeLost || outcomes["a3"] != client.AllocOutcomeLost {
+		t.Fatalf("expected the finished alloc to succeed and the stopped and interrupted ones to be lost, got %v", outcomes)
+	}
+	mu.Unlock()
+
+	if exe.Execution(running) != nil {
+		t.Error("expected the stopped execution to be removed")
+	}
+
+	if err = w.Deregister(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := w.state.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !deregistered || st.Worker != nil || len(st.Runs) != 0 {
+		t.Fatalf("expected the worker to deregister and forget its registration, got %+v", st)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//ProcessStopTimeout is how long a process gets to exit after it was asked to stop before it is killed
+var ProcessStopTimeout = 10 * time.Second
+
+//process is an execution of the process executor
+type process struct {
+	status *ExecStatus
+	root   string
+	cmd    *exec.Cmd
+	done   chan struct{}
+}
+
+//ProcessExecutor runs executions as local processes for hosts without a container runtime. The image and resource limits are ignored, the command is run from a directory in which the mounts are linked at their target path so tasks can use relative paths such as 'in/<dataset>'
+type ProcessExecutor struct {
+	Dir string
+
+	mu    sync.Mutex
+	procs map[string]*process
+	seq   int
+}
+
+//NewProcessExecutor creates an executor that keeps the directories of its executions in dir
+func NewProcessExecutor(dir string) (e *ProcessExecutor, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create execution directory")
+	}
+
+	return &ProcessExecutor{Dir: dir, procs: map[string]*process{}}, nil
+}
+
+//Start links the mounts into a new directory and starts the command there in its own process group
+func (e *ProcessExecutor) Start(spec *ExecSpec) (id string, err error) {
+	if len(spec.Command) < 1 {
+		return "", errors.New("no command to run")
+	}
+
+	e.mu.Lock()
+	e.seq++
+	id = fmt.Sprintf("%s-%d", spec.AllocID, e.seq)
+	e.mu.Unlock()
+
+	p := &process{
+		status: &ExecStatus{ID: id, AllocID: spec.AllocID, Running: true},
+		root:   filepath.Join(e.Dir, id, "root"),
+		done:   make(chan struct{}),
+	}
+
+	if err = os.MkdirAll(p.root, 0755); err != nil {
+		return "", errors.Wrap(err, "failed to create root")
+	}
+
+	for _, m := range spec.Mounts {
+		target := filepath.Join(p.root, strings.TrimPrefix(m.Target, "/"))
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", errors.Wrapf(err, "failed to create parent of mount '%s'", m.Target)
+		}
+
+		if err = os.Symlink(m.Source, target); err != nil {
+			return "", errors.Wrapf(err, "failed to link mount '%s'", m.Target)
+		}
+	}
+
+	logs, err := os.Create(filepath.Join(e.Dir, id, "log"))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create log file")
+	}
+
+	out := &timestampWriter{w: logs}
+	p.cmd = exec.Command(spec.Command[0], spec.Command[1:]...)
+	p.cmd.Dir = p.root
+	p.cmd.Stdout = out
+	p.cmd.Stderr = out
+	p.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	p.cmd.Env = []string{fmt.Sprintf("LINE_ROOT=%s", p.root)} //the worker's own environment holds its credentials, tasks don't get it
+	for _, key := range []string{"PATH", "HOME"} {
+		if val, ok := os.LookupEnv(key); ok {
+			p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("%s=%s", key, val))
+		}
+	}
+
+	for key, val := range spec.Env {
+		p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("%s=%s", key, val))
+	}
+
+	if err = p.cmd.Start(); err != nil {
+		logs.Close()
+		return "", errors.Wrap(err, "failed to start process")
+	}
+
+	e.mu.Lock()
+	p.status.Pid = p.cmd.Process.Pid
+	e.procs[id] = p
+	e.mu.Unlock()
+
+	go func() {
+		code := exitCode(p.cmd.Wait())
+		out.Flush()
+		logs.Close()
+
+		e.mu.Lock()
+		p.status.Running = false
+		p.status.ExitCode = code
+		e.mu.Unlock()
+		close(p.done)
+	}()
+
+	return id, nil
+}
+
+//Wait blocks until the process exited
+func (e *ProcessExecutor) Wait(id string) (code int, err error) {
+	p, err := e.process(id)
+	if err != nil {
+		return 0, err
+	}
+
+	<-p.done
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return p.status.ExitCode, nil
+}
+
+//Inspect returns a copy of the process' status
+func (e *ProcessExecutor) Inspect(id string) (status *ExecStatus, err error) {
+	p, err := e.process(id)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cp := *p.status
+	return &cp, nil
+}
+
+//Logs follows the log file of the process until it exited
+func (e *ProcessExecutor) Logs(id string, w io.Writer) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(e.Dir, id, "log"))
+	if err != nil {
+		return errors.Wrap(err, "failed to open log file")
+	}
+
+	defer f.Close()
+	for {
+		select {
+		case <-p.done:
+			_, err = io.Copy(w, f) //the rest of the output
+			return err
+		default:
+		}
+
+		n, err := io.Copy(w, f)
+		if err != nil {
+			return errors.Wrap(err, "failed to copy logs")
+		}
+
+		if n == 0 {
+			select {
+			case <-p.done:
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}
+}
+
+//CopyOut copies a file relative to the directory the process runs in, following the linked mounts
+func (e *ProcessExecutor) CopyOut(id, path string, w io.Writer) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(p.root, filepath.Clean("/"+path)))
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+
+	defer f.Close()
+	if _, err = io.Copy(w, f); err != nil {
+		return errors.Wrap(err, "failed to copy file")
+	}
+
+	return nil
+}
+
+//Stop terminates the process group and kills it when it doesn't exit in time
+func (e *ProcessExecutor) Stop(id string) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	pgid := -p.cmd.Process.Pid
+	if err = syscall.Kill(pgid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return errors.Wrap(err, "failed to terminate process")
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(ProcessStopTimeout):
+		if err = syscall.Kill(pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return errors.Wrap(err, "failed to kill process")
+		}
+
+		<-p.done
+	}
+
+	return nil
+}
+
+//Remove kills the process if it still runs and removes its directory
+func (e *ProcessExecutor) Remove(id string) error {
+	p, err := e.process(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-p.done:
+	default:
+		if err = syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return errors.Wrap(err, "failed to kill process")
+		}
+
+		<-p.done
+	}
+
+	if err = os.RemoveAll(filepath.Join(e.Dir, id)); err != nil {
+		return errors.Wrap(err, "failed to remove execution directory")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.procs, id)
+	return nil
+}
+
+//KillOrphan kills the process group of an execution that was started by a previous worker process and removes its directory. The process is only killed if its environment shows it still is that execution, a pid that was reused by the host is left alone
+func (e *ProcessExecutor) KillOrphan(id string, pid int) error {
+	env, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err == nil && bytes.Contains(env, []byte(fmt.Sprintf("LINE_ROOT=%s\x00", filepath.Join(e.Dir, id, "root")))) {
+		if err = syscall.Kill(-pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return errors.Wrap(err, "failed to kill orphaned process")
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read environment of orphaned process")
+	}
+
+	if err = os.RemoveAll(filepath.Join(e.Dir, id)); err != nil {
+		return errors.Wrap(err, "failed to remove execution directory")
+	}
+
+	return nil
+}
+
+//List returns the status of all processes that weren't removed
+func (e *ProcessExecutor) List() (statuses []*ExecStatus, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, p := range e.procs {
+		cp := *p.status
+		statuses = append(statuses, &cp)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].ID < statuses[j].ID
+	})
+
+	return statuses, nil
+}
+
+//process returns a started process
+func (e *ProcessExecutor) process(id string) (p *process, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p, ok := e.procs[id]
+	if !ok {
+		return nil, ErrExecutionNotExists
+	}
+
+	return p, nil
+}
+
+//exitCode turns the error of waiting for a process into an exit code, processes that were killed by a signal exit with 128 plus the signal as they would in a shell
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 255
+	}
+
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return exitErr.ExitCode()
+}
+
+//timestampWriter prefixes each line that is written with the time it was written at
+type timestampWriter struct {
+	w   io.Writer
+	mu  sync.Mutex
+	buf []byte
+}
+
+//Write writes all complete lines and buffers the rest
+func (tw *timestampWriter) Write(p []byte) (n int, err error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.buf = append(tw.buf, p...)
+	for {
+		i := bytes.IndexByte(tw.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		if _, err = fmt.Fprintf(tw.w, "%s %s", time.Now().UTC().Format(time.RFC3339Nano), tw.buf[:i+1]); err != nil {
+			return 0, err
+		}
+
+		tw.buf = tw.buf[i+1:]
+	}
+}
+
+//Flush writes what is left of an unterminated line
+func (tw *timestampWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if len(tw.buf) > 0 {
+		fmt.Fprintf(tw.w, "%s %s\n", time.Now().UTC().Format(time.RFC3339Nano), tw.buf)
+		tw.buf = nil
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//ReplicaRepoExp matches the first path segment of a request for a replica's bare repository
+var ReplicaRepoExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*\.git$`)
+
+//DatasetIDExp matches the dataset ids the server accepts, ids are used as path segments so anything else is refused
+var DatasetIDExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+
+//ReplicaServer serves the bare repositories in Dir read-only over git's smart http protocol such that peers can fetch from it. Requests are not authenticated, it must only be reachable from a private network
+type ReplicaServer struct {
+	Dir string
+}
+
+//ServeHTTP only allows fetching, anything that would push to a replica is refused
+func (srv *ReplicaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if !ReplicaRepoExp.MatchString(parts[0]) || strings.Contains(r.URL.Path, "..") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/git-receive-pack") || r.URL.Query().Get("service") == "git-receive-pack" {
+		http.Error(w, "replicas are read-only", http.StatusForbidden)
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(srv.Dir, parts[0])); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	exe, err := exec.LookPath("git")
+	if err != nil {
+		http.Error(w, "git is not available", http.StatusInternalServerError)
+		return
+	}
+
+	h := &cgi.Handler{
+		Path: exe,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + srv.Dir,
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+
+	h.ServeHTTP(w, r)
+}
+
+//ReplicaPath returns the location of a dataset's bare repository
+func ReplicaPath(dir, datasetID string) string {
+	return filepath.Join(dir, datasetID+".git")
+}
+
+//FetchSources returns the urls to fetch a dataset from in order of preference: peers that hold the version, then the other peers and the upstream remote last
+func FetchSources(out *client.GetReplicaPeersOutput) (srcs []string) {
+	for _, peer := range out.Peers {
+		srcs = append(srcs, peer.URL)
+	}
+
+	if out.Remote != "" {
+		srcs = append(srcs, out.Remote)
+	}
+
+	return srcs
+}
+
+//SyncReplica fetches a dataset into its local bare repository from the first source that provides the version, it returns the source that was used. A positive depth only fetches that many of the most recent versions of each branch, unless a version is required
+func SyncReplica(dir, datasetID, version string, depth int, srcs []string) (src string, err error) {
+	if strings.HasPrefix(version, "-") {
+		return "", errors.Errorf("invalid version '%s'", version)
+	}
+
+	if !DatasetIDExp.MatchString(datasetID) {
+		return "", errors.Errorf("invalid dataset id '%s'", datasetID)
+	}
+
+	repo := ReplicaPath(dir, datasetID)
+	if _, err = os.Stat(repo); os.IsNotExist(err) {
+		if err = git("", "init", "--bare", repo); err != nil {
+			return "", errors.Wrap(err, "failed to init replica")
+		}
+	} else if err != nil {
+		return "", errors.Wrap(err, "failed to stat replica")
+	}
+
+	if version != "" && hasCommit(repo, version) {
+		return "", nil //nothing to fetch
+	}
+
+	var errs []string
+	for _, src = range srcs {
+		if strings.HasPrefix(src, "-") {
+			errs = append(errs, fmt.Sprintf("%s: not a valid source", src)) //would be taken as an option by git
+			continue
+		}
+
+		//a required version may be older than the depth allows, its history is fetched in full instead
+		args := []string{"fetch", "--quiet"}
+		if version == "" && depth > 0 {
+			args = append(args, fmt.Sprintf("--depth=%d", depth))
+		} else if version != "" && isShallow(repo) {
+			args = append(args, "--unshallow")
+		}
+
+		err = git(repo, append(args, "--", src, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")...)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src, err))
+			continue
+		}
+
+		if version == "" || hasCommit(repo, version) {
+			return src, nil
+		}
+
+		errs = append(errs, fmt.Sprintf("%s: doesn't provide version '%s'", src, version))
+	}
+
+	return "", errors.Errorf("failed to fetch dataset '%s' from any of %d sources: %s", datasetID, len(srcs), strings.Join(errs, "; "))
+}
+
+//isShallow returns whether the repository was fetched with a limited depth
+func isShallow(repo string) bool {
+	_, err := os.Stat(filepath.Join(repo, "shallow"))
+	return err == nil
+}
+
+//hasCommit returns whether the repository holds the commit, anything that looks like an option is never a commit
+func hasCommit(repo, commit string) bool {
+	if strings.HasPrefix(commit, "-") {
+		return false
+	}
+
+	return git(repo, "cat-file", "-e", commit+"^{commit}") == nil
+}
+
+//git runs a git command, optionally against a bare repository, without ever prompting for credentials
+func git(repo string, args ...string) (err error) {
+	_, err = gitOutput(gitCmd(repo, args...))
+	return err
+}
+
+//gitCmd prepares a git command, optionally against a bare repository
+func gitCmd(repo string, args ...string) *exec.Cmd {
+	if repo != "" {
+		args = append([]string{"--git-dir", repo}, args...)
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+//gitOutput runs a prepared git command and returns its trimmed standard output
+func gitOutput(cmd *exec.Cmd) (out string, err error) {
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+	outb, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s: %s", strings.Join(cmd.Args, " "), strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(string(outb)), nil
+}
+
+//LocalReplicaState returns the commits a local replica holds and the head version of each of its branches
+func LocalReplicaState(dir, datasetID string) (state *client.ReplicaState, versions []*client.DatasetVersion, err error) {
+	repo := ReplicaPath(dir, datasetID)
+	out, err := gitOutput(gitCmd(repo, "for-each-ref", "--format=%(refname)\t%(objectname)\t%(*objectname)", "refs/heads", "refs/tags"))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list refs")
+	}
+
+	state = &client.ReplicaState{DatasetID: datasetID, Refs: map[string]string{}}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+
+		commit := fields[1]
+		if fields[2] != "" {
+			commit = fields[2] //annotated tags point at the tag object, we want the commit
+		}
+
+		if strings.HasPrefix(fields[0], "refs/heads/") {
+			branch := strings.TrimPrefix(fields[0], "refs/heads/")
+			state.Refs[branch] = commit
+
+			ver := &client.DatasetVersion{DatasetID: datasetID, Version: commit, Branch: branch}
+			if ver.Parent, err = gitOutput(gitCmd(repo, "rev-parse", "--verify", "--quiet", commit+"^")); err != nil {
+				ver.Parent = "" //root commit, or the parent was cut off by a shallow fetch
+			}
+
+			versions = append(versions, ver)
+			continue
+		}
+
+		state.Refs[strings.TrimPrefix(fields[0], "refs/tags/")] = commit
+	}
+
+	if head, err := gitOutput(gitCmd(repo, "rev-parse", "--verify", "--quiet", "HEAD")); err == nil {
+		state.Head = head
+	}
+
+	return state, versions, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSyncReplicaRefusesOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_replicas_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "pwned")
+	if _, err = SyncReplica(dir, "ds", "", 0, []string{"--upload-pack=touch " + marker}); err == nil || !strings.Contains(err.Error(), "not a valid source") {
+		t.Errorf("expected a source that looks like an option to be refused, got %v", err)
+	}
+
+	if _, err = os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatal("expected the source to never reach git as an option")
+	}
+
+	if _, err = SyncReplica(dir, "ds", "--output=x", 0, nil); err == nil {
+		t.Error("expected a version that looks like an option to be refused")
+	}
+
+	if _, err = SyncReplica(dir, "../ds", "", 0, nil); err == nil {
+		t.Error("expected a dataset id that is a path to be refused")
+	}
+}
+
+func TestSyncReplicaFetchesOldVersionsBeyondDepth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_replicas_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	var versions []string
+	for i, args := range [][]string{{"init", "--quiet", src}, {"commit", "--allow-empty", "-m", "v1"}, {"commit", "--allow-empty", "-m", "v2"}, {"commit", "--allow-empty", "-m", "v3"}} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=line", "-c", "user.email=line@localhost"}, args...)...)
+		if i > 0 {
+			cmd.Dir = src
+		}
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("failed to prepare source: %v: %s", err, out)
+		}
+
+		if i > 0 {
+			cmd = exec.Command("git", "rev-parse", "HEAD")
+			cmd.Dir = src
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			versions = append(versions, strings.TrimSpace(string(out)))
+		}
+	}
+
+	replicas := filepath.Join(dir, "replicas")
+	if _, err = SyncReplica(replicas, "ds", "", 1, []string{"file://" + src}); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := ReplicaPath(replicas, "ds")
+	if !hasCommit(repo, versions[2]) || hasCommit(repo, versions[0]) {
+		t.Fatal("expected only the most recent version to be fetched")
+	}
+
+	if _, err = SyncReplica(replicas, "ds", versions[0], 1, []string{"file://" + src}); err != nil {
+		t.Fatalf("expected a version beyond the depth to be fetched, got %v", err)
+	}
+}
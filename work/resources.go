@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//Resources is what the host has to offer to tasks
+type Resources struct {
+	CPUs     float64
+	MemoryMB int64
+}
+
+//DetectResources returns the cpus the worker may use and the total memory of the host. Memory is zero, and thus not accounted for, when it can't be determined e.g. on hosts without /proc
+func DetectResources() (res *Resources) {
+	res = &Resources{CPUs: float64(runtime.NumCPU())}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return res
+	}
+
+	defer f.Close()
+	if mb, err := parseMemInfo(f); err == nil {
+		res.MemoryMB = mb
+	}
+
+	return res
+}
+
+//Reserve returns the resources that are left after the host kept the reserve for itself, never less than nothing
+func (r *Resources) Reserve(cpus float64, memoryMB int64) *Resources {
+	left := &Resources{CPUs: r.CPUs - cpus, MemoryMB: r.MemoryMB - memoryMB}
+	if left.CPUs < 0 {
+		left.CPUs = 0
+	}
+
+	if left.MemoryMB < 0 {
+		left.MemoryMB = 0
+	}
+
+	return left
+}
+
+//parseMemInfo reads the total memory in megabytes from the format of /proc/meminfo
+func parseMemInfo(r io.Reader) (mb int64, err error) {
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to parse total memory")
+		}
+
+		return kb / 1024, nil
+	}
+
+	if err = scan.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to read memory info")
+	}
+
+	return 0, errors.New("memory info has no total")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMemInfo(t *testing.T) {
+	mb, err := parseMemInfo(strings.NewReader("MemTotal:       16318664 kB\nMemFree:         1024000 kB\n"))
+	if err != nil || mb != 15936 {
+		t.Fatalf("expected 15936 MB, got %d (%v)", mb, err)
+	}
+
+	if _, err = parseMemInfo(strings.NewReader("MemFree: 1024 kB\n")); err == nil {
+		t.Error("expected memory info without a total to fail")
+	}
+}
+
+func TestDetectResources(t *testing.T) {
+	if res := DetectResources(); res.CPUs < 1 || res.MemoryMB < 0 {
+		t.Fatalf("expected at least one cpu and no negative memory, got %+v", res)
+	}
+}
+
+func TestResourcesReserve(t *testing.T) {
+	res := (&Resources{CPUs: 8, MemoryMB: 16384}).Reserve(1.5, 1024)
+	if res.CPUs != 6.5 || res.MemoryMB != 15360 {
+		t.Fatalf("expected the reserve to be subtracted, got %+v", res)
+	}
+
+	if res = (&Resources{CPUs: 1, MemoryMB: 512}).Reserve(2, 1024); res.CPUs != 0 || res.MemoryMB != 0 {
+		t.Fatalf("expected a reserve larger than the host to leave nothing, got %+v", res)
+	}
+}
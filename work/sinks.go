@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//logLine is how a log event is encoded by the sinks
+type logLine struct {
+	Stream string `json:"stream,omitempty"`
+	T      int64  `json:"t"`
+	Line   string `json:"line"`
+}
+
+//cloudWatchStream holds the state of a single log stream, puts to the same stream must be sequenced
+type cloudWatchStream struct {
+	mu      sync.Mutex
+	created bool
+	token   *string
+}
+
+//CloudWatchSink puts log events in a stream of a cloudwatch log group, streams are created when first used
+type CloudWatchSink struct {
+	Group string
+
+	cwatch  *cloudwatchlogs.CloudWatchLogs
+	mu      sync.Mutex
+	streams map[string]*cloudWatchStream
+}
+
+//NewCloudWatchSink creates a sink for the given log group
+func NewCloudWatchSink(cwatch *cloudwatchlogs.CloudWatchLogs, group string) *CloudWatchSink {
+	return &CloudWatchSink{Group: group, cwatch: cwatch, streams: map[string]*cloudWatchStream{}}
+}
+
+//Put creates the stream if needed and puts the events with the stream's sequence token, when the token is rejected it is looked up and the put is tried once more
+func (s *CloudWatchSink) Put(stream string, evs []*LogEvent) (err error) {
+	s.mu.Lock()
+	st, ok := s.streams[stream]
+	if !ok {
+		st = &cloudWatchStream{}
+		s.streams[stream] = st
+	}
+	s.mu.Unlock()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.created {
+		if _, err = s.cwatch.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(s.Group),
+			LogStreamName: aws.String(stream),
+		}); err != nil && !isAWSErr(err, cloudwatchlogs.ErrCodeResourceAlreadyExistsException) {
+			return errors.Wrap(err, "failed to create log stream")
+		} else if err != nil {
+			if st.token, err = s.sequenceToken(stream); err != nil {
+				return err
+			}
+		}
+
+		st.created = true
+	}
+
+	in := &cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(s.Group),
+		LogStreamName: aws.String(stream),
+	}
+
+	for _, ev := range evs {
+		msg, err := json.Marshal(logLine{T: ev.T.UnixNano(), Line: ev.Line})
+		if err != nil {
+			return errors.Wrap(err, "failed to encode log event")
+		}
+
+		in.LogEvents = append(in.LogEvents, &cloudwatchlogs.InputLogEvent{
+			Timestamp: aws.Int64(ev.T.UnixNano() / 1000 / 1000), //only milliseconds are accepted (visible)
+			Message:   aws.String(string(msg)),
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		in.SequenceToken = st.token
+		out, perr := s.cwatch.PutLogEvents(in)
+		if perr == nil {
+			st.token = out.NextSequenceToken
+			return nil
+		}
+
+		accepted := isAWSErr(perr, cloudwatchlogs.ErrCodeDataAlreadyAcceptedException)
+		if !accepted && !isAWSErr(perr, cloudwatchlogs.ErrCodeInvalidSequenceTokenException) {
+			return errors.Wrap(perr, "failed to put log events")
+		}
+
+		if st.token, err = s.sequenceToken(stream); err != nil {
+			return err
+		}
+
+		if accepted {
+			return nil //a retry of a batch that did arrive
+		}
+	}
+
+	return errors.New("log stream sequence token keeps changing")
+}
+
+//Close does nothing, each put is send right away
+func (s *CloudWatchSink) Close() error {
+	return nil
+}
+
+//sequenceToken looks up the token the next put to a stream must use
+func (s *CloudWatchSink) sequenceToken(stream string) (token *string, err error) {
+	out, err := s.cwatch.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(s.Group),
+		LogStreamNamePrefix: aws.String(stream),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe log stream")
+	}
+
+	for _, ls := range out.LogStreams {
+		if aws.StringValue(ls.LogStreamName) == stream {
+			return ls.UploadSequenceToken, nil
+		}
+	}
+
+	return nil, errors.Errorf("log stream '%s' doesn't exist", stream)
+}
+
+//isAWSErr returns whether an error is an aws error with the given code
+func isAWSErr(err error, code string) bool {
+	aerr, ok := errors.Cause(err).(awserr.Error)
+	return ok && aerr.Code() == code
+}
+
+//FileSink writes each stream to a file of json lines in a directory, files are rotated when they grow too large
+type FileSink struct {
+	Dir      string
+	MaxBytes int64 //zero disables rotation
+	MaxFiles int   //rotated files that are kept
+
+	mu sync.Mutex
+}
+
+//NewFileSink creates a sink that writes to dir
+func NewFileSink(dir string, maxBytes int64, maxFiles int) (s *FileSink, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create log directory")
+	}
+
+	return &FileSink{Dir: dir, MaxBytes: maxBytes, MaxFiles: maxFiles}, nil
+}
+
+//Path returns the file a stream is currently written to
+func (s *FileSink) Path(stream string) string {
+	return filepath.Join(s.Dir, filepath.Base(stream)+".log")
+}
+
+//Put appends the events to the stream's file, the file is rotated first if the events would make it too large
+func (s *FileSink) Put(stream string, evs []*LogEvent) (err error) {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	for _, ev := range evs {
+		if err = enc.Encode(logLine{T: ev.T.UnixNano(), Line: ev.Line}); err != nil {
+			return errors.Wrap(err, "failed to encode log event")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.Path(stream)
+	if fi, err := os.Stat(path); err == nil && s.MaxBytes > 0 && fi.Size()+int64(buf.Len()) > s.MaxBytes {
+		if err = s.rotate(path); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open log file")
+	}
+
+	defer f.Close()
+	if _, err = buf.WriteTo(f); err != nil {
+		return errors.Wrap(err, "failed to write log file")
+	}
+
+	return nil
+}
+
+//Close does nothing, files are closed after each put
+func (s *FileSink) Close() error {
+	return nil
+}
+
+//rotate shifts the numbered files of a stream and drops the oldest
+func (s *FileSink) rotate(path string) (err error) {
+	if s.MaxFiles < 1 {
+		return errors.Wrap(os.Remove(path), "failed to remove log file")
+	}
+
+	for i := s.MaxFiles - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to rotate log file")
+		}
+	}
+
+	if err = os.Rename(path, path+".1"); err != nil {
+		return errors.Wrap(err, "failed to rotate log file")
+	}
+
+	return nil
+}
+
+//JSONSink writes every event as a json line that names its stream, e.g. to stdout for a log collector on the host
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+//NewJSONSink creates a sink that writes to w
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+//Put writes the events as json lines
+func (s *JSONSink) Put(stream string, evs []*LogEvent) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	enc := json.NewEncoder(s.w)
+	for _, ev := range evs {
+		if err = enc.Encode(logLine{Stream: stream, T: ev.T.UnixNano(), Line: ev.Line}); err != nil {
+			return errors.Wrap(err, "failed to write log event")
+		}
+	}
+
+	return nil
+}
+
+//Close does nothing, the writer is owned by the caller
+func (s *JSONSink) Close() error {
+	return nil
+}
+
+//HTTPSink posts batches of events as json to an endpoint
+type HTTPSink struct {
+	URL string
+
+	client *http.Client
+}
+
+//NewHTTPSink creates a sink that posts to the given url
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{URL: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+//Put posts the events of a batch at once, any response other than 2xx fails the put
+func (s *HTTPSink) Put(stream string, evs []*LogEvent) (err error) {
+	batch := struct {
+		Stream string     `json:"stream"`
+		Events []*logLine `json:"events"`
+	}{Stream: stream}
+
+	for _, ev := range evs {
+		batch.Events = append(batch.Events, &logLine{T: ev.T.UnixNano(), Line: ev.Line})
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode log events")
+	}
+
+	resp, err := s.client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to post log events")
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("log endpoint responded with %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+//Close does nothing, each put is send right away
+func (s *HTTPSink) Close() error {
+	return nil
+}
+
+//LineSink uploads the output of allocs to the line server, streams are named after the alloc they hold the output of
+type LineSink struct {
+	PoolID string
+
+	client   *client.Client
+	workerID func() string
+}
+
+//NewLineSink creates a sink that uploads as the worker that is currently registered
+func NewLineSink(c *client.Client, poolID string, workerID func() string) *LineSink {
+	return &LineSink{PoolID: poolID, client: c, workerID: workerID}
+}
+
+//Put uploads the events as a single chunk
+func (s *LineSink) Put(stream string, evs []*LogEvent) (err error) {
+	in := &client.PutAllocLogsInput{
+		PoolID:   s.PoolID,
+		WorkerID: s.workerID(),
+		AllocID:  stream,
+	}
+
+	for _, ev := range evs {
+		in.Lines = append(in.Lines, &client.LogLine{T: ev.T.UnixNano(), Line: ev.Line})
+	}
+
+	if _, err = s.client.PutAllocLogs(in); err != nil {
+		return errors.Wrap(err, "failed to upload logs")
+	}
+
+	return nil
+}
+
+//Close does nothing, each put is send right away
+func (s *LineSink) Close() error {
+	return nil
+}
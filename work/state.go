@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/microfactory/line/line/client"
+	"github.com/pkg/errors"
+)
+
+//WorkerState is what the worker persists to pick up where it left off when it restarts
+type WorkerState struct {
+	Worker *client.RegisterWorkerOutput `json:"worker,omitempty"`
+	Runs   map[string]*Run              `json:"runs"`
+}
+
+//StateFile stores the worker state on local disk
+type StateFile struct {
+	Path string
+}
+
+//Load reads the state, a file that doesn't exist holds an empty state
+func (f *StateFile) Load() (st *WorkerState, err error) {
+	st = &WorkerState{Runs: map[string]*Run{}}
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read state file")
+	}
+
+	if err = json.Unmarshal(data, st); err != nil {
+		return nil, errors.Wrap(err, "failed to decode state file")
+	}
+
+	if st.Runs == nil {
+		st.Runs = map[string]*Run{}
+	}
+
+	return st, nil
+}
+
+//Save writes the state to a temporary file that replaces the state file, such that a crash never leaves half a state behind
+func (f *StateFile) Save(st *WorkerState) (err error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode state")
+	}
+
+	if err = os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return errors.Wrap(err, "failed to create state directory")
+	}
+
+	tmp := f.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+
+	if err = os.Rename(tmp, f.Path); err != nil {
+		return errors.Wrap(err, "failed to replace state file")
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microfactory/line/line/client"
+)
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "line_state_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	f := &StateFile{Path: filepath.Join(dir, "state", "worker.json")}
+	st, err := f.Load()
+	if err != nil || st.Worker != nil || len(st.Runs) != 0 {
+		t.Fatalf("expected a missing file to hold an empty state, got %+v (%v)", st, err)
+	}
+
+	st.Worker = &client.RegisterWorkerOutput{WorkerID: "w1"}
+	st.Runs["a1"] = &Run{
+		Alloc:     &client.Alloc{AllocID: "a1"},
+		ExecID:    "c1",
+		Checkouts: []*Checkout{{DatasetID: "ds", Path: "/co/a1/out/ds", Output: true}},
+		LogOffset: 42,
+		Stopped:   true,
+	}
+
+	if err = f.Save(st); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err = f.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	run := st.Runs["a1"]
+	if st.Worker.WorkerID != "w1" || run == nil || run.ExecID != "c1" || run.LogOffset != 42 || !run.Checkouts[0].Output {
+		t.Fatalf("expected state to survive a round trip, got %+v", st)
+	}
+
+	if run.Stopped {
+		t.Error("expected stopped to not be persisted")
+	}
+}